@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ---- Batch Summaries ----
+// Dry-run summarization leaves one summarization_contexts row per chunk.
+// These are replayed through the OpenAI Batch API at half the price of
+// direct calls: pending contexts are submitted as chat completion requests
+// with custom_id "ctx-<id>", and collected summaries are written back to
+// their context rows and to the chunk cache, so a later non-dry summarize
+// only has to run the reductions. Timeline windows whose chunks are all done
+// become conversation_summaries rows.
+
+// The Batch API allows 50000 requests per file; timeline chunks are up to
+// 25k tokens, so stay well below the 200MB file limit too.
+const maxSummaryBatchRequests = 1000
+
+type pendingContext struct {
+	ID        int64
+	Prompt    string
+	ChunkText string
+}
+
+func contextCustomID(id int64) string {
+	return fmt.Sprintf("ctx-%d", id)
+}
+
+func contextIDFromCustomID(customID string) (int64, bool) {
+	id, err := strconv.ParseInt(strings.TrimPrefix(customID, "ctx-"), 10, 64)
+	return id, err == nil && strings.HasPrefix(customID, "ctx-")
+}
+
+func GetPendingContexts(db *sql.DB, afterID int64, limit int) ([]pendingContext, error) {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(prompt, ''), COALESCE(chunk_text, '')
+		FROM summarization_contexts
+		WHERE status = 'pending' AND id > ?
+		ORDER BY id
+		LIMIT ?
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pending []pendingContext
+	for rows.Next() {
+		var c pendingContext
+		if err := rows.Scan(&c.ID, &c.Prompt, &c.ChunkText); err != nil {
+			return nil, err
+		}
+		pending = append(pending, c)
+	}
+	return pending, rows.Err()
+}
+
+// summaryBatchLines builds the same request summarizeChunkNode would send
+func summaryBatchLines(pending []pendingContext) []openai.BatchLineItem {
+	lines := make([]openai.BatchLineItem, len(pending))
+	for i, c := range pending {
+		system := c.Prompt
+		if system == "" {
+			system = chunkSystemPrompt
+		}
+		lines[i] = openai.BatchChatCompletionRequest{
+			CustomID: contextCustomID(c.ID),
+			Body: openai.ChatCompletionRequest{
+				Model: summaryModel,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: openai.ChatMessageRoleSystem, Content: system},
+					{Role: openai.ChatMessageRoleUser, Content: chunkPrompt(c.ChunkText)},
+				},
+				ResponseFormat: &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject},
+			},
+			Method: "POST",
+			URL:    openai.BatchEndpointChatCompletions,
+		}
+	}
+	return lines
+}
+
+func markContextsSubmitted(db *sql.DB, batchID string, pending []pendingContext) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO batch_jobs (batch_id, completed, kind, status) VALUES (?, 0, 'summaries', 'validating')`, batchID); err != nil {
+		return err
+	}
+	for _, c := range pending {
+		if _, err := tx.Exec(`UPDATE summarization_contexts SET status = 'submitted', batch_id = ?, error = NULL WHERE id = ?`, batchID, c.ID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// One line of a batch output or error file
+type summaryBatchLine struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int                           `json:"status_code"`
+		Body       openai.ChatCompletionResponse `json:"body"`
+	} `json:"response"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// ApplySummaryBatchOutput writes the results in a batch output (or error)
+// file back to their contexts. Completed summaries also go into the chunk
+// cache under the context's chunk hash.
+func ApplySummaryBatchOutput(db *sql.DB, r io.Reader) (done, failed int, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var line summaryBatchLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			log.Printf("Skipping line (unmarshal error): %v", err)
+			continue
+		}
+		id, ok := contextIDFromCustomID(line.CustomID)
+		if !ok {
+			log.Printf("Skipping line with unknown custom_id %q", line.CustomID)
+			continue
+		}
+
+		var problem string
+		switch {
+		case line.Error != nil:
+			problem = fmt.Sprintf("%s: %s", line.Error.Code, line.Error.Message)
+		case line.Response == nil:
+			problem = "no response"
+		case line.Response.StatusCode != 200:
+			problem = fmt.Sprintf("status %d", line.Response.StatusCode)
+		case len(line.Response.Body.Choices) == 0:
+			problem = "no choices in response"
+		}
+		if problem != "" {
+			if _, err := db.Exec(`UPDATE summarization_contexts SET status = 'failed', error = ? WHERE id = ?`, problem, id); err != nil {
+				return done, failed, err
+			}
+			failed++
+			continue
+		}
+
+		hash, threadPath, postIDs, err := contextPosts(db, id)
+		if err == sql.ErrNoRows {
+			log.Printf("Skipping line for missing context %d", id)
+			continue
+		}
+		if err != nil {
+			return done, failed, err
+		}
+		known := make(map[string]bool, len(postIDs))
+		for _, postID := range postIDs {
+			known[postID] = true
+		}
+		if len(known) == 0 && threadPath != "" {
+			// Chunks rendered before headers carried IDs: any post of the
+			// thread is one the model could have seen
+			posts, err := GetPostsByThread(db, threadPath)
+			if err != nil {
+				return done, failed, err
+			}
+			known = postIDSet(posts)
+		}
+		summary, citations := parseCitations(line.Response.Body.Choices[0].Message.Content, known)
+		if _, err := db.Exec(`UPDATE summarization_contexts SET status = 'done', summary = ?, citations = ?, error = NULL WHERE id = ?`,
+			summary, encodeCitations(citations), id); err != nil {
+			return done, failed, err
+		}
+		if hash != "" {
+			if err := saveCachedSummary(db, hash, 0, threadPath, postIDs, nil, summary, citations); err != nil {
+				fmt.Printf("Failed to cache chunk summary: %v\n", err)
+			}
+		}
+		done++
+	}
+	return done, failed, scanner.Err()
+}
+
+var chunkHeaderPostID = regexp.MustCompile(`(?m)^.* \(([^()\s]+)\) \[[^\]\n]*\]:$`)
+
+// contextPosts returns a context's chunk hash, thread and the IDs of the
+// posts in its chunk. Contexts saved before post IDs were recorded fall back
+// to the IDs in the chunk's post headers.
+func contextPosts(db *sql.DB, id int64) (hash, threadPath string, postIDs []string, err error) {
+	var h, tp, idsJSON, chunkText sql.NullString
+	err = db.QueryRow(`SELECT chunk_hash, thread_path, post_ids, chunk_text FROM summarization_contexts WHERE id = ?`, id).
+		Scan(&h, &tp, &idsJSON, &chunkText)
+	if err != nil {
+		return "", "", nil, err
+	}
+	hash, threadPath = h.String, tp.String
+	if idsJSON.String != "" {
+		if err := json.Unmarshal([]byte(idsJSON.String), &postIDs); err != nil {
+			return hash, threadPath, nil, fmt.Errorf("context %d post_ids: %w", id, err)
+		}
+	}
+	if len(postIDs) == 0 {
+		for _, m := range chunkHeaderPostID.FindAllStringSubmatch(chunkText.String, -1) {
+			postIDs = append(postIDs, m[1])
+		}
+	}
+	return hash, threadPath, postIDs, nil
+}
+
+// contextSummaries returns the summaries of the given context IDs, in order,
+// or false while any of them is not done yet.
+func contextSummaries(db *sql.DB, ids []string) ([]summaryNode, bool, error) {
+	summaries := make([]summaryNode, 0, len(ids))
+	for _, id := range ids {
+		var status string
+		var summary, citations sql.NullString
+		err := db.QueryRow(`SELECT status, summary, citations FROM summarization_contexts WHERE id = ?`, strings.TrimSpace(id)).Scan(&status, &summary, &citations)
+		if err == sql.ErrNoRows {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if status != "done" {
+			return nil, false, nil
+		}
+		summaries = append(summaries, summaryNode{Summary: summary.String, Citations: decodeCitations(citations)})
+	}
+	return summaries, true, nil
+}
+
+// FinalizeTimelineContexts turns dry-run timeline windows whose chunks all
+// have a summary into conversation_summaries rows, joined the way Timeline
+// joins them, and links each context to its row.
+func FinalizeTimelineContexts(db *sql.DB) (int, error) {
+	type windowContext struct {
+		ID                   int64
+		Username, ThreadPath string
+		Start, End           int64
+		ChunkIDs             string
+	}
+	rows, err := db.Query(`
+		SELECT id, username, thread_path, start, end, chunk_ids
+		FROM conversation_timeline_contexts
+		WHERE summary_id IS NULL AND COALESCE(chunk_ids, '') != ''
+		ORDER BY id
+	`)
+	if err != nil {
+		return 0, err
+	}
+	var windows []windowContext
+	for rows.Next() {
+		var w windowContext
+		if err := rows.Scan(&w.ID, &w.Username, &w.ThreadPath, &w.Start, &w.End, &w.ChunkIDs); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		windows = append(windows, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	finalized := 0
+	for _, w := range windows {
+		summaries, ready, err := contextSummaries(db, strings.Split(w.ChunkIDs, ","))
+		if err != nil {
+			return finalized, err
+		}
+		if !ready {
+			continue
+		}
+		convo := Conversation{ThreadPath: w.ThreadPath, Start: w.Start, End: w.End}
+		var postCount int
+		db.QueryRow(`SELECT COUNT(*) FROM forum_posts WHERE thread_path = ? AND timestamp >= ? AND timestamp < ?`, w.ThreadPath, w.Start, w.End).Scan(&postCount)
+		summary, citations := joinWindowSummaries(summaries)
+		summaryID, err := saveConversationSummary(db, w.Username, convo, postCount, summary, citations)
+		if err != nil {
+			return finalized, err
+		}
+		if _, err := db.Exec(`UPDATE conversation_timeline_contexts SET summary_id = ? WHERE id = ?`, summaryID, w.ID); err != nil {
+			return finalized, err
+		}
+		finalized++
+	}
+	return finalized, nil
+}
+
+// readyThreadContexts lists dry-run thread contexts whose chunks are all
+// summarized but that have no stored thread summary yet.
+func readyThreadContexts(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT DISTINCT c.thread_path, c.ids
+		FROM summarized_thread_contexts c
+		WHERE NOT EXISTS (SELECT 1 FROM thread_summaries s WHERE s.thread_path = c.thread_path)
+		ORDER BY c.thread_path
+	`)
+	if err != nil {
+		return nil, err
+	}
+	type threadContext struct{ path, ids string }
+	var contexts []threadContext
+	for rows.Next() {
+		var c threadContext
+		if err := rows.Scan(&c.path, &c.ids); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		contexts = append(contexts, c)
+	}
+	rows.Close()
+
+	var ready []string
+	seen := make(map[string]bool)
+	for _, c := range contexts {
+		if seen[c.path] || c.ids == "" {
+			continue
+		}
+		if _, ok, err := contextSummaries(db, strings.Split(c.ids, ",")); err != nil {
+			return nil, err
+		} else if ok {
+			seen[c.path] = true
+			ready = append(ready, c.path)
+		}
+	}
+	return ready, nil
+}
+
+// ---- CLI ----
+// SubmitSummaryBatches submits every pending context, in batches of up to
+// maxSummaryBatchRequests. With dryRun the batch files are written to OUTDIR
+// instead and nothing is marked submitted.
+func SubmitSummaryBatches(dryRun bool) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	submitted := 0
+	var lastID int64
+	for batchNum := 1; ; batchNum++ {
+		pending, err := GetPendingContexts(db, lastID, maxSummaryBatchRequests)
+		if err != nil {
+			log.Fatalf("failed to load pending contexts: %v", err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		lastID = pending[len(pending)-1].ID
+		lines := summaryBatchLines(pending)
+		submitted += len(pending)
+
+		if dryRun {
+			os.MkdirAll(OUTDIR, 0755)
+			path := filepath.Join(OUTDIR, fmt.Sprintf("summaries_batch_%d.jsonl", batchNum))
+			var b strings.Builder
+			for _, line := range lines {
+				b.Write(line.MarshalBatchLineItem())
+				b.WriteString("\n")
+			}
+			if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+				log.Fatalf("failed to write %s: %v", path, err)
+			}
+			fmt.Printf("Dry run: wrote %d requests to %s\n", len(lines), path)
+			continue
+		}
+
+		resp, err := client.CreateBatchWithUploadFile(context.Background(), openai.CreateBatchWithUploadFileRequest{
+			Endpoint:         openai.BatchEndpointChatCompletions,
+			CompletionWindow: "24h",
+			UploadBatchFileRequest: openai.UploadBatchFileRequest{
+				FileName: fmt.Sprintf("summaries_batch_%d.jsonl", batchNum),
+				Lines:    lines,
+			},
+		})
+		if err != nil {
+			log.Fatalf("failed to create batch: %v", err)
+		}
+		if err := markContextsSubmitted(db, resp.ID, pending); err != nil {
+			log.Fatalf("batch %s was created but could not be recorded: %v", resp.ID, err)
+		}
+		fmt.Printf("Submitted batch %s with %d contexts\n", resp.ID, len(pending))
+	}
+	if submitted == 0 {
+		fmt.Println("No pending summarization contexts.")
+		return
+	}
+	if !dryRun {
+		fmt.Printf("Submitted %d contexts; run -mode collect-summary-batches to fetch the results\n", submitted)
+	}
+}
+
+// CollectSummaryBatches checks every open summary batch, applies the output
+// of finished ones and returns the contexts of failed or expired ones to
+// pending so the next submit retries them.
+func CollectSummaryBatches() {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT batch_id FROM batch_jobs WHERE kind = 'summaries' AND completed = 0 ORDER BY id`)
+	if err != nil {
+		log.Fatalf("failed to list batches: %v", err)
+	}
+	var batchIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			log.Fatalf("failed to list batches: %v", err)
+		}
+		batchIDs = append(batchIDs, id)
+	}
+	rows.Close()
+
+	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	ctx := context.Background()
+	applyFile := func(fileID *string) (int, int) {
+		if fileID == nil || *fileID == "" {
+			return 0, 0
+		}
+		content, err := client.GetFileContent(ctx, *fileID)
+		if err != nil {
+			log.Fatalf("failed to download %s: %v", *fileID, err)
+		}
+		defer content.Close()
+		done, failed, err := ApplySummaryBatchOutput(db, content)
+		if err != nil {
+			log.Fatalf("failed to apply %s: %v", *fileID, err)
+		}
+		return done, failed
+	}
+
+	for _, id := range batchIDs {
+		batch, err := client.RetrieveBatch(ctx, id)
+		if err != nil {
+			log.Printf("Failed to retrieve batch %s: %v", id, err)
+			continue
+		}
+		db.Exec(`UPDATE batch_jobs SET status = ? WHERE batch_id = ?`, batch.Status, id)
+		counts := batch.RequestCounts
+		switch batch.Status {
+		case "completed", "failed", "expired", "cancelled":
+			// Expired and cancelled batches still report what did finish
+			done, failed := applyFile(batch.OutputFileID)
+			d, f := applyFile(batch.ErrorFileID)
+			done, failed = done+d, failed+f
+			res, err := db.Exec(`UPDATE summarization_contexts SET status = 'pending', batch_id = NULL WHERE batch_id = ? AND status = 'submitted'`, id)
+			if err != nil {
+				log.Fatalf("failed to reset contexts of %s: %v", id, err)
+			}
+			requeued, _ := res.RowsAffected()
+			db.Exec(`UPDATE batch_jobs SET completed = 1 WHERE batch_id = ?`, id)
+			fmt.Printf("%s %s: %d summaries, %d failed, %d returned to pending\n", id, batch.Status, done, failed, requeued)
+		default:
+			fmt.Printf("%s %s: %d/%d done, %d failed\n", id, batch.Status, counts.Completed, counts.Total, counts.Failed)
+		}
+	}
+
+	finalized, err := FinalizeTimelineContexts(db)
+	if err != nil {
+		log.Fatalf("failed to finalize timeline contexts: %v", err)
+	}
+	if finalized > 0 {
+		fmt.Printf("Saved %d timeline conversation summaries\n", finalized)
+	}
+	ready, err := readyThreadContexts(db)
+	if err != nil {
+		log.Fatalf("failed to check thread contexts: %v", err)
+	}
+	for _, path := range ready {
+		fmt.Printf("All chunks of %s are summarized; run -mode summarize -thread %s to reduce them\n", path, path)
+	}
+
+	var pending, submitted, failed int
+	db.QueryRow(`SELECT COUNT(*) FILTER (WHERE status = 'pending'), COUNT(*) FILTER (WHERE status = 'submitted'), COUNT(*) FILTER (WHERE status = 'failed') FROM summarization_contexts`).
+		Scan(&pending, &submitted, &failed)
+	fmt.Printf("Contexts: %d pending, %d submitted, %d failed\n", pending, submitted, failed)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplaySummaryBatch(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	var posts []ForumPost
+	for i := 0; i < 3; i++ {
+		posts = append(posts, ForumPost{PostID: fmt.Sprintf("post-%d", i), User: "Puck", Timestamp: 1459729209,
+			Message: strings.Repeat("word ", 20), ThreadPath: "board/threads/a"})
+	}
+	budget := TokenizerFor(summaryModel).Count(renderChunk(posts[:1]))
+	chunks := ChunkPosts(posts, ChunkOptions{Model: summaryModel, MaxTokens: budget})
+	var ids []string
+	for _, c := range chunks {
+		id, err := SummarizeChunk(db, nil, c, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// A second dry run reuses the pending contexts
+	if again, _ := SummarizeChunk(db, nil, chunks[0], true); again != ids[0] {
+		t.Errorf("dry run saved a second context %s for chunk %s", again, ids[0])
+	}
+	db.Exec(`INSERT INTO conversation_timeline_contexts (prompt, username, thread_path, start, end, chunk_ids) VALUES ('', 'Puck', 'board/threads/a', 1, 2, ?)`,
+		strings.Join(ids, ","))
+
+	pending, err := GetPendingContexts(db, 0, 10)
+	if err != nil || len(pending) != len(chunks) {
+		t.Fatalf("pending = %d, %v", len(pending), err)
+	}
+	line := string(summaryBatchLines(pending[:1])[0].MarshalBatchLineItem())
+	if !strings.Contains(line, `"custom_id":"ctx-`+ids[0]+`"`) || !strings.Contains(line, `"url":"/v1/chat/completions"`) {
+		t.Errorf("batch line = %s", line)
+	}
+	if err := markContextsSubmitted(db, "batch_1", pending); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := `{"custom_id": "ctx-%s", "response": {"status_code": 200, "body": {"choices": [{"message": {"role": "assistant", "content": "part %d"}}]}}, "error": null}` + "\n"
+	cited := `{"custom_id": "ctx-` + ids[1] + `", "response": {"status_code": 200, "body": {"choices": [{"message": {"role": "assistant", "content": "{\"points\": [{\"text\": \"part 1\", \"post_ids\": [\"post-1\", \"post-7\"]}]}"}}]}}, "error": null}` + "\n"
+	output := fmt.Sprintf(ok, ids[0], 0) + cited +
+		`{"custom_id": "ctx-` + ids[2] + `", "response": {"status_code": 400, "body": {}}, "error": null}` + "\n"
+	done, failed, err := ApplySummaryBatchOutput(db, strings.NewReader(output))
+	if err != nil || done != 2 || failed != 1 {
+		t.Fatalf("applied %d done, %d failed, %v", done, failed, err)
+	}
+	// Citations of posts outside the chunk are dropped
+	if node, ok := getCachedNode(db, chunkHash(chunks[1], renderChunk(chunks[1]))); !ok || node.Summary != "part 1" ||
+		len(node.Citations) != 1 || strings.Join(node.Citations[0].PostIDs, ",") != "post-1" {
+		t.Errorf("cached chunk summary = %+v, %v", node, ok)
+	}
+
+	// The window waits for its failed chunk
+	if n, err := FinalizeTimelineContexts(db); err != nil || n != 0 {
+		t.Errorf("finalized %d windows with a failed chunk, %v", n, err)
+	}
+	db.Exec(`UPDATE summarization_contexts SET status = 'done', summary = 'part 2' WHERE id = ?`, ids[2])
+	if n, err := FinalizeTimelineContexts(db); err != nil || n != 1 {
+		t.Fatalf("finalized %d windows, %v", n, err)
+	}
+	var summary string
+	db.QueryRow(`SELECT s.summary FROM conversation_summaries s JOIN conversation_timeline_contexts c ON c.summary_id = s.id`).Scan(&summary)
+	if summary != "part 0\n---\npart 1\n---\npart 2" {
+		t.Errorf("timeline summary = %q", summary)
+	}
+	if n, _ := FinalizeTimelineContexts(db); n != 0 {
+		t.Errorf("window finalized twice")
+	}
+}
+
+// Contexts saved before post IDs were recorded still get their citations
+func TestReplayLegacyContexts(t *testing.T) {
+	db := openTestDB(t)
+	if _, err := db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES ('post-5', 'Puck', 0, 1459729209, 'x', 'board/threads/old')`); err != nil {
+		t.Fatal(err)
+	}
+	withHeaders, err := db.Exec(`INSERT INTO summarization_contexts (prompt, chunk_text, thread_path, status) VALUES ('', ?, 'board/threads/a', 'pending')`,
+		"Puck (post-1) [2016-04-04 00:40]:\nOne.\nFly (the second) (post-2) [2016-04-04 00:41]:\nTwo.\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutHeaders, err := db.Exec(`INSERT INTO summarization_contexts (prompt, chunk_text, thread_path, status) VALUES ('', 'Puck [2016-04-04 00:40]:\nOne.\n', 'board/threads/old', 'pending')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := withHeaders.LastInsertId()
+	second, _ := withoutHeaders.LastInsertId()
+
+	line := `{"custom_id": "ctx-%d", "response": {"status_code": 200, "body": {"choices": [{"message": {"role": "assistant", "content": "{\"points\": [{\"text\": \"x\", \"post_ids\": %s}]}"}}]}}, "error": null}` + "\n"
+	output := fmt.Sprintf(line, first, `[\"post-1\", \"post-2\", \"post-9\"]`) +
+		fmt.Sprintf(line, second, `[\"post-5\", \"post-9\"]`) +
+		fmt.Sprintf(line, second+100, `[]`)
+	done, failed, err := ApplySummaryBatchOutput(db, strings.NewReader(output))
+	if err != nil || done != 2 || failed != 0 {
+		t.Fatalf("applied %d done, %d failed, %v", done, failed, err)
+	}
+	for id, want := range map[int64]string{first: "post-1,post-2", second: "post-5"} {
+		var citations sql.NullString
+		if err := db.QueryRow(`SELECT citations FROM summarization_contexts WHERE id = ?`, id).Scan(&citations); err != nil {
+			t.Fatal(err)
+		}
+		if c := decodeCitations(citations); len(c) != 1 || strings.Join(c[0].PostIDs, ",") != want {
+			t.Errorf("context %d citations = %+v, want %s", id, c, want)
+		}
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 
 	"github.com/qdrant/go-client/qdrant"
@@ -430,16 +429,23 @@ func ImportEmbeddingsFromJSONL(jsonlPath string, db *sql.DB, qdrantClient *qdran
 			continue
 		}
 
-		// Lookup original post
-		var post PostToEmbed
+		// Lookup original post, and the part of it that was embedded
+		postID, part := parseEmbeddingCustomID(entry.CustomID)
+		var p ForumPost
 		err := db.QueryRow(`
-			SELECT post_id, user, message, thread_path, timestamp
+			SELECT post_id, user, message, thread_path, timestamp, COALESCE(clean_message, message)
 			FROM forum_posts WHERE post_id = ?
-		`, entry.CustomID).Scan(&post.PostID, &post.User, &post.Message, &post.ThreadID, &post.Timestamp)
+		`, postID).Scan(&p.PostID, &p.User, &p.Message, &p.ThreadPath, &p.Timestamp, &p.CleanMessage)
 		if err != nil {
 			log.Printf("Skipping embedding with custom_id %s (not found in db): %v", entry.CustomID, err)
 			continue
 		}
+		parts := embeddingInputs([]ForumPost{p})
+		if part >= len(parts) {
+			log.Printf("Skipping embedding with custom_id %s (post has %d parts)", entry.CustomID, len(parts))
+			continue
+		}
+		post := parts[part]
 
 		toInsert = append(toInsert, struct {
 			Post      PostToEmbed
@@ -474,12 +480,8 @@ func batchInsertQdrant(batch []struct {
 }, qdrantClient *qdrant.Client) error {
 	points := make([]*qdrant.PointStruct, len(batch))
 	for i, item := range batch {
-		postID, err := strconv.ParseUint(item.Post.PostID, 10, 64)
-		if err != nil {
-			postID = uint64(hashString(item.Post.PostID))
-		}
 		points[i] = &qdrant.PointStruct{
-			Id:      qdrant.NewIDNum(postID),
+			Id:      qdrant.NewIDNum(embeddingPointID(item.Post)),
 			Vectors: qdrant.NewVectors(item.Embedding...),
 			Payload: qdrant.NewValueMap(map[string]any{
 				"user":      item.Post.User,
@@ -487,6 +489,7 @@ func batchInsertQdrant(batch []struct {
 				"timestamp": item.Post.Timestamp,
 				"message":   item.Post.Message,
 				"post_id":   item.Post.PostID,
+				"part":      item.Post.Part,
 			}),
 		}
 	}
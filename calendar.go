@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ---- In-World Calendar ----
+// Maps real posting dates onto in-world dates. The forum's "On the Passage
+// of Time" rules leave the pace of time to the players, so the mapping is a
+// rules file: an epoch pinning one real date to an in-world date, the
+// calendar's months, and how many in-world days pass per real day (which can
+// change from a given date on). In-world dates are opt-in: copy
+// data/tfs/calendar.example.json to data/tfs/calendar.json and fill in the
+// campaign's own epoch and months.
+const calendarPath = "data/tfs/calendar.json"
+
+type CalendarRules struct {
+	Name      string `json:"name"`
+	Era       string `json:"era"`        // suffix for year 0 on, e.g. "AC"
+	EraBefore string `json:"era_before"` // suffix for negative years, e.g. "BC"
+	Epoch     struct {
+		Real  string `json:"real"` // YYYY-MM-DD
+		Year  int    `json:"year"`
+		Month int    `json:"month"` // 1-based
+		Day   int    `json:"day"`   // 1-based
+	} `json:"epoch"`
+	Months []struct {
+		Name string `json:"name"`
+		Days int    `json:"days"`
+	} `json:"months"`
+	// Pace of in-world time. The first entry applies from the epoch (and
+	// before it); each later one from its own date on.
+	Rates []struct {
+		From           string  `json:"from"` // YYYY-MM-DD, "" for the first entry
+		DaysPerRealDay float64 `json:"days_per_real_day"`
+	} `json:"rates"`
+}
+
+type calendarRate struct {
+	from time.Time
+	rate float64
+}
+
+type Calendar struct {
+	Rules       CalendarRules
+	epoch       time.Time
+	epochOffset int // day of the in-world year the epoch falls on, 0-based
+	yearDays    int
+	rates       []calendarRate
+}
+
+type WorldDate struct {
+	Year      int
+	Month     int // 1-based
+	Day       int // 1-based
+	MonthName string
+	cal       *Calendar
+}
+
+func (d WorldDate) String() string {
+	// Years before 0 count down, with the era_before suffix
+	if d.Year < 0 {
+		return fmt.Sprintf("%d %s %d %s", d.Day, d.MonthName, -d.Year, d.cal.Rules.EraBefore)
+	}
+	return fmt.Sprintf("%d %s %d %s", d.Day, d.MonthName, d.Year, d.cal.Rules.Era)
+}
+
+func NewCalendar(rules CalendarRules) (*Calendar, error) {
+	c := &Calendar{Rules: rules}
+	if len(rules.Months) == 0 {
+		return nil, fmt.Errorf("calendar has no months")
+	}
+	for _, m := range rules.Months {
+		if m.Days <= 0 {
+			return nil, fmt.Errorf("month %q has no days", m.Name)
+		}
+		c.yearDays += m.Days
+	}
+	epoch, err := time.Parse("2006-01-02", rules.Epoch.Real)
+	if err != nil {
+		return nil, fmt.Errorf("bad epoch date: %w", err)
+	}
+	c.epoch = epoch
+	if rules.Epoch.Month < 1 || rules.Epoch.Month > len(rules.Months) {
+		return nil, fmt.Errorf("epoch month %d out of range", rules.Epoch.Month)
+	}
+	for i := 0; i < rules.Epoch.Month-1; i++ {
+		c.epochOffset += rules.Months[i].Days
+	}
+	c.epochOffset += rules.Epoch.Day - 1
+
+	if len(rules.Rates) == 0 {
+		c.rates = []calendarRate{{from: epoch, rate: 1}}
+	}
+	for i, r := range rules.Rates {
+		from := epoch
+		if i > 0 || r.From != "" {
+			if from, err = time.Parse("2006-01-02", r.From); err != nil {
+				return nil, fmt.Errorf("bad rate date: %w", err)
+			}
+		}
+		c.rates = append(c.rates, calendarRate{from: from, rate: r.DaysPerRealDay})
+	}
+	sort.Slice(c.rates, func(i, j int) bool { return c.rates[i].from.Before(c.rates[j].from) })
+	return c, nil
+}
+
+func LoadCalendar(path string) (*Calendar, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules CalendarRules
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return NewCalendar(rules)
+}
+
+// worldDaysSinceEpoch integrates the rates between the epoch and t.
+func (c *Calendar) worldDaysSinceEpoch(t time.Time) float64 {
+	if !t.After(c.epoch) {
+		return t.Sub(c.epoch).Hours() / 24 * c.rates[0].rate
+	}
+	var days float64
+	for i, r := range c.rates {
+		start := r.from
+		if start.Before(c.epoch) {
+			start = c.epoch
+		}
+		end := t
+		if i+1 < len(c.rates) && c.rates[i+1].from.Before(end) {
+			end = c.rates[i+1].from
+		}
+		if end.After(start) {
+			days += end.Sub(start).Hours() / 24 * r.rate
+		}
+	}
+	return days
+}
+
+// At returns the in-world date for a real time.
+func (c *Calendar) At(t time.Time) WorldDate {
+	day := c.epochOffset + int(math.Floor(c.worldDaysSinceEpoch(t)))
+	year := c.Rules.Epoch.Year + floorDiv(day, c.yearDays)
+	day -= floorDiv(day, c.yearDays) * c.yearDays
+	d := WorldDate{Year: year, cal: c}
+	for i, m := range c.Rules.Months {
+		if day < m.Days {
+			d.Month, d.Day, d.MonthName = i+1, day+1, m.Name
+			break
+		}
+		day -= m.Days
+	}
+	return d
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+var (
+	worldCalendar     *Calendar
+	worldCalendarOnce sync.Once
+)
+
+// WorldCalendar returns the calendar from data/tfs/calendar.json, or nil if
+// there is none; in-world dates are then simply left out.
+func WorldCalendar() *Calendar {
+	worldCalendarOnce.Do(func() {
+		c, err := LoadCalendar(calendarPath)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Printf("Warning: ignoring calendar rules: %v\n", err)
+			}
+			return
+		}
+		worldCalendar = c
+	})
+	return worldCalendar
+}
+
+// FormatWorldTime renders a unix-seconds time as the real date in UTC,
+// followed by the in-world date when a calendar is configured.
+func FormatWorldTime(ts int64) string {
+	return formatWorldTime(time.Unix(ts, 0).UTC())
+}
+
+func formatWorldTime(t time.Time) string {
+	s := t.Format("2006-01-02 15:04")
+	if c := WorldCalendar(); c != nil {
+		s += " (" + c.At(t).String() + ")"
+	}
+	return s
+}
+
+// ---- CLI ----
+func ShowCalendar(date string) {
+	c, err := LoadCalendar(calendarPath)
+	if err != nil {
+		fmt.Printf("No calendar rules: %v (copy data/tfs/calendar.example.json to start)\n", err)
+		return
+	}
+	t := time.Now().UTC()
+	if date != "" {
+		if t, err = parseDateFlag(date); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	fmt.Printf("%s: %s is %s\n", c.Rules.Name, t.Format("2006-01-02"), c.At(t))
+}
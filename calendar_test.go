@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestCalendarAt(t *testing.T) {
+	var rules CalendarRules
+	err := json.Unmarshal([]byte(`{
+		"era": "AC", "era_before": "BC",
+		"epoch": {"real": "2015-01-01", "year": 0, "month": 2, "day": 5},
+		"months": [{"name": "Frost", "days": 10}, {"name": "Thaw", "days": 10}],
+		"rates": [{"from": "", "days_per_real_day": 1}, {"from": "2015-01-11", "days_per_real_day": 2}]
+	}`), &rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCalendar(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		real string
+		want string
+	}{
+		{"2015-01-01", "5 Thaw 0 AC"},
+		{"2015-01-07", "1 Frost 1 AC"},
+		// Ten days at 1x, then two at 2x
+		{"2015-01-13", "9 Frost 1 AC"},
+		{"2014-12-26", "9 Frost 0 AC"},
+		{"2014-12-01", "4 Frost 1 BC"},
+	}
+	for _, tc := range cases {
+		real, _ := time.Parse("2006-01-02", tc.real)
+		if got := c.At(real).String(); got != tc.want {
+			t.Errorf("At(%s) = %q, want %q", tc.real, got, tc.want)
+		}
+	}
+}
+
+func TestUnixSeconds(t *testing.T) {
+	for _, ts := range []int64{1459300585, 1459300585000, 1459300585000000} {
+		if got := unixSeconds(ts); got != 1459300585 {
+			t.Errorf("unixSeconds(%d) = %d", ts, got)
+		}
+	}
+}
@@ -179,7 +179,7 @@ func extractFirstJSON(s string) (string, error) {
 
 func GetAllUserPosts(db *sql.DB, username string) ([]ForumPost, error) {
 	rows, err := db.Query(`
-		SELECT post_id, user, user_num, timestamp, message, thread_path 
+		SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message)
 		FROM forum_posts 
 		WHERE user = ? 
 		ORDER BY timestamp ASC
@@ -192,7 +192,7 @@ func GetAllUserPosts(db *sql.DB, username string) ([]ForumPost, error) {
 	var posts []ForumPost
 	for rows.Next() {
 		var p ForumPost
-		err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath)
+		err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage)
 		if err != nil {
 			return nil, err
 		}
@@ -204,8 +204,7 @@ func GetAllUserPosts(db *sql.DB, username string) ([]ForumPost, error) {
 func ConcatenatePosts(posts []ForumPost) string {
 	var builder strings.Builder
 	for _, post := range posts {
-		// Include thread or timestamp if you want context
-		builder.WriteString(fmt.Sprintf("[Thread: %s, Time: %d]\n%s\n\n", post.ThreadPath, post.Timestamp, post.Message))
+		builder.WriteString(fmt.Sprintf("[Thread: %s, Time: %s]\n%s\n\n", post.ThreadPath, FormatWorldTime(post.Timestamp), post.Text()))
 	}
 	return builder.String()
 }
@@ -218,8 +217,6 @@ func min(a, b int) int {
 }
 
 func Charactar(username string, dryRun bool) error{
-	maxChars := 500_000
-
 	// Use pure sql
 	db, err := sql.Open("sqlite", "data/docs.db")
 	if err != nil {
@@ -230,12 +227,12 @@ func Charactar(username string, dryRun bool) error{
 	posts, err := GetAllUserPosts(db, username)
 	if err != nil || len(posts) == 0 {
 
-		log.Println("failed to get posts: %v", err)
-		return fmt.Errorf("no posts found for user %s", username)
+		log.Printf("failed to get posts: %v", err)
+		return noPostsError(db, username)
 	}
 	fmt.Printf("Found %d posts for %s\n", len(posts), username)
 
-	chunks := ChunkPosts(posts, maxChars)
+	chunks := ChunkPosts(posts, ChunkOptions{Model: openai.GPT4o, MaxTokens: TokenBudget(openai.GPT4o, 0)})
 	fmt.Printf("Split into %d chunks.\n", len(chunks))
 
 	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
@@ -260,7 +257,7 @@ func Charactar(username string, dryRun bool) error{
 	out, _ := json.MarshalIndent(masterSheet, "", "  ")
 	fmt.Printf("Master character sheet for %s:\n%s\n", username, out)
 	if !dryRun {
-		outputPath := fmt.Sprintf("data/tfs/characters/%s.json", strings.ToLower(strings.ReplaceAll(username, " ", "-")))
+		outputPath := characterSheetFile(username)
 		if err := os.WriteFile(outputPath, out, 0644); err != nil {
 			log.Fatalf("Failed to write master sheet to %s: %v", outputPath, err)
 		}
@@ -290,7 +287,7 @@ func SelectBestPosts(client *openai.Client, posts []ForumPost, charName string,
 		n := min(len(posts), 5)
 		out := make([]string, 0, n)
 		for i := 0; i < n; i++ {
-			out = append(out, posts[i].Message)
+			out = append(out, posts[i].Text())
 		}
 		return out, nil
 	}
@@ -300,7 +297,7 @@ func SelectBestPosts(client *openai.Client, posts []ForumPost, charName string,
 	// Concatenate posts with minimal context for the LLM
 	var sb strings.Builder
 	for i, post := range posts {
-		sb.WriteString(fmt.Sprintf("Post %d:\n%s\n\n", i+1, post.Message))
+		sb.WriteString(fmt.Sprintf("Post %d:\n%s\n\n", i+1, post.Text()))
 	}
 
 	systemPrompt := fmt.Sprintf(
@@ -349,8 +346,6 @@ func SelectBestPosts(client *openai.Client, posts []ForumPost, charName string,
 }
 
 func BestPosts(username string, dryRun bool) {
-	maxChars := 500_000
-
 	db, err := sql.Open("sqlite", "data/docs.db")
 	if err != nil {
 		log.Fatalf("failed to open db: %v", err)
@@ -359,12 +354,13 @@ func BestPosts(username string, dryRun bool) {
 
 	posts, err := GetAllUserPosts(db, username)
 	if err != nil || len(posts) == 0 {
-		log.Println("failed to get posts: %v", err)
+		log.Printf("failed to get posts: %v", err)
+		log.Println(noPostsError(db, username))
 		return
 	}
 	fmt.Printf("Found %d posts for %s\n", len(posts), username)
 
-	chunks := ChunkPosts(posts, maxChars)
+	chunks := ChunkPosts(posts, ChunkOptions{Model: openai.GPT4o, MaxTokens: TokenBudget(openai.GPT4o, 0)})
 	fmt.Printf("Split into %d chunks.\n", len(chunks))
 
 	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
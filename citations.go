@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ---- Citations ----
+// Chunks show the model each post's ID, and summaries come back as JSON
+// points, each a sentence or bullet with the IDs of the posts it is based
+// on, so a GM can check a recap against the posts before treating it as
+// canon. Reductions get their inputs' citations and cite the same IDs.
+type Citation struct {
+	Text    string   `json:"text"`
+	PostIDs []string `json:"post_ids"`
+}
+
+const citationInstructions = `Reply with a JSON object of the form {"points": [{"text": "...", "post_ids": ["..."]}]}, where each point is one sentence or bullet of the summary, in order, and post_ids lists the IDs of the posts it is based on, as shown after each post's author or in brackets after each point of a summary.`
+
+var jsonFence = regexp.MustCompile("(?s)^```(?:json)?\\s*(.*?)\\s*```$")
+
+// parseCitations reads a cited reply. IDs the model was not shown are
+// dropped; a reply that is not the JSON asked for is kept as plain text
+// without citations.
+func parseCitations(content string, known map[string]bool) (string, []Citation) {
+	content = strings.TrimSpace(content)
+	if m := jsonFence.FindStringSubmatch(content); m != nil {
+		content = m[1]
+	}
+	var reply struct {
+		Points []Citation `json:"points"`
+	}
+	if err := json.Unmarshal([]byte(content), &reply); err != nil || len(reply.Points) == 0 {
+		return content, nil
+	}
+	var lines []string
+	var citations []Citation
+	for _, p := range reply.Points {
+		p.Text = strings.TrimSpace(p.Text)
+		if p.Text == "" {
+			continue
+		}
+		ids := []string{}
+		for _, id := range p.PostIDs {
+			if known[id] {
+				ids = append(ids, id)
+			}
+		}
+		p.PostIDs = ids
+		lines = append(lines, p.Text)
+		citations = append(citations, p)
+	}
+	return strings.Join(lines, "\n"), citations
+}
+
+// completeCited asks for a cited summary, citing only IDs in known
+func completeCited(client *openai.Client, systemPrompt, prompt string, known map[string]bool) (string, []Citation, error) {
+	req := openai.ChatCompletionRequest{
+		Model: summaryModel,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: systemPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: prompt},
+		},
+		ResponseFormat: &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject},
+	}
+	resp, err := client.CreateChatCompletion(context.Background(), req)
+	if err != nil {
+		return "", nil, err
+	}
+	summary, citations := parseCitations(resp.Choices[0].Message.Content, known)
+	return summary, citations, nil
+}
+
+func postIDSet(posts []ForumPost) map[string]bool {
+	known := make(map[string]bool, len(posts))
+	for _, p := range posts {
+		known[p.PostID] = true
+	}
+	return known
+}
+
+func hasCitations(nodes []summaryNode) bool {
+	for _, n := range nodes {
+		if len(n.Citations) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// renderCited writes a summary with the IDs behind each point, as input for
+// a cited reduction
+func renderCited(n summaryNode) string {
+	if len(n.Citations) == 0 {
+		return n.Summary
+	}
+	var b strings.Builder
+	for _, c := range n.Citations {
+		fmt.Fprintf(&b, "- %s [%s]\n", c.Text, strings.Join(c.PostIDs, ", "))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func encodeCitations(citations []Citation) sql.NullString {
+	if len(citations) == 0 {
+		return sql.NullString{}
+	}
+	data, _ := json.Marshal(citations)
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func decodeCitations(s sql.NullString) []Citation {
+	var citations []Citation
+	if s.Valid && s.String != "" {
+		json.Unmarshal([]byte(s.String), &citations)
+	}
+	return citations
+}
+
+// FormatCitations renders points as a plain text list with their post IDs
+func FormatCitations(citations []Citation) string {
+	var b strings.Builder
+	for _, c := range citations {
+		fmt.Fprintf(&b, "- %s", c.Text)
+		if len(c.PostIDs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(c.PostIDs, ", "))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// PostURL links a ProBoards post ("post-81710") through the forum's post
+// redirect, given the URL of its thread. Posts from elsewhere have no link.
+func PostURL(threadURL, postID string) string {
+	num := strings.TrimPrefix(postID, "post-")
+	if num == postID || threadURL == "" {
+		return ""
+	}
+	u, err := url.Parse(threadURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s://%s/post/%s/thread", u.Scheme, u.Host, num)
+}
+
+// PostLabel is the short form of a post ID shown next to a claim
+func PostLabel(postID string) string {
+	return "#" + strings.TrimPrefix(postID, "post-")
+}
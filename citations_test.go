@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseCitations(t *testing.T) {
+	known := map[string]bool{"post-1": true, "post-2": true}
+	reply := "```json\n" + `{"points": [{"text": "Puck arrives.", "post_ids": ["post-1"]}, {"text": " The sun stays up. ", "post_ids": ["post-2", "post-99"]}]}` + "\n```"
+	summary, citations := parseCitations(reply, known)
+	if summary != "Puck arrives.\nThe sun stays up." {
+		t.Errorf("summary = %q", summary)
+	}
+	if len(citations) != 2 || strings.Join(citations[1].PostIDs, ",") != "post-2" {
+		t.Errorf("citations = %+v", citations)
+	}
+	if FormatCitations(citations) != "- Puck arrives. [post-1]\n- The sun stays up. [post-2]\n" {
+		t.Errorf("formatted = %q", FormatCitations(citations))
+	}
+
+	// Plain text replies are kept without citations
+	if summary, citations := parseCitations("Puck arrives.", known); summary != "Puck arrives." || citations != nil {
+		t.Errorf("plain reply = %q, %+v", summary, citations)
+	}
+}
+
+func TestPostURL(t *testing.T) {
+	for _, c := range []struct{ thread, id, want string }{
+		{"https://thefantasysandbox.boards.net/thread/3160/black-vale-information", "post-81710", "https://thefantasysandbox.boards.net/post/81710/thread"},
+		{"https://thefantasysandbox.boards.net/thread/3160/black-vale-information", "discord-1234", ""},
+		{"", "post-81710", ""},
+	} {
+		if got := PostURL(c.thread, c.id); got != c.want {
+			t.Errorf("PostURL(%q, %q) = %q, want %q", c.thread, c.id, got, c.want)
+		}
+	}
+}
@@ -117,7 +117,7 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Selecting posts for %s...", username))
 			BestPosts(username, false) // This writes to file
 			// Load the results
-			csPath := fmt.Sprintf("data/tfs/characters/%s.json", strings.ToLower(strings.ReplaceAll(username, " ", "-")))
+			csPath := characterSheetFile(username)
 			writingPath := fmt.Sprintf("data/tfs/writing/%s-best-posts.txt", strings.ToLower(strings.ReplaceAll(username, " ", "-")))
 			cs, err1 := LoadCharacterSheet(csPath)
 			writing, err2 := LoadOriginalWriting(writingPath)
@@ -174,6 +174,45 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
+	// Handle "!world <category>" to show a category's state of the world
+	if fields[0] == "world" {
+		if len(fields) < 2 {
+			s.ChannelMessageSend(m.ChannelID, "Usage: !world <category>, e.g. !world overworld")
+			return
+		}
+		summary, err := GetBoardSummary(postDb, strings.ToLower(fields[1]))
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("No roll-up for '%s' yet; run -mode rollup.", fields[1]))
+			return
+		}
+		s.ChannelMessageSend(m.ChannelID, truncate(summary.Summary, 1900))
+		return
+	}
+
+	// Handle "!lore <name>" to look up a place, faction, artifact, creature or NPC
+	if fields[0] == "lore" {
+		if len(fields) < 2 {
+			s.ChannelMessageSend(m.ChannelID, "Usage: !lore <name>, e.g. !lore Isran Empire")
+			return
+		}
+		name := strings.Join(fields[1:], " ")
+		entities, err := FindLoreEntities(postDb, name)
+		if err != nil {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Lore error: %v", err))
+			return
+		}
+		if len(entities) == 0 {
+			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("No lore entry for '%s'.", name))
+			return
+		}
+		entries := make([]string, len(entities))
+		for i, e := range entities {
+			entries[i] = FormatLoreEntity(e, 5)
+		}
+		s.ChannelMessageSend(m.ChannelID, truncate(strings.Join(entries, "\n"), 1900))
+		return
+	}
+
 	if fields[0] == "search" {
 		query := strings.Join(fields[1:], " ")
 		if query == "" {
@@ -183,8 +222,14 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		topK := 1 // Default number of results
 		results, err := SearchForumPosts(query, topK)
 		if err != nil {
-			s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Search error: %v", err))
-			return
+			// Semantic search needs OpenAI and Qdrant; keyword search works offline
+			fmt.Printf("Semantic search failed, using keyword search: %v\n", err)
+			hits, ftsErr := KeywordSearch(postDb, query, SearchOptions{Limit: 3, Highlight: [2]string{"**", "**"}})
+			if ftsErr != nil {
+				s.ChannelMessageSend(m.ChannelID, fmt.Sprintf("Search error: %v", ftsErr))
+				return
+			}
+			results = FormatSearchHits(hits)
 		}
 		if results == "" {
 			s.ChannelMessageSend(m.ChannelID, "No results found.")
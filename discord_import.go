@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ---- Discord Channel Import ----
+// Reads DiscordChatExporter JSON exports (one channel per file) into
+// forum_posts, so the rest of the pipeline works on Discord history too.
+type DiscordExport struct {
+	Guild struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"guild"`
+	Channel struct {
+		ID       string `json:"id"`
+		Category string `json:"category"`
+		Name     string `json:"name"`
+	} `json:"channel"`
+	Messages []DiscordExportMessage `json:"messages"`
+}
+
+type DiscordExportMessage struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Timestamp string `json:"timestamp"`
+	Content   string `json:"content"`
+	Author    struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		Nickname string `json:"nickname"`
+		IsBot    bool   `json:"isBot"`
+	} `json:"author"`
+	Attachments []struct {
+		URL      string `json:"url"`
+		FileName string `json:"fileName"`
+	} `json:"attachments"`
+	Reference *struct {
+		MessageID string `json:"messageId"`
+	} `json:"reference"`
+}
+
+// DiscordMapping says where channels and authors land in the forum corpus.
+// Keys may be Discord IDs or names; IDs win when both match.
+type DiscordMapping struct {
+	Channels    map[string]string               `json:"channels"` // -> thread_path
+	Authors     map[string]DiscordAuthorMapping `json:"authors"`
+	IncludeBots bool                            `json:"include_bots"`
+}
+
+// Maps a Discord author onto a forum account, so their Discord posts
+// count towards the same user (and character) as their forum posts.
+type DiscordAuthorMapping struct {
+	User    string `json:"user"`
+	UserNum int    `json:"user_num"`
+}
+
+const discordPostPrefix = "discord-"
+
+var slugRe = regexp.MustCompile(`[^a-z0-9]+`)
+
+func slugify(s string) string {
+	return strings.Trim(slugRe.ReplaceAllString(strings.ToLower(s), "-"), "-")
+}
+
+func LoadDiscordMapping(path string) (*DiscordMapping, error) {
+	m := &DiscordMapping{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// ThreadPath for a channel; unmapped channels go under discord/<guild>/<category>.
+func (m *DiscordMapping) ThreadPath(e *DiscordExport) string {
+	if tp, ok := m.Channels[e.Channel.ID]; ok {
+		return tp
+	}
+	if tp, ok := m.Channels[e.Channel.Name]; ok {
+		return tp
+	}
+	parts := []string{"discord", slugify(e.Guild.Name)}
+	if e.Channel.Category != "" {
+		parts = append(parts, slugify(e.Channel.Category))
+	}
+	return strings.Join(parts, "/") + "/threads/" + slugify(e.Channel.Name)
+}
+
+// Author returns the forum user and user_num for a message author.
+// Unmapped authors keep their server nickname and user_num 0.
+func (m *DiscordMapping) Author(msg *DiscordExportMessage) (string, int) {
+	for _, key := range []string{msg.Author.ID, msg.Author.Name, msg.Author.Nickname} {
+		if a, ok := m.Authors[key]; ok && key != "" {
+			return a.User, a.UserNum
+		}
+	}
+	if msg.Author.Nickname != "" {
+		return msg.Author.Nickname, 0
+	}
+	return msg.Author.Name, 0
+}
+
+// ParseDiscordExport converts an export into posts for one thread. Replies
+// become quote relations, like forum quotes.
+func ParseDiscordExport(path string, m *DiscordMapping) (string, []ForumPost, []PostQuote, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var export DiscordExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return "", nil, nil, fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if export.Channel.ID == "" {
+		return "", nil, nil, fmt.Errorf("%s is not a DiscordChatExporter export (no channel)", path)
+	}
+	threadPath := m.ThreadPath(&export)
+
+	var posts []ForumPost
+	var replies []PostQuote
+	authors := make(map[string]string) // message id -> user
+	for i := range export.Messages {
+		msg := &export.Messages[i]
+		// Skip joins, pins, thread notices and the like
+		if msg.Type != "Default" && msg.Type != "Reply" {
+			continue
+		}
+		if msg.Author.IsBot && !m.IncludeBots {
+			continue
+		}
+		content := msg.Content
+		for _, a := range msg.Attachments {
+			content = strings.TrimSpace(content + "\n" + a.URL)
+		}
+		if strings.TrimSpace(content) == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, msg.Timestamp)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("message %s: bad timestamp %q", msg.ID, msg.Timestamp)
+		}
+		user, userNum := m.Author(msg)
+		post := ForumPost{
+			PostID:     discordPostPrefix + msg.ID,
+			User:       user,
+			UserNum:    userNum,
+			Timestamp:  t.Unix(),
+			Message:    content,
+			ThreadPath: threadPath,
+		}
+		posts = append(posts, post)
+		authors[msg.ID] = user
+		if msg.Reference != nil && msg.Reference.MessageID != "" {
+			replies = append(replies, PostQuote{PostID: post.PostID, QuotedPostID: discordPostPrefix + msg.Reference.MessageID})
+		}
+	}
+
+	posts, quotes := NormalizeThread(posts, nil)
+	for _, q := range replies {
+		user, ok := authors[strings.TrimPrefix(q.QuotedPostID, discordPostPrefix)]
+		if !ok {
+			continue // reply to a message outside this export
+		}
+		q.QuotedUser = user
+		quotes = append(quotes, q)
+	}
+	return threadPath, posts, quotes, nil
+}
+
+// FindDiscordExports returns path itself or every .json export under it,
+// leaving out the mapping file.
+func FindDiscordExports(path, mappingPath string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var files []string
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(p, ".json") && filepath.Clean(p) != filepath.Clean(mappingPath) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// ImportDiscordExports ingests exports through the same manifest as the
+// forum scrape, so re-imports only touch channels whose export changed.
+func ImportDiscordExports(ctx context.Context, db *sql.DB, path string, m *DiscordMapping, mappingPath string, workers int) (*ScrapeReport, error) {
+	files, err := FindDiscordExports(path, mappingPath)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := LoadManifest(db)
+	if err != nil {
+		return nil, fmt.Errorf("load manifest failed: %w", err)
+	}
+	runID, err := startIngestRun(db)
+	if err != nil {
+		return nil, fmt.Errorf("start ingest run failed: %w", err)
+	}
+	report := &ScrapeReport{RunID: runID}
+
+	// Re-import every channel when the mapping changes
+	salt, err := hashFile(mappingPath)
+	if err != nil {
+		salt = "no-mapping"
+	}
+	seen := make(map[string]bool)
+	var jobs []sourceJob
+	for _, f := range files {
+		f := f
+		seen[f] = true
+		jobs = append(jobs, sourceJob{Path: f, Salt: salt, Parse: func() (*ParsedSource, error) {
+			threadPath, posts, quotes, err := ParseDiscordExport(f, m)
+			if err != nil {
+				return nil, err
+			}
+			return &ParsedSource{ThreadPath: threadPath, Posts: posts, Quotes: quotes}, nil
+		}})
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		removeVanishedFiles(db, report, manifest, seen, path)
+	}
+	if err := ingestSources(ctx, db, report, manifest, jobs, workers); err != nil {
+		finishIngestRun(db, report)
+		return report, err
+	}
+
+	if err := finishIngestRun(db, report); err != nil {
+		fmt.Printf("Failed to finish ingest run: %v\n", err)
+	}
+	return report, nil
+}
+
+// ---- CLI ----
+func ImportDiscord(path, mappingPath string, workers int) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	mapping, err := LoadDiscordMapping(mappingPath)
+	if err != nil {
+		log.Fatalf("failed to load discord mapping: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := ImportDiscordExports(ctx, db, path, mapping, mappingPath, workers)
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+	if report != nil {
+		report.Print()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := RebuildBoardsAndThreads(db, "data/tfs/data/"); err != nil {
+		fmt.Println("Error indexing boards and threads:", err)
+	}
+	if err := RebuildForumUsers(db); err != nil {
+		fmt.Println("Error indexing forum users:", err)
+	}
+}
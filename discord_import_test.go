@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDiscordExport(t *testing.T) {
+	m, err := LoadDiscordMapping("testdata/discord/mapping.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	threadPath, posts, quotes, err := ParseDiscordExport("testdata/discord/isra-city.json", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threadPath != "overworld/isran-empire/free-plains-isra/isra-free-city/threads/discord-isra-city" {
+		t.Errorf("thread path = %q", threadPath)
+	}
+	// The join notice and the bot are skipped
+	if len(posts) != 3 {
+		t.Fatalf("expected 3 posts, got %d", len(posts))
+	}
+	naoki := posts[0]
+	if naoki.PostID != "discord-900000000000000002" || naoki.User != "Empress Naoki" || naoki.UserNum != 607 {
+		t.Errorf("mapped author post = %+v", naoki)
+	}
+	if naoki.Timestamp != 1711994712 {
+		t.Errorf("timestamp = %d", naoki.Timestamp)
+	}
+	if naoki.CleanMessage != "The Empress stepped onto the balcony. She surveyed the city below." {
+		t.Errorf("clean message = %q", naoki.CleanMessage)
+	}
+	if posts[1].User != "Puck" || posts[2].User != "wanderer" || posts[2].Message != "https://cdn.example.com/map.png" {
+		t.Errorf("unmapped authors = %+v, %+v", posts[1], posts[2])
+	}
+	if len(quotes) != 1 || quotes[0].PostID != "discord-900000000000000004" ||
+		quotes[0].QuotedPostID != "discord-900000000000000002" || quotes[0].QuotedUser != "Empress Naoki" {
+		t.Errorf("reply quotes = %+v", quotes)
+	}
+
+	// Without a mapping the channel lands under discord/<guild>/<category>
+	threadPath, _, _, err = ParseDiscordExport("testdata/discord/isra-city.json", &DiscordMapping{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threadPath != "discord/the-free-scrolls/isran-empire/threads/isra-city" {
+		t.Errorf("default thread path = %q", threadPath)
+	}
+}
+
+func TestImportDiscordExports(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+
+	mappingPath := "testdata/discord/mapping.json"
+	m, err := LoadDiscordMapping(mappingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := ImportDiscordExports(context.Background(), db, "testdata/discord", m, mappingPath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, _, _ := report.Totals(); added != 3 || report.FilesScanned != 1 {
+		t.Errorf("first import: %d files scanned, %d posts added", report.FilesScanned, added)
+	}
+
+	// Importing the same export again changes nothing
+	report, err = ImportDiscordExports(context.Background(), db, "testdata/discord", m, mappingPath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, updated, removed := report.Totals(); added+updated+removed != 0 || report.FilesUnchanged != 1 {
+		t.Errorf("re-import touched posts: +%d ~%d -%d", added, updated, removed)
+	}
+
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM post_quotes WHERE quoted_post_id = 'discord-900000000000000002'`).Scan(&n)
+	if n != 1 {
+		t.Errorf("expected the reply to be stored as a quote, got %d", n)
+	}
+}
+
+// An export deleted from a directory given in an uncleaned form is still
+// noticed
+func TestImportDiscordRemovedExport(t *testing.T) {
+	db := openTestDB(t)
+	mappingPath := "testdata/discord/mapping.json"
+	m, err := LoadDiscordMapping(mappingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	data, err := os.ReadFile("testdata/discord/isra-city.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := filepath.Join(dir, "isra-city.json")
+	if err := os.WriteFile(export, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + string(filepath.Separator) + "."
+	if _, err := ImportDiscordExports(context.Background(), db, path, m, mappingPath, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(export); err != nil {
+		t.Fatal(err)
+	}
+	report, err := ImportDiscordExports(context.Background(), db, path, m, mappingPath, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, removed := report.Totals(); removed != 3 {
+		t.Errorf("removed %d posts, want 3", removed)
+	}
+	var tombstones int
+	db.QueryRow(`SELECT COUNT(*) FROM forum_post_tombstones`).Scan(&tombstones)
+	if tombstones != 3 {
+		t.Errorf("%d tombstones, want 3", tombstones)
+	}
+}
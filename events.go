@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ---- Events ----
+// Structured events extracted from threads by function calling: who did
+// what, where, with what result, and the posts that show it. Unlike prose
+// summaries they can be queried, e.g. every battle involving a faction.
+type Event struct {
+	ID           int64    `json:"id"`
+	ThreadPath   string   `json:"thread_path"`
+	Participants []string `json:"participants"`
+	Location     string   `json:"location"` // the thread's board path unless the posts name a place
+	Action       string   `json:"action"`
+	Outcome      string   `json:"outcome"`
+	Timestamp    int64    `json:"timestamp"` // of the earliest source post
+	PostIDs      []string `json:"post_ids"`
+}
+
+var eventsFunction = openai.FunctionDefinition{
+	Name:        "record_events",
+	Description: "Record the in-world events that happen in a section of a fantasy roleplay forum thread.",
+	Parameters: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"events": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"participants": map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "Characters, factions and nations involved, by name"},
+						"location":     map[string]string{"type": "string", "description": "Where it happens, if the posts say; otherwise empty"},
+						"action":       map[string]string{"type": "string", "description": "What happens in-world, in one sentence"},
+						"outcome":      map[string]string{"type": "string", "description": "The result, or empty if it is not resolved in these posts"},
+						"post_ids":     map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "IDs of the posts the event is based on"},
+					},
+					"required": []string{"participants", "action", "post_ids"},
+				},
+			},
+		},
+		"required": []string{"events"},
+	},
+}
+
+const eventsSystemPrompt = "You are an expert at cataloguing the in-world history of fantasy roleplay forums."
+
+func eventsPrompt(chunkText string) string {
+	return "List the in-world events in the following thread section: battles, meetings, journeys, deals, discoveries, deaths and the like. Leave out out-of-character chatter and events that are only mentioned as rumour. Each post is headed by its author, its ID in parentheses and its time.\n\nThread Section:\n" + chunkText
+}
+
+// parseEvents reads the arguments of a record_events call for chunk.
+// Source IDs outside the chunk are dropped, the timestamp is that of the
+// earliest source post, and the location falls back to the board.
+func parseEvents(arguments string, chunk []ForumPost) ([]Event, error) {
+	var call struct {
+		Events []struct {
+			Participants []string `json:"participants"`
+			Location     string   `json:"location"`
+			Action       string   `json:"action"`
+			Outcome      string   `json:"outcome"`
+			PostIDs      []string `json:"post_ids"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &call); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]ForumPost, len(chunk))
+	for _, p := range chunk {
+		byID[p.PostID] = p
+	}
+	threadPath := chunk[0].ThreadPath
+	board, _ := SplitThreadPath(threadPath)
+
+	var events []Event
+	for _, c := range call.Events {
+		e := Event{
+			ThreadPath: threadPath,
+			Location:   strings.TrimSpace(c.Location),
+			Action:     strings.TrimSpace(c.Action),
+			Outcome:    strings.TrimSpace(c.Outcome),
+			Timestamp:  chunk[0].Timestamp,
+			PostIDs:    []string{},
+		}
+		if e.Action == "" {
+			continue
+		}
+		if e.Location == "" {
+			e.Location = board
+		}
+		seen := make(map[string]bool)
+		for _, name := range c.Participants {
+			name = strings.TrimSpace(name)
+			if name != "" && !seen[strings.ToLower(name)] {
+				seen[strings.ToLower(name)] = true
+				e.Participants = append(e.Participants, name)
+			}
+		}
+		first := true
+		for _, id := range c.PostIDs {
+			p, ok := byID[id]
+			if !ok {
+				continue
+			}
+			e.PostIDs = append(e.PostIDs, id)
+			if first || p.Timestamp < e.Timestamp {
+				e.Timestamp, first = p.Timestamp, false
+			}
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func ExtractEvents(client *openai.Client, chunk []ForumPost) ([]Event, error) {
+	resp, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
+		Model: openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: eventsSystemPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: eventsPrompt(renderChunk(chunk))},
+		},
+		Functions:    []openai.FunctionDefinition{eventsFunction},
+		FunctionCall: openai.FunctionCall{Name: eventsFunction.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, choice := range resp.Choices {
+		if choice.Message.FunctionCall != nil && choice.Message.FunctionCall.Arguments != "" {
+			return parseEvents(choice.Message.FunctionCall.Arguments, chunk)
+		}
+	}
+	return nil, fmt.Errorf("No function response in completion")
+}
+
+// eventsExtracted reports whether a chunk was already run, even if it had
+// no events
+func eventsExtracted(db *sql.DB, hash string) bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM event_extractions WHERE chunk_hash = ?`, hash).Scan(&n)
+	return n > 0
+}
+
+// SaveEvents replaces the events of a chunk and records it as extracted
+func SaveEvents(db *sql.DB, hash, threadPath string, events []Event) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM event_participants WHERE event_id IN (SELECT id FROM events WHERE chunk_hash = ?)`, hash); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM events WHERE chunk_hash = ?`, hash); err != nil {
+		return err
+	}
+	for _, e := range events {
+		participants, _ := json.Marshal(e.Participants)
+		postIDs, _ := json.Marshal(e.PostIDs)
+		res, err := tx.Exec(`
+			INSERT INTO events (thread_path, chunk_hash, participants, location, action, outcome, timestamp, post_ids)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, e.ThreadPath, hash, string(participants), e.Location, e.Action, e.Outcome, e.Timestamp, string(postIDs))
+		if err != nil {
+			return err
+		}
+		id, _ := res.LastInsertId()
+		for _, name := range e.Participants {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO event_participants (event_id, name) VALUES (?, ?)`, id, name); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO event_extractions (chunk_hash, thread_path, event_count, extracted_at) VALUES (?, ?, ?, ?)`,
+		hash, threadPath, len(events), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type EventFilter struct {
+	ThreadPrefix string
+	Participant  string // any participant, case-insensitive
+	Text         string // in the action, outcome or location
+	Since, Until time.Time
+	Limit        int
+}
+
+// QueryEvents returns matching events in in-world order
+func QueryEvents(db *sql.DB, f EventFilter) ([]Event, error) {
+	query := `SELECT id, thread_path, participants, location, action, outcome, timestamp, post_ids FROM events WHERE 1 = 1`
+	var args []interface{}
+	if f.ThreadPrefix != "" {
+		query += ` AND thread_path LIKE ?`
+		args = append(args, f.ThreadPrefix+"%")
+	}
+	if f.Participant != "" {
+		query += ` AND id IN (SELECT event_id FROM event_participants WHERE name = ? COLLATE NOCASE)`
+		args = append(args, f.Participant)
+	}
+	if f.Text != "" {
+		query += ` AND (action LIKE ? OR outcome LIKE ? OR location LIKE ?)`
+		like := "%" + f.Text + "%"
+		args = append(args, like, like, like)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, postTimestamp(f.Since))
+	}
+	if !f.Until.IsZero() {
+		query += ` AND timestamp < ?`
+		args = append(args, postTimestamp(f.Until))
+	}
+	query += ` ORDER BY timestamp, id`
+	if f.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, f.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []Event
+	for rows.Next() {
+		var e Event
+		var participants, postIDs string
+		if err := rows.Scan(&e.ID, &e.ThreadPath, &participants, &e.Location, &e.Action, &e.Outcome, &e.Timestamp, &postIDs); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(participants), &e.Participants)
+		json.Unmarshal([]byte(postIDs), &e.PostIDs)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// ---- CLI ----
+// ExtractThreadEvents extracts the events of every thread under prefix.
+// Chunks that were extracted before are skipped unless force is set; with
+// dryRun nothing is sent to OpenAI.
+func ExtractThreadEvents(dryRun, force bool, prefix string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT DISTINCT thread_path FROM forum_posts WHERE thread_path LIKE ? ORDER BY thread_path`, prefix+"%")
+	if err != nil {
+		log.Fatalf("failed to list threads: %v", err)
+	}
+	var threads []string
+	for rows.Next() {
+		var tp string
+		if err := rows.Scan(&tp); err != nil {
+			log.Fatalf("failed to list threads: %v", err)
+		}
+		threads = append(threads, tp)
+	}
+	rows.Close()
+	if len(threads) == 0 {
+		fmt.Printf("No threads under %q\n", prefix)
+		return
+	}
+
+	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	extract := func(chunk []ForumPost) ([]Event, error) { return ExtractEvents(client, chunk) }
+	var total extractionStats
+	for _, tp := range threads {
+		stats, err := extractEventsInThread(db, tp, dryRun, force, extract)
+		if err != nil {
+			log.Fatalf("failed to extract events for thread %s: %v", tp, err)
+		}
+		total.add(stats)
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d chunks in %d threads would be sent, %d were extracted before\n", total.todo, len(threads), total.skipped)
+		return
+	}
+	fmt.Printf("\n%d events from %d chunks, %d chunks already done, %d failed\n", total.saved, total.todo-total.failed, total.skipped, total.failed)
+}
+
+type extractionStats struct {
+	todo, skipped, saved, failed int
+}
+
+func (s *extractionStats) add(o extractionStats) {
+	s.todo += o.todo
+	s.skipped += o.skipped
+	s.saved += o.saved
+	s.failed += o.failed
+}
+
+// extractEventsInThread extracts the chunks of a thread that were not done
+// before. Once every chunk is done, events from chunks the thread no longer
+// has, such as its last chunk before more posts were added, are dropped.
+func extractEventsInThread(db *sql.DB, tp string, dryRun, force bool, extract func([]ForumPost) ([]Event, error)) (extractionStats, error) {
+	var stats extractionStats
+	posts, err := GetPostsByThread(db, tp)
+	if err != nil {
+		return stats, err
+	}
+	chunks := ChunkPosts(posts, ChunkOptions{Model: openai.GPT4o, MaxTokens: summaryChunkTokens})
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hash := chunkHash(chunk, renderChunk(chunk))
+		hashes[i] = hash
+		if !force && eventsExtracted(db, hash) {
+			stats.skipped++
+			continue
+		}
+		stats.todo++
+		if dryRun {
+			continue
+		}
+		fmt.Printf("Extracting events from %s, chunk %d/%d...\n", tp, i+1, len(chunks))
+		events, err := extract(chunk)
+		if err != nil {
+			log.Printf("Extraction failed: %v", err)
+			stats.failed++
+			continue
+		}
+		if err := SaveEvents(db, hash, tp, events); err != nil {
+			return stats, err
+		}
+		for _, e := range events {
+			fmt.Printf("  %s: %s\n", strings.Join(e.Participants, ", "), e.Action)
+		}
+		stats.saved += len(events)
+	}
+	if dryRun || stats.failed > 0 {
+		return stats, nil
+	}
+	return stats, pruneEvents(db, tp, hashes)
+}
+
+// pruneEvents drops the events of a thread's chunks other than hashes
+func pruneEvents(db *sql.DB, threadPath string, hashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	keep, args := hashesNotIn(threadPath, hashes)
+	if _, err := tx.Exec(`DELETE FROM event_participants WHERE event_id IN (SELECT id FROM events WHERE thread_path = ? AND chunk_hash NOT IN (`+keep+`))`, args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM events WHERE thread_path = ? AND chunk_hash NOT IN (`+keep+`)`, args...); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM event_extractions WHERE thread_path = ? AND chunk_hash NOT IN (`+keep+`)`, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// hashesNotIn returns placeholders for hashes and the arguments for a
+// "thread_path = ? AND chunk_hash NOT IN (...)" condition. An empty list
+// still needs a value for NOT IN to match every row.
+func hashesNotIn(threadPath string, hashes []string) (string, []interface{}) {
+	args := []interface{}{threadPath}
+	if len(hashes) == 0 {
+		return "''", args
+	}
+	for _, h := range hashes {
+		args = append(args, h)
+	}
+	return strings.TrimSuffix(strings.Repeat("?,", len(hashes)), ","), args
+}
+
+// ListEvents prints the events matching f, oldest first
+func ListEvents(f EventFilter, format, outPath string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	events, err := QueryEvents(db, f)
+	if err != nil {
+		log.Fatalf("failed to query events: %v", err)
+	}
+	w := os.Stdout
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			log.Fatalf("failed to create %s: %v", outPath, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if events == nil {
+			events = []Event{}
+		}
+		enc.Encode(events)
+		return
+	}
+	if len(events) == 0 {
+		fmt.Fprintln(w, "No matching events.")
+		return
+	}
+	for _, e := range events {
+		fmt.Fprintf(w, "%s  %s\n  %s", FormatWorldTime(e.Timestamp), e.Location, e.Action)
+		if e.Outcome != "" {
+			fmt.Fprintf(w, " -> %s", e.Outcome)
+		}
+		fmt.Fprintf(w, "\n  with %s [%s]\n", strings.Join(e.Participants, ", "), strings.Join(e.PostIDs, ", "))
+	}
+}
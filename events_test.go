@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvents(t *testing.T) {
+	db := openTestDB(t)
+	chunk := []ForumPost{
+		{PostID: "post-1", User: "Puck", Timestamp: 1459729209, ThreadPath: "overworld/isran-empire/threads/siege"},
+		{PostID: "post-2", User: "Empress Naoki", Timestamp: 1459729300, ThreadPath: "overworld/isran-empire/threads/siege"},
+	}
+	args := `{"events": [
+		{"participants": ["Isran Empire", "Black Vale", "isran empire"], "location": "", "action": "The Isran Empire besieges the Black Vale fortress.", "outcome": "The walls fall.", "post_ids": ["post-2", "post-1", "post-9"]},
+		{"participants": ["Puck"], "location": "The Midnight Sun inn", "action": "Puck meets a stranger.", "post_ids": []},
+		{"participants": ["Nobody"], "action": " ", "post_ids": ["post-1"]}
+	]}`
+	events, err := parseEvents(args, chunk)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("events = %+v, %v", events, err)
+	}
+	siege := events[0]
+	if siege.Location != "overworld/isran-empire" || strings.Join(siege.Participants, ",") != "Isran Empire,Black Vale" ||
+		strings.Join(siege.PostIDs, ",") != "post-2,post-1" || siege.Timestamp != 1459729209 {
+		t.Errorf("siege = %+v", siege)
+	}
+	if events[1].Location != "The Midnight Sun inn" || events[1].Timestamp != chunk[0].Timestamp {
+		t.Errorf("meeting = %+v", events[1])
+	}
+
+	hash := chunkHash(chunk, renderChunk(chunk))
+	if err := SaveEvents(db, hash, chunk[0].ThreadPath, events); err != nil {
+		t.Fatal(err)
+	}
+	// Re-extracting a chunk replaces its events
+	if err := SaveEvents(db, hash, chunk[0].ThreadPath, events); err != nil {
+		t.Fatal(err)
+	}
+	if !eventsExtracted(db, hash) {
+		t.Error("chunk not recorded as extracted")
+	}
+	all, _ := QueryEvents(db, EventFilter{})
+	if len(all) != 2 {
+		t.Errorf("%d events stored, want 2", len(all))
+	}
+	found, err := QueryEvents(db, EventFilter{Participant: "isran empire", Text: "besieges"})
+	if err != nil || len(found) != 1 || found[0].Outcome != "The walls fall." || len(found[0].PostIDs) != 2 {
+		t.Errorf("query = %+v, %v", found, err)
+	}
+	if none, _ := QueryEvents(db, EventFilter{Participant: "Puck", Text: "besieges"}); len(none) != 0 {
+		t.Errorf("query matched %+v", none)
+	}
+}
+
+// A thread that grows gets a new last chunk; the old one's events go
+func TestExtractEventsPrunesStaleChunks(t *testing.T) {
+	db := openTestDB(t)
+	const tp = "overworld/isran-empire/threads/siege"
+	addPost := func(id string, ts int64) {
+		if _, err := db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES (?, 'Puck', 0, ?, 'The walls hold.', ?)`, id, ts, tp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extract := func(chunk []ForumPost) ([]Event, error) {
+		return []Event{{ThreadPath: tp, Participants: []string{"Puck"}, Action: "Puck holds the wall.", PostIDs: []string{chunk[len(chunk)-1].PostID}}}, nil
+	}
+	count := func(table string) int {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	addPost("post-1", 1459729209)
+	if _, err := extractEventsInThread(db, tp, false, false, extract); err != nil {
+		t.Fatal(err)
+	}
+	addPost("post-2", 1459729300)
+	stats, err := extractEventsInThread(db, tp, false, false, extract)
+	if err != nil || stats.todo != 1 || stats.saved != 1 {
+		t.Fatalf("second run = %+v, %v", stats, err)
+	}
+	if n := count("events"); n != 1 {
+		t.Errorf("%d events after the thread grew, want 1", n)
+	}
+	if n := count("event_participants"); n != 1 {
+		t.Errorf("%d participants after the thread grew, want 1", n)
+	}
+	if n := count("event_extractions"); n != 1 {
+		t.Errorf("%d extractions after the thread grew, want 1", n)
+	}
+	events, _ := QueryEvents(db, EventFilter{})
+	if len(events) != 1 || events[0].PostIDs[0] != "post-2" {
+		t.Errorf("events = %+v", events)
+	}
+	// Nothing new to extract on a third run
+	if stats, _ := extractEventsInThread(db, tp, false, false, extract); stats.todo != 0 || stats.skipped != 1 {
+		t.Errorf("third run = %+v", stats)
+	}
+}
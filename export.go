@@ -0,0 +1,204 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---- Corpus Export ----
+// Dumps a filtered slice of forum_posts for sharing with players and GMs.
+type ExportFilter struct {
+	User         string // exact name as stored; "" for everyone
+	ThreadPrefix string // like GetPostsByThreadPrefix; "" for all threads
+	Since        time.Time
+	Until        time.Time // exclusive
+}
+
+// Post timestamps are stored in Unix seconds
+func postTimestamp(t time.Time) int64 {
+	return t.Unix()
+}
+
+func postTime(ts int64) time.Time {
+	return time.Unix(ts, 0).UTC()
+}
+
+// parseDateFlag accepts 2016-04-03, 2016-04-03T16:20 or full RFC3339.
+func parseDateFlag(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04", time.RFC3339} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q (use YYYY-MM-DD)", s)
+}
+
+func GetFilteredPosts(db *sql.DB, f ExportFilter) ([]ForumPost, error) {
+	query := `SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message) FROM forum_posts WHERE thread_path LIKE ?`
+	args := []interface{}{f.ThreadPrefix + "%"}
+	if f.User != "" {
+		query += ` AND user = ?`
+		args = append(args, f.User)
+	}
+	if !f.Since.IsZero() {
+		query += ` AND timestamp >= ?`
+		args = append(args, postTimestamp(f.Since))
+	}
+	if !f.Until.IsZero() {
+		query += ` AND timestamp < ?`
+		args = append(args, postTimestamp(f.Until))
+	}
+	query += ` ORDER BY timestamp ASC`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var posts []ForumPost
+	for rows.Next() {
+		var p ForumPost
+		if err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+type exportedPost struct {
+	PostID     string `json:"post_id"`
+	User       string `json:"user"`
+	UserNum    int    `json:"user_num"`
+	Timestamp  int64  `json:"timestamp"`
+	Date       string `json:"date"`
+	ThreadPath string `json:"thread_path"`
+	Message    string `json:"message"`
+}
+
+func toExported(p ForumPost) exportedPost {
+	return exportedPost{
+		PostID:     p.PostID,
+		User:       p.User,
+		UserNum:    p.UserNum,
+		Timestamp:  p.Timestamp,
+		Date:       postTime(p.Timestamp).Format(time.RFC3339),
+		ThreadPath: p.ThreadPath,
+		Message:    p.Text(),
+	}
+}
+
+func WriteJSONL(w io.Writer, posts []ForumPost) error {
+	enc := json.NewEncoder(w)
+	for _, p := range posts {
+		if err := enc.Encode(toExported(p)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func WriteCSV(w io.Writer, posts []ForumPost) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"post_id", "user", "user_num", "timestamp", "date", "thread_path", "message"})
+	for _, p := range posts {
+		e := toExported(p)
+		cw.Write([]string{e.PostID, e.User, strconv.Itoa(e.UserNum), strconv.FormatInt(e.Timestamp, 10), e.Date, e.ThreadPath, e.Message})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteMarkdownTranscript groups posts by thread, threads in order of their
+// first exported post. titles maps thread paths to display titles.
+func WriteMarkdownTranscript(w io.Writer, posts []ForumPost, titles map[string]string) error {
+	byThread := make(map[string][]ForumPost)
+	var order []string
+	for _, p := range posts {
+		if _, ok := byThread[p.ThreadPath]; !ok {
+			order = append(order, p.ThreadPath)
+		}
+		byThread[p.ThreadPath] = append(byThread[p.ThreadPath], p)
+	}
+	for i, tp := range order {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		title := titles[tp]
+		if title == "" {
+			_, slug := SplitThreadPath(tp)
+			title = titleFromSlug(slug)
+		}
+		fmt.Fprintf(w, "# %s\n\n_%s_\n", title, tp)
+		for _, p := range byThread[tp] {
+			fmt.Fprintf(w, "\n## %s — %s\n\n%s\n", p.User, postTime(p.Timestamp).Format("Jan 2, 2006 15:04"), strings.TrimSpace(p.Text()))
+		}
+	}
+	return nil
+}
+
+// ---- CLI ----
+func ExportPosts(f ExportFilter, format, outPath string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if f.User != "" {
+		name, err := ResolveUsername(db, f.User)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		f.User = name
+	}
+	posts, err := GetFilteredPosts(db, f)
+	if err != nil {
+		log.Fatalf("failed to query posts: %v", err)
+	}
+
+	w := os.Stdout
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			log.Fatalf("failed to create %s: %v", outPath, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	switch format {
+	case "jsonl":
+		err = WriteJSONL(w, posts)
+	case "csv":
+		err = WriteCSV(w, posts)
+	case "md", "markdown":
+		titles := make(map[string]string)
+		for _, p := range posts {
+			if _, ok := titles[p.ThreadPath]; ok {
+				continue
+			}
+			titles[p.ThreadPath] = ""
+			if t, err := GetThread(db, p.ThreadPath); err == nil {
+				titles[p.ThreadPath] = t.Title
+			}
+		}
+		err = WriteMarkdownTranscript(w, posts, titles)
+	default:
+		log.Fatalf("unknown export format %q (use jsonl, csv or md)", format)
+	}
+	if err != nil {
+		log.Fatalf("failed to write export: %v", err)
+	}
+	if outPath != "" {
+		fmt.Printf("Exported %d posts to %s\n", len(posts), outPath)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportPosts(t *testing.T) {
+	db := openTestDB(t)
+	const siege, court = "overworld/isran-empire/threads/siege", "overworld/vessia/threads/court"
+	day := func(d int) int64 { return time.Date(2016, 4, d, 12, 0, 0, 0, time.UTC).Unix() }
+	for _, p := range []struct {
+		id, user, thread, clean string
+		at                      int64
+	}{
+		{"post-1", "Puck", court, "Hello, \"court\".\nSecond line.", day(1)},
+		{"post-2", "Empress Naoki", siege, "The walls fall.", day(2)},
+		{"post-3", "Puck", siege, "We hold, barely.", day(3)},
+		{"post-4", "Empress Naoki", court, "Enough.", day(4)},
+	} {
+		if _, err := db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path, clean_message) VALUES (?, ?, 0, ?, 'raw', ?, ?)`,
+			p.id, p.user, p.at, p.thread, p.clean); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(posts []ForumPost) string {
+		var out []string
+		for _, p := range posts {
+			out = append(out, p.PostID)
+		}
+		return strings.Join(out, ",")
+	}
+	date := func(d int) time.Time { return time.Date(2016, 4, d, 0, 0, 0, 0, time.UTC) }
+	for _, c := range []struct {
+		name string
+		f    ExportFilter
+		want string
+	}{
+		{"everything", ExportFilter{}, "post-1,post-2,post-3,post-4"},
+		{"user", ExportFilter{User: "Puck"}, "post-1,post-3"},
+		{"thread", ExportFilter{ThreadPrefix: "overworld/vessia/"}, "post-1,post-4"},
+		{"user and thread", ExportFilter{User: "Puck", ThreadPrefix: siege}, "post-3"},
+		{"since", ExportFilter{Since: date(2)}, "post-2,post-3,post-4"},
+		{"until is exclusive", ExportFilter{Until: date(3)}, "post-1,post-2"},
+		{"all four", ExportFilter{User: "Empress Naoki", ThreadPrefix: "overworld/", Since: date(2), Until: date(5)}, "post-2,post-4"},
+		{"no match", ExportFilter{User: "Nobody"}, ""},
+	} {
+		posts, err := GetFilteredPosts(db, c.f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(posts); got != c.want {
+			t.Errorf("%s: %s, want %s", c.name, got, c.want)
+		}
+	}
+
+	posts, err := GetFilteredPosts(db, ExportFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Commas, quotes and newlines survive a CSV round trip
+	var csvOut bytes.Buffer
+	if err := WriteCSV(&csvOut, posts); err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&csvOut).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV does not parse: %v", err)
+	}
+	if len(records) != 5 || strings.Join(records[0], ",") != "post_id,user,user_num,timestamp,date,thread_path,message" {
+		t.Fatalf("CSV records = %q", records)
+	}
+	if r := records[1]; r[0] != "post-1" || r[4] != "2016-04-01T12:00:00Z" || r[6] != "Hello, \"court\".\nSecond line." {
+		t.Errorf("CSV row = %q", r)
+	}
+
+	var jsonl bytes.Buffer
+	if err := WriteJSONL(&jsonl, posts); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(jsonl.String()), "\n")
+	var first exportedPost
+	if len(lines) != 4 || json.Unmarshal([]byte(lines[0]), &first) != nil || first.Message != posts[0].CleanMessage {
+		t.Errorf("JSONL = %s", jsonl.String())
+	}
+
+	// Markdown groups posts under their thread, threads by first post
+	var md bytes.Buffer
+	if err := WriteMarkdownTranscript(&md, posts, map[string]string{court: "The Court of Vessia"}); err != nil {
+		t.Fatal(err)
+	}
+	want := `# The Court of Vessia
+
+_overworld/vessia/threads/court_
+
+## Puck — Apr 1, 2016 12:00
+
+Hello, "court".
+Second line.
+
+## Empress Naoki — Apr 4, 2016 12:00
+
+Enough.
+
+# Siege
+
+_overworld/isran-empire/threads/siege_
+
+## Empress Naoki — Apr 2, 2016 12:00
+
+The walls fall.
+
+## Puck — Apr 3, 2016 12:00
+
+We hold, barely.
+`
+	if md.String() != want {
+		t.Errorf("Markdown =\n%s\nwant\n%s", md.String(), want)
+	}
+}
@@ -10,6 +10,7 @@ require (
 	github.com/qdrant/go-client v1.14.1
 	github.com/sashabaranov/go-openai v1.40.5
 	github.com/tidwall/gjson v1.18.0
+	golang.org/x/net v0.28.0
 	gorm.io/driver/postgres v1.6.0
 	gorm.io/gorm v1.30.0
 )
@@ -49,7 +50,6 @@ require (
 	github.com/willf/bitset v1.1.10 // indirect
 	go.etcd.io/bbolt v1.3.5 // indirect
 	golang.org/x/crypto v0.31.0 // indirect
-	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/sys v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
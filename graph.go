@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ---- Interaction Graph ----
+// Directed graph of who responds to whom. An edge A -> B means A posted
+// right after B in a thread, or A quoted one of B's posts.
+type GraphNode struct {
+	Name      string `json:"name"`
+	PostCount int    `json:"post_count"`
+}
+
+type InteractionEdge struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Weight  int      `json:"weight"`
+	Replies int      `json:"replies"`
+	Quotes  int      `json:"quotes"`
+	Threads []string `json:"threads"`
+	FirstAt int64    `json:"first_at"`
+	LastAt  int64    `json:"last_at"`
+
+	threadSet map[string]bool
+}
+
+type InteractionGraph struct {
+	Nodes map[string]*GraphNode
+	Edges map[string]*InteractionEdge // keyed by from + "\x00" + to
+}
+
+func NewInteractionGraph() *InteractionGraph {
+	return &InteractionGraph{
+		Nodes: make(map[string]*GraphNode),
+		Edges: make(map[string]*InteractionEdge),
+	}
+}
+
+func (g *InteractionGraph) node(name string) *GraphNode {
+	n, ok := g.Nodes[name]
+	if !ok {
+		n = &GraphNode{Name: name}
+		g.Nodes[name] = n
+	}
+	return n
+}
+
+// AddInteraction records one reply or quote from -> to
+func (g *InteractionGraph) AddInteraction(from, to, kind, threadPath string, at int64) {
+	if from == "" || to == "" || from == to {
+		return
+	}
+	g.node(from)
+	g.node(to)
+	key := from + "\x00" + to
+	e, ok := g.Edges[key]
+	if !ok {
+		e = &InteractionEdge{From: from, To: to, FirstAt: at, LastAt: at, threadSet: make(map[string]bool)}
+		g.Edges[key] = e
+	}
+	e.Weight++
+	if kind == "quote" {
+		e.Quotes++
+	} else {
+		e.Replies++
+	}
+	if !e.threadSet[threadPath] {
+		e.threadSet[threadPath] = true
+		e.Threads = append(e.Threads, threadPath)
+	}
+	if at < e.FirstAt {
+		e.FirstAt = at
+	}
+	if at > e.LastAt {
+		e.LastAt = at
+	}
+}
+
+// SortedEdges returns edges by descending weight
+func (g *InteractionGraph) SortedEdges() []*InteractionEdge {
+	edges := make([]*InteractionEdge, 0, len(g.Edges))
+	for _, e := range g.Edges {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].Weight != edges[j].Weight {
+			return edges[i].Weight > edges[j].Weight
+		}
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges
+}
+
+// Partner is a user's combined interaction with someone in both directions
+type Partner struct {
+	Name     string
+	Outgoing int // user -> partner
+	Incoming int // partner -> user
+	Threads  int
+}
+
+func (p Partner) Total() int { return p.Outgoing + p.Incoming }
+
+// PartnersOf answers "who did X interact with most".
+func (g *InteractionGraph) PartnersOf(user string) []Partner {
+	byName := make(map[string]*Partner)
+	threads := make(map[string]map[string]bool)
+	for _, e := range g.Edges {
+		var other string
+		switch {
+		case e.From == user:
+			other = e.To
+		case e.To == user:
+			other = e.From
+		default:
+			continue
+		}
+		p, ok := byName[other]
+		if !ok {
+			p = &Partner{Name: other}
+			byName[other] = p
+			threads[other] = make(map[string]bool)
+		}
+		if e.From == user {
+			p.Outgoing += e.Weight
+		} else {
+			p.Incoming += e.Weight
+		}
+		for _, t := range e.Threads {
+			threads[other][t] = true
+		}
+	}
+	partners := make([]Partner, 0, len(byName))
+	for name, p := range byName {
+		p.Threads = len(threads[name])
+		partners = append(partners, *p)
+	}
+	sort.Slice(partners, func(i, j int) bool {
+		if partners[i].Total() != partners[j].Total() {
+			return partners[i].Total() > partners[j].Total()
+		}
+		return partners[i].Name < partners[j].Name
+	})
+	return partners
+}
+
+// BuildInteractionGraph builds the graph for every thread under threadPrefix
+// ("" for the whole forum).
+func BuildInteractionGraph(db *sql.DB, threadPrefix string) (*InteractionGraph, error) {
+	posts, err := GetPostsByThreadPrefix(db, threadPrefix)
+	if err != nil {
+		return nil, err
+	}
+	g := NewInteractionGraph()
+
+	// Posts come back ordered by timestamp, so the previous post seen for a
+	// thread is the one this post follows.
+	last := make(map[string]ForumPost)
+	for _, p := range posts {
+		if p.User == "" {
+			continue
+		}
+		g.node(p.User).PostCount++
+		if prev, ok := last[p.ThreadPath]; ok {
+			g.AddInteraction(p.User, prev.User, "reply", p.ThreadPath, p.Timestamp)
+		}
+		last[p.ThreadPath] = p
+	}
+
+	rows, err := db.Query(`
+		SELECT p.user, q.quoted_user, p.thread_path, p.timestamp
+		FROM post_quotes q
+		JOIN forum_posts p ON p.post_id = q.post_id
+		WHERE q.quoted_post_id != '' AND p.thread_path LIKE ?
+	`, threadPrefix+"%")
+	if err != nil {
+		return nil, fmt.Errorf("quote query failed (run -mode normalize first?): %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var from, to, threadPath string
+		var at int64
+		if err := rows.Scan(&from, &to, &threadPath, &at); err != nil {
+			return nil, err
+		}
+		g.AddInteraction(from, to, "quote", threadPath, at)
+	}
+	return g, rows.Err()
+}
+
+// ---- Export ----
+func (g *InteractionGraph) sortedNodes() []*GraphNode {
+	nodes := make([]*GraphNode, 0, len(g.Nodes))
+	for _, n := range g.Nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+	return nodes
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (g *InteractionGraph) WriteDOT(w io.Writer) error {
+	fmt.Fprintln(w, "digraph interactions {")
+	for _, n := range g.sortedNodes() {
+		fmt.Fprintf(w, "  %s [posts=%d];\n", dotQuote(n.Name), n.PostCount)
+	}
+	for _, e := range g.SortedEdges() {
+		fmt.Fprintf(w, "  %s -> %s [weight=%d, replies=%d, quotes=%d, threads=%d, first_at=%d, last_at=%d];\n",
+			dotQuote(e.From), dotQuote(e.To), e.Weight, e.Replies, e.Quotes, len(e.Threads), e.FirstAt, e.LastAt)
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (g *InteractionGraph) WriteGraphML(w io.Writer) error {
+	fmt.Fprintln(w, `<?xml version="1.0" encoding="UTF-8"?>`)
+	fmt.Fprintln(w, `<graphml xmlns="http://graphml.graphdrawing.org/xmlns">`)
+	fmt.Fprintln(w, `  <key id="posts" for="node" attr.name="posts" attr.type="int"/>`)
+	fmt.Fprintln(w, `  <key id="weight" for="edge" attr.name="weight" attr.type="int"/>`)
+	fmt.Fprintln(w, `  <key id="replies" for="edge" attr.name="replies" attr.type="int"/>`)
+	fmt.Fprintln(w, `  <key id="quotes" for="edge" attr.name="quotes" attr.type="int"/>`)
+	fmt.Fprintln(w, `  <key id="threads" for="edge" attr.name="threads" attr.type="string"/>`)
+	fmt.Fprintln(w, `  <key id="first_at" for="edge" attr.name="first_at" attr.type="long"/>`)
+	fmt.Fprintln(w, `  <key id="last_at" for="edge" attr.name="last_at" attr.type="long"/>`)
+	fmt.Fprintln(w, `  <graph id="interactions" edgedefault="directed">`)
+	for _, n := range g.sortedNodes() {
+		fmt.Fprintf(w, "    <node id=\"%s\"><data key=\"posts\">%d</data></node>\n", xmlEscape(n.Name), n.PostCount)
+	}
+	for _, e := range g.SortedEdges() {
+		fmt.Fprintf(w, "    <edge source=\"%s\" target=\"%s\">", xmlEscape(e.From), xmlEscape(e.To))
+		fmt.Fprintf(w, "<data key=\"weight\">%d</data><data key=\"replies\">%d</data><data key=\"quotes\">%d</data>", e.Weight, e.Replies, e.Quotes)
+		fmt.Fprintf(w, "<data key=\"threads\">%s</data>", xmlEscape(strings.Join(e.Threads, ",")))
+		fmt.Fprintf(w, "<data key=\"first_at\">%d</data><data key=\"last_at\">%d</data></edge>\n", e.FirstAt, e.LastAt)
+	}
+	fmt.Fprintln(w, "  </graph>")
+	_, err := fmt.Fprintln(w, "</graphml>")
+	return err
+}
+
+func (g *InteractionGraph) WriteJSON(w io.Writer) error {
+	out := struct {
+		Nodes []*GraphNode       `json:"nodes"`
+		Edges []*InteractionEdge `json:"edges"`
+	}{g.sortedNodes(), g.SortedEdges()}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// ---- CLI ----
+func ExportInteractionGraph(threadPrefix, format, outPath string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	g, err := BuildInteractionGraph(db, threadPrefix)
+	if err != nil {
+		log.Fatalf("failed to build graph: %v", err)
+	}
+
+	w := os.Stdout
+	if outPath != "" {
+		f, err := os.Create(outPath)
+		if err != nil {
+			log.Fatalf("failed to create %s: %v", outPath, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	switch format {
+	case "dot":
+		err = g.WriteDOT(w)
+	case "graphml":
+		err = g.WriteGraphML(w)
+	case "json":
+		err = g.WriteJSON(w)
+	default:
+		log.Fatalf("unknown graph format %q (use dot, graphml or json)", format)
+	}
+	if err != nil {
+		log.Fatalf("failed to write graph: %v", err)
+	}
+	if outPath != "" {
+		fmt.Printf("Wrote %d users and %d edges to %s\n", len(g.Nodes), len(g.Edges), outPath)
+	}
+}
+
+// TopInteractions prints who a user interacted with most.
+func TopInteractions(username, threadPrefix string, limit int) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	g, err := BuildInteractionGraph(db, threadPrefix)
+	if err != nil {
+		log.Fatalf("failed to build graph: %v", err)
+	}
+	if _, ok := g.Nodes[username]; !ok {
+		fmt.Println(noPostsError(db, username))
+		return
+	}
+	partners := g.PartnersOf(username)
+	fmt.Printf("%s interacted with %d users:\n", username, len(partners))
+	for i, p := range partners {
+		if limit > 0 && i >= limit {
+			break
+		}
+		fmt.Printf("%3d. %-40s %5d  (%d to, %d from, %d threads)\n", i+1, truncate(p.Name, 40), p.Total(), p.Outgoing, p.Incoming, p.Threads)
+	}
+}
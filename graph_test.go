@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestInteractionGraph(t *testing.T) {
+	db := openTestDB(t)
+	const a, b, c = "board/threads/a", "board/threads/b", "board/threads/c"
+	for _, p := range []struct {
+		id, user, thread string
+		at               int64
+	}{
+		{"post-1", "Puck", a, 100},
+		{"post-2", "Fly", a, 200},
+		{"post-3", "Puck", a, 300},
+		{"post-4", "Fly", a, 400}, // quotes post-1
+		{"post-5", "", a, 450},    // no author, left out
+		{"post-6", "Fly", b, 1000},
+		{"post-7", "Puck", b, 1100},
+		{"post-8", "Fly", c, 2000},
+		{"post-9", `Asthor "Sneak" & Co`, c, 2100},
+	} {
+		if _, err := db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES (?, ?, 0, ?, 'x', ?)`,
+			p.id, p.user, p.at, p.thread); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(`INSERT INTO post_quotes (post_id, quoted_post_id, quoted_user, quoted_at) VALUES ('post-4', 'post-1', 'Puck', 100)`); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := BuildInteractionGraph(db, "board/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Nodes) != 3 || g.Nodes["Puck"].PostCount != 3 || g.Nodes["Fly"].PostCount != 4 {
+		t.Errorf("nodes = %d, Puck %+v, Fly %+v", len(g.Nodes), g.Nodes["Puck"], g.Nodes["Fly"])
+	}
+	// Fly follows Puck twice in thread a and quotes him once
+	flyToPuck := g.Edges["Fly\x00Puck"]
+	if flyToPuck == nil || flyToPuck.Weight != 3 || flyToPuck.Replies != 2 || flyToPuck.Quotes != 1 ||
+		strings.Join(flyToPuck.Threads, ",") != a || flyToPuck.FirstAt != 200 || flyToPuck.LastAt != 400 {
+		t.Errorf("Fly -> Puck = %+v", flyToPuck)
+	}
+	puckToFly := g.Edges["Puck\x00Fly"]
+	if puckToFly == nil || puckToFly.Weight != 2 || puckToFly.Quotes != 0 ||
+		strings.Join(puckToFly.Threads, ",") != a+","+b || puckToFly.FirstAt != 300 || puckToFly.LastAt != 1100 {
+		t.Errorf("Puck -> Fly = %+v", puckToFly)
+	}
+	if len(g.Edges) != 3 {
+		t.Errorf("%d edges, want 3", len(g.Edges))
+	}
+	if edges := g.SortedEdges(); edges[0] != flyToPuck {
+		t.Errorf("heaviest edge = %+v", edges[0])
+	}
+
+	partners := g.PartnersOf("Fly")
+	if len(partners) != 2 || partners[0].Name != "Puck" || partners[0].Outgoing != 3 || partners[0].Incoming != 2 || partners[0].Threads != 2 {
+		t.Errorf("partners of Fly = %+v", partners)
+	}
+
+	var dot bytes.Buffer
+	if err := g.WriteDOT(&dot); err != nil {
+		t.Fatal(err)
+	}
+	if s := dot.String(); !strings.HasPrefix(s, "digraph interactions {\n") || !strings.HasSuffix(s, "}\n") ||
+		!strings.Contains(s, `"Fly" -> "Puck" [weight=3, replies=2, quotes=1, threads=1, first_at=200, last_at=400];`) ||
+		!strings.Contains(s, `"Asthor \"Sneak\" & Co" [posts=1];`) {
+		t.Errorf("DOT =\n%s", s)
+	}
+
+	var graphml bytes.Buffer
+	if err := g.WriteGraphML(&graphml); err != nil {
+		t.Fatal(err)
+	}
+	dec := xml.NewDecoder(&graphml)
+	nodes, edges := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("GraphML does not parse: %v", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok {
+			switch el.Name.Local {
+			case "node":
+				nodes++
+				if id := el.Attr[0].Value; id != "Puck" && id != "Fly" && id != `Asthor "Sneak" & Co` {
+					t.Errorf("GraphML node id %q", id)
+				}
+			case "edge":
+				edges++
+			}
+		}
+	}
+	if nodes != 3 || edges != 3 {
+		t.Errorf("GraphML has %d nodes and %d edges", nodes, edges)
+	}
+
+	var js bytes.Buffer
+	if err := g.WriteJSON(&js); err != nil {
+		t.Fatal(err)
+	}
+	var out struct {
+		Nodes []GraphNode       `json:"nodes"`
+		Edges []InteractionEdge `json:"edges"`
+	}
+	if err := json.Unmarshal(js.Bytes(), &out); err != nil {
+		t.Fatalf("JSON does not parse: %v", err)
+	}
+	if len(out.Nodes) != 3 || len(out.Edges) != 3 || out.Edges[0].From != "Fly" || out.Edges[0].Weight != 3 || len(out.Edges[0].Threads) != 1 {
+		t.Errorf("JSON = %s", js.String())
+	}
+}
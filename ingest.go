@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// ---- Ingestion Pipeline ----
+// A bounded pool of workers stats, hashes, parses and validates source files
+// while a single writer applies the results in large transactions. Results
+// are applied in job order, so which of two threads claiming the same post
+// ID wins does not depend on scheduling.
+const (
+	ingestBatchPosts = 20000 // commit after this many parsed posts...
+	ingestBatchFiles = 500   // ...or this many files
+	progressInterval = 2 * time.Second
+)
+
+type ingestTask struct {
+	job    sourceJob
+	result chan *preparedSource
+}
+
+type ingestProgress struct {
+	start      time.Time
+	lastReport time.Time
+	total      int
+	files      int
+	posts      int
+}
+
+func (p *ingestProgress) add(prepared *preparedSource) {
+	p.files++
+	if prepared.Src != nil {
+		p.posts += len(prepared.Src.Posts)
+	}
+	if time.Since(p.lastReport) >= progressInterval {
+		p.lastReport = time.Now()
+		p.print("Progress")
+	}
+}
+
+func (p *ingestProgress) print(label string) {
+	secs := time.Since(p.start).Seconds()
+	if secs <= 0 {
+		secs = 1e-9
+	}
+	fmt.Printf("%s: %d/%d files, %d posts parsed in %.1fs (%.0f files/s, %.0f posts/s)\n",
+		label, p.files, p.total, p.posts, secs, float64(p.files)/secs, float64(p.posts)/secs)
+}
+
+// ingestSources runs jobs through the pipeline with the given number of
+// workers (0 for one per CPU). On cancellation the files applied so far are
+// committed and ctx.Err() is returned.
+func ingestSources(ctx context.Context, db *sql.DB, report *ScrapeReport, manifest map[string]ManifestEntry, jobs []sourceJob, workers int) error {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the dispatcher if the writer bails out
+
+	work := make(chan ingestTask)
+	pending := make(chan chan *preparedSource, workers*2)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for t := range work {
+				t.result <- prepareSource(manifest, t.job)
+			}
+		}()
+	}
+	go func() {
+		defer close(pending)
+		defer close(work)
+		for _, job := range jobs {
+			t := ingestTask{job: job, result: make(chan *preparedSource, 1)}
+			select {
+			case work <- t:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case pending <- t.result:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	progress := &ingestProgress{start: time.Now(), lastReport: time.Now(), total: len(jobs)}
+	var tx *sql.Tx
+	batchFiles, batchPosts := 0, 0
+	commit := func() error {
+		if tx == nil {
+			return nil
+		}
+		err := tx.Commit()
+		tx, batchFiles, batchPosts = nil, 0, 0
+		return err
+	}
+	fail := func(err error) error {
+		if tx != nil {
+			tx.Rollback()
+		}
+		return err
+	}
+
+writer:
+	for result := range pending {
+		var p *preparedSource
+		select {
+		case p = <-result:
+		case <-ctx.Done():
+			break writer
+		}
+		if tx == nil {
+			var err error
+			if tx, err = db.Begin(); err != nil {
+				return fmt.Errorf("failed to begin transaction: %w", err)
+			}
+		}
+		if err := applySource(tx, report, p); err != nil {
+			return fail(err)
+		}
+		progress.add(p)
+		batchFiles++
+		if p.Src != nil {
+			batchPosts += len(p.Src.Posts)
+		}
+		if batchFiles >= ingestBatchFiles || batchPosts >= ingestBatchPosts {
+			if err := commit(); err != nil {
+				return fmt.Errorf("commit failed: %w", err)
+			}
+		}
+	}
+	if err := commit(); err != nil {
+		return fmt.Errorf("commit failed: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		progress.print("Cancelled")
+		return err
+	}
+	progress.print("Ingested")
+	return nil
+}
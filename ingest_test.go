@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrapeCancelAndResume(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(tmp, "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	forum := filepath.Join(tmp, "forum") + "/"
+	for i := 0; i < 30; i++ {
+		writePostsFile(t, forum, fmt.Sprintf("board/threads/t%d", i), fmt.Sprintf(`{
+			"post-%d": {"user": "Puck", "user_num": 42, "timestamp": "1459729209000", "message": "One."},
+			"post-%d": {"user": "Fly", "user_num": 43, "timestamp": "1459729309000", "message": "Two."}
+		}`, 2*i, 2*i+1))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ScrapeAndInsertPosts(ctx, db, forum, 4); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled scrape returned %v", err)
+	}
+
+	// Whatever the cancelled run committed is complete, so a rerun picks up the rest
+	report, err := ScrapeAndInsertPosts(context.Background(), db, forum, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilesScanned != 30 || report.FilesFailed != 0 {
+		t.Errorf("rerun scanned %d files, %d failed", report.FilesScanned, report.FilesFailed)
+	}
+	var stored, files int
+	db.QueryRow(`SELECT COUNT(*) FROM forum_posts`).Scan(&stored)
+	db.QueryRow(`SELECT COUNT(*) FROM ingest_manifest`).Scan(&files)
+	if stored != 60 || files != 30 {
+		t.Errorf("stored %d posts from %d files, want 60 from 30", stored, files)
+	}
+}
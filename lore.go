@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ---- Lore ----
+// A knowledge base of the named things in the forum that are not player
+// characters: places, factions, artifacts, creatures and NPCs. Thread chunks
+// are run through function calling to find the entities they mention; a
+// name or alias seen before with the same kind is the same entity. Each
+// entity keeps what every chunk says about it, and a description is
+// synthesized from those notes once they change.
+var loreKinds = []string{"place", "faction", "artifact", "creature", "npc"}
+
+type LoreEntity struct {
+	ID             int64
+	Name           string
+	Kind           string
+	Aliases        []string // other names, not including Name
+	Description    string
+	FirstMentionAt int64
+	LastMentionAt  int64
+	PostIDs        []string // oldest first
+}
+
+// A mention of an entity as returned by the model
+type loreMention struct {
+	Name    string   `json:"name"`
+	Kind    string   `json:"kind"`
+	Aliases []string `json:"aliases"`
+	Note    string   `json:"note"`
+	PostIDs []string `json:"post_ids"`
+}
+
+var loreFunction = openai.FunctionDefinition{
+	Name:        "record_lore",
+	Description: "Record the named places, factions, artifacts, creatures and non-player characters mentioned in a section of a fantasy roleplay forum thread.",
+	Parameters: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"entities": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name":     map[string]string{"type": "string", "description": "The entity's fullest proper name"},
+						"kind":     map[string]interface{}{"type": "string", "enum": loreKinds},
+						"aliases":  map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "Other names or titles used for it in these posts"},
+						"note":     map[string]string{"type": "string", "description": "What these posts establish about it, in one to three sentences"},
+						"post_ids": map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "IDs of the posts that mention it"},
+					},
+					"required": []string{"name", "kind", "note", "post_ids"},
+				},
+			},
+		},
+		"required": []string{"entities"},
+	},
+}
+
+const loreSystemPrompt = "You are an expert at cataloguing the lore of fantasy roleplay forums."
+
+func lorePrompt(chunkText string) string {
+	return "List the named places, factions, artifacts, creatures and non-player characters in the following thread section, with what the posts establish about each. Leave out the player characters who write the posts, and things that are not named. Each post is headed by its author, its ID in parentheses and its time.\n\nThread Section:\n" + chunkText
+}
+
+// parseLore reads the arguments of a record_lore call for chunk. Unknown
+// kinds, the chunk's authors and post IDs outside the chunk are dropped.
+func parseLore(arguments string, chunk []ForumPost) ([]loreMention, error) {
+	var call struct {
+		Entities []loreMention `json:"entities"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &call); err != nil {
+		return nil, err
+	}
+	inChunk := postIDSet(chunk)
+	authors := make(map[string]bool)
+	for _, p := range chunk {
+		authors[strings.ToLower(p.User)] = true
+	}
+	kinds := make(map[string]bool)
+	for _, k := range loreKinds {
+		kinds[k] = true
+	}
+
+	var mentions []loreMention
+	for _, m := range call.Entities {
+		m.Name = strings.TrimSpace(m.Name)
+		m.Kind = strings.ToLower(strings.TrimSpace(m.Kind))
+		m.Note = strings.TrimSpace(m.Note)
+		if m.Name == "" || !kinds[m.Kind] || authors[strings.ToLower(m.Name)] {
+			continue
+		}
+		var aliases []string
+		for _, a := range m.Aliases {
+			if a = strings.TrimSpace(a); a != "" && !strings.EqualFold(a, m.Name) {
+				aliases = append(aliases, a)
+			}
+		}
+		m.Aliases = aliases
+		var ids []string
+		for _, id := range m.PostIDs {
+			if inChunk[id] {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		m.PostIDs = ids
+		mentions = append(mentions, m)
+	}
+	return mentions, nil
+}
+
+func ExtractLore(client *openai.Client, chunk []ForumPost) ([]loreMention, error) {
+	resp, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
+		Model: openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: loreSystemPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: lorePrompt(renderChunk(chunk))},
+		},
+		Functions:    []openai.FunctionDefinition{loreFunction},
+		FunctionCall: openai.FunctionCall{Name: loreFunction.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, choice := range resp.Choices {
+		if choice.Message.FunctionCall != nil && choice.Message.FunctionCall.Arguments != "" {
+			return parseLore(choice.Message.FunctionCall.Arguments, chunk)
+		}
+	}
+	return nil, fmt.Errorf("No function response in completion")
+}
+
+// resolveLoreEntity returns the entity of that kind known by the name or
+// one of the aliases, creating it if there is none, and records any new
+// aliases.
+func resolveLoreEntity(tx *sql.Tx, m loreMention) (int64, error) {
+	names := append([]string{m.Name}, m.Aliases...)
+	var id int64
+	for _, name := range names {
+		err := tx.QueryRow(`
+			SELECT e.id FROM lore_aliases a JOIN lore_entities e ON e.id = a.entity_id
+			WHERE a.alias = ? AND e.kind = ? ORDER BY e.id LIMIT 1
+		`, name, m.Kind).Scan(&id)
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows {
+			return 0, err
+		}
+	}
+	if id == 0 {
+		res, err := tx.Exec(`INSERT INTO lore_entities (name, kind) VALUES (?, ?)`, m.Name, m.Kind)
+		if err != nil {
+			return 0, err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+	}
+	for _, name := range names {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO lore_aliases (alias, entity_id) VALUES (?, ?)`, name, id); err != nil {
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// SaveLoreMentions replaces what a chunk says about its entities and records
+// the chunk as extracted.
+func SaveLoreMentions(db *sql.DB, hash string, chunk []ForumPost, mentions []loreMention) error {
+	threadPath := chunk[0].ThreadPath
+	timestamps := make(map[string]int64, len(chunk))
+	for _, p := range chunk {
+		timestamps[p.PostID] = p.Timestamp
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM lore_mentions WHERE chunk_hash = ?`, hash); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM lore_posts WHERE chunk_hash = ?`, hash); err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, m := range mentions {
+		id, err := resolveLoreEntity(tx, m)
+		if err != nil {
+			return err
+		}
+		// An entity named twice in one chunk keeps both notes
+		_, err = tx.Exec(`
+			INSERT INTO lore_mentions (entity_id, chunk_hash, thread_path, note, added_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (entity_id, chunk_hash) DO UPDATE SET note = note || ' ' || excluded.note
+		`, id, hash, threadPath, m.Note, now)
+		if err != nil {
+			return err
+		}
+		for _, postID := range m.PostIDs {
+			_, err := tx.Exec(`INSERT OR REPLACE INTO lore_posts (entity_id, post_id, chunk_hash, thread_path, timestamp) VALUES (?, ?, ?, ?, ?)`,
+				id, postID, hash, threadPath, timestamps[postID])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec(`INSERT OR REPLACE INTO lore_extractions (chunk_hash, thread_path, entity_count, extracted_at) VALUES (?, ?, ?, ?)`,
+		hash, threadPath, len(mentions), now)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func loreExtracted(db *sql.DB, hash string) bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM lore_extractions WHERE chunk_hash = ?`, hash).Scan(&n)
+	return n > 0
+}
+
+// staleLoreEntities lists entities with notes newer than their description
+func staleLoreEntities(db *sql.DB) ([]int64, error) {
+	rows, err := db.Query(`
+		SELECT e.id FROM lore_entities e
+		WHERE EXISTS (SELECT 1 FROM lore_mentions m WHERE m.entity_id = e.id AND m.added_at > COALESCE(e.synthesized_at, -1))
+		ORDER BY e.id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// loreNotes returns an entity's notes in the order of the posts behind them
+func loreNotes(db *sql.DB, id int64) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT m.note FROM lore_mentions m
+		WHERE m.entity_id = ?
+		ORDER BY (SELECT MIN(p.timestamp) FROM lore_posts p WHERE p.entity_id = m.entity_id AND p.chunk_hash = m.chunk_hash), m.chunk_hash
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var notes []string
+	for rows.Next() {
+		var note string
+		if err := rows.Scan(&note); err != nil {
+			return nil, err
+		}
+		if note != "" {
+			notes = append(notes, note)
+		}
+	}
+	return notes, rows.Err()
+}
+
+// synthesizeLoreEntity writes the description of an entity from its notes.
+// Entities with a single note use it as is.
+func synthesizeLoreEntity(db *sql.DB, client *openai.Client, id int64) error {
+	var name, kind string
+	if err := db.QueryRow(`SELECT name, kind FROM lore_entities WHERE id = ?`, id).Scan(&name, &kind); err != nil {
+		return err
+	}
+	notes, err := loreNotes(db, id)
+	if err != nil {
+		return err
+	}
+	description := strings.Join(notes, " ")
+	if len(notes) > 1 {
+		input := TokenizerFor(summaryModel).Truncate(strings.Join(notes, "\n"), TokenBudget(summaryModel, 0))
+		prompt := fmt.Sprintf("Write a short encyclopedia entry for %s, a %s in a fantasy roleplay forum, from these notes taken from posts in the order they were written. Keep to what the notes establish, and say how it changed over time where they show that.\n\n%s", name, kind, input)
+		if description, err = complete(client, loreSystemPrompt, prompt); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`UPDATE lore_entities SET description = ?, synthesized_at = ? WHERE id = ?`, description, time.Now().Unix(), id)
+	return err
+}
+
+// FindLoreEntities returns the entities known by name or alias, ignoring
+// case; with no exact match, those whose name starts with it.
+func FindLoreEntities(db *sql.DB, name string) ([]*LoreEntity, error) {
+	name = strings.TrimSpace(name)
+	queries := []struct {
+		where string
+		arg   string
+	}{
+		{`id IN (SELECT entity_id FROM lore_aliases WHERE alias = ?)`, name},
+		{`id IN (SELECT entity_id FROM lore_aliases WHERE alias LIKE ?)`, name + "%"},
+	}
+	for _, q := range queries {
+		rows, err := db.Query(`SELECT id FROM lore_entities WHERE `+q.where+` ORDER BY name LIMIT 10`, q.arg)
+		if err != nil {
+			return nil, err
+		}
+		var ids []int64
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			continue
+		}
+		entities := make([]*LoreEntity, 0, len(ids))
+		for _, id := range ids {
+			e, err := GetLoreEntity(db, id)
+			if err != nil {
+				return nil, err
+			}
+			entities = append(entities, e)
+		}
+		return entities, nil
+	}
+	return nil, nil
+}
+
+func GetLoreEntity(db *sql.DB, id int64) (*LoreEntity, error) {
+	e := &LoreEntity{ID: id}
+	var description sql.NullString
+	err := db.QueryRow(`
+		SELECT name, kind, description,
+			(SELECT COALESCE(MIN(timestamp), 0) FROM lore_posts WHERE entity_id = e.id),
+			(SELECT COALESCE(MAX(timestamp), 0) FROM lore_posts WHERE entity_id = e.id)
+		FROM lore_entities e WHERE id = ?
+	`, id).Scan(&e.Name, &e.Kind, &description, &e.FirstMentionAt, &e.LastMentionAt)
+	if err != nil {
+		return nil, err
+	}
+	e.Description = description.String
+
+	rows, err := db.Query(`SELECT alias FROM lore_aliases WHERE entity_id = ? AND alias != ? ORDER BY alias`, id, e.Name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var alias string
+		if err := rows.Scan(&alias); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e.Aliases = append(e.Aliases, alias)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT post_id FROM lore_posts WHERE entity_id = ? ORDER BY timestamp, post_id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var postID string
+		if err := rows.Scan(&postID); err != nil {
+			return nil, err
+		}
+		e.PostIDs = append(e.PostIDs, postID)
+	}
+	return e, rows.Err()
+}
+
+// characterReferences lists the character sheets that name the entity
+// among their affiliations or relationships, e.g. "Puck (affiliation)".
+func characterReferences(e *LoreEntity) []string {
+	files, _ := filepath.Glob("data/tfs/characters/*.json")
+	names := append([]string{e.Name}, e.Aliases...)
+	matches := func(s string) bool {
+		for _, n := range names {
+			if strings.EqualFold(strings.TrimSpace(s), n) {
+				return true
+			}
+		}
+		return false
+	}
+	var refs []string
+	for _, path := range files {
+		cs, err := LoadCharacterSheet(path)
+		if err != nil {
+			continue
+		}
+		for _, a := range cs.Affiliations {
+			if matches(a) {
+				refs = append(refs, cs.Name+" (affiliation)")
+			}
+		}
+		for _, r := range cs.ImportantRelationships {
+			if matches(r["name"]) {
+				refs = append(refs, fmt.Sprintf("%s (%s)", cs.Name, strings.ToLower(r["type"])))
+			}
+		}
+	}
+	return refs
+}
+
+// FormatLoreEntity renders an entity for the CLI and Discord, listing at
+// most maxPosts of its posts.
+func FormatLoreEntity(e *LoreEntity, maxPosts int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "**%s** (%s)", e.Name, e.Kind)
+	if len(e.Aliases) > 0 {
+		fmt.Fprintf(&b, ", also %s", strings.Join(e.Aliases, ", "))
+	}
+	fmt.Fprintf(&b, "\nMentioned %s to %s in %d posts\n", FormatWorldTime(e.FirstMentionAt), FormatWorldTime(e.LastMentionAt), len(e.PostIDs))
+	if e.Description != "" {
+		fmt.Fprintf(&b, "%s\n", e.Description)
+	} else {
+		b.WriteString("(No description yet; run -mode lore)\n")
+	}
+	if refs := characterReferences(e); len(refs) > 0 {
+		fmt.Fprintf(&b, "Character sheets: %s\n", strings.Join(refs, ", "))
+	}
+	posts := e.PostIDs
+	if len(posts) > maxPosts {
+		posts = posts[:maxPosts]
+	}
+	labels := make([]string, len(posts))
+	for i, id := range posts {
+		labels[i] = PostLabel(id)
+	}
+	if len(labels) > 0 {
+		more := ""
+		if len(e.PostIDs) > len(posts) {
+			more = fmt.Sprintf(" and %d more", len(e.PostIDs)-len(posts))
+		}
+		fmt.Fprintf(&b, "Posts: %s%s\n", strings.Join(labels, ", "), more)
+	}
+	return b.String()
+}
+
+// ---- CLI ----
+// BuildLore extracts the entities of every thread under prefix and then
+// synthesizes the descriptions whose notes changed. Chunks that were
+// extracted before are skipped unless force is set.
+func BuildLore(dryRun, force bool, prefix string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT DISTINCT thread_path FROM forum_posts WHERE thread_path LIKE ? ORDER BY thread_path`, prefix+"%")
+	if err != nil {
+		log.Fatalf("failed to list threads: %v", err)
+	}
+	var threads []string
+	for rows.Next() {
+		var tp string
+		if err := rows.Scan(&tp); err != nil {
+			log.Fatalf("failed to list threads: %v", err)
+		}
+		threads = append(threads, tp)
+	}
+	rows.Close()
+
+	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	extract := func(chunk []ForumPost) ([]loreMention, error) { return ExtractLore(client, chunk) }
+	var total extractionStats
+	for _, tp := range threads {
+		stats, err := extractLoreInThread(db, tp, dryRun, force, extract)
+		if err != nil {
+			log.Fatalf("failed to extract lore for thread %s: %v", tp, err)
+		}
+		total.add(stats)
+	}
+
+	stale, err := staleLoreEntities(db)
+	if err != nil {
+		log.Fatalf("failed to check lore entities: %v", err)
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d chunks in %d threads would be sent, %d were extracted before; %d entities need a description\n",
+			total.todo, len(threads), total.skipped, len(stale))
+		return
+	}
+	fmt.Printf("%d mentions from %d chunks, %d chunks already done, %d failed\n", total.saved, total.todo-total.failed, total.skipped, total.failed)
+	described := 0
+	for i, id := range stale {
+		fmt.Printf("Describing entity %d/%d...\n", i+1, len(stale))
+		if err := synthesizeLoreEntity(db, client, id); err != nil {
+			log.Printf("Description failed: %v", err)
+			continue
+		}
+		described++
+	}
+	var entities int
+	db.QueryRow(`SELECT COUNT(*) FROM lore_entities`).Scan(&entities)
+	fmt.Printf("%d lore entities, %d descriptions updated, %d failed\n", entities, described, len(stale)-described)
+}
+
+// extractLoreInThread extracts the chunks of a thread that were not done
+// before. Once every chunk is done, the notes and posts of chunks the thread
+// no longer has are dropped, as for events.
+func extractLoreInThread(db *sql.DB, tp string, dryRun, force bool, extract func([]ForumPost) ([]loreMention, error)) (extractionStats, error) {
+	var stats extractionStats
+	posts, err := GetPostsByThread(db, tp)
+	if err != nil {
+		return stats, err
+	}
+	chunks := ChunkPosts(posts, ChunkOptions{Model: openai.GPT4o, MaxTokens: summaryChunkTokens})
+	hashes := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		hash := chunkHash(chunk, renderChunk(chunk))
+		hashes[i] = hash
+		if !force && loreExtracted(db, hash) {
+			stats.skipped++
+			continue
+		}
+		stats.todo++
+		if dryRun {
+			continue
+		}
+		fmt.Printf("Extracting lore from %s, chunk %d/%d...\n", tp, i+1, len(chunks))
+		mentions, err := extract(chunk)
+		if err != nil {
+			log.Printf("Extraction failed: %v", err)
+			stats.failed++
+			continue
+		}
+		if err := SaveLoreMentions(db, hash, chunk, mentions); err != nil {
+			return stats, err
+		}
+		stats.saved += len(mentions)
+	}
+	if dryRun || stats.failed > 0 {
+		return stats, nil
+	}
+	return stats, pruneLore(db, tp, hashes)
+}
+
+// pruneLore drops the notes and posts of a thread's chunks other than
+// hashes. Entities that lost notes are described again, and those left
+// with none are removed.
+func pruneLore(db *sql.DB, threadPath string, hashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	keep, args := hashesNotIn(threadPath, hashes)
+	stmts := []string{
+		`UPDATE lore_entities SET synthesized_at = NULL WHERE id IN (SELECT entity_id FROM lore_mentions WHERE thread_path = ? AND chunk_hash NOT IN (` + keep + `))`,
+		`DELETE FROM lore_mentions WHERE thread_path = ? AND chunk_hash NOT IN (` + keep + `)`,
+		`DELETE FROM lore_posts WHERE thread_path = ? AND chunk_hash NOT IN (` + keep + `)`,
+		`DELETE FROM lore_extractions WHERE thread_path = ? AND chunk_hash NOT IN (` + keep + `)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt, args...); err != nil {
+			return err
+		}
+	}
+	orphans := `SELECT id FROM lore_entities WHERE id NOT IN (SELECT entity_id FROM lore_mentions)`
+	if _, err := tx.Exec(`DELETE FROM lore_aliases WHERE entity_id IN (` + orphans + `)`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM lore_posts WHERE entity_id IN (` + orphans + `)`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM lore_entities WHERE id IN (` + orphans + `)`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// LookupLore prints the entities known by name
+func LookupLore(name string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	entities, err := FindLoreEntities(db, name)
+	if err != nil {
+		log.Fatalf("failed to look up %q: %v", name, err)
+	}
+	if len(entities) == 0 {
+		fmt.Printf("No lore entry for %q\n", name)
+		return
+	}
+	for _, e := range entities {
+		fmt.Println(FormatLoreEntity(e, 20))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLore(t *testing.T) {
+	db := openTestDB(t)
+	first := []ForumPost{
+		{PostID: "post-1", User: "Puck", Timestamp: 1459729209, ThreadPath: "overworld/isran-empire/threads/siege"},
+		{PostID: "post-2", User: "Empress Naoki", Timestamp: 1459729300, ThreadPath: "overworld/isran-empire/threads/siege"},
+	}
+	args := `{"entities": [
+		{"name": "Isran Empire", "kind": "Faction", "aliases": ["Isra", "isran empire"], "note": "An empire ruled by Empress Naoki.", "post_ids": ["post-2", "post-9"]},
+		{"name": "Empress Naoki", "kind": "npc", "note": "Writes the posts.", "post_ids": ["post-2"]},
+		{"name": "The Sunblade", "kind": "weapon", "note": "A sword.", "post_ids": ["post-1"]},
+		{"name": "Black Vale", "kind": "place", "note": "Never cited.", "post_ids": []}
+	]}`
+	mentions, err := parseLore(args, first)
+	if err != nil || len(mentions) != 1 {
+		t.Fatalf("mentions = %+v, %v", mentions, err)
+	}
+	if m := mentions[0]; m.Kind != "faction" || strings.Join(m.Aliases, ",") != "Isra" || strings.Join(m.PostIDs, ",") != "post-2" {
+		t.Errorf("mention = %+v", m)
+	}
+	if err := SaveLoreMentions(db, "hash-1", first, mentions); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later chunk that only uses the alias adds to the same entity
+	second := []ForumPost{{PostID: "post-7", User: "Puck", Timestamp: 1459900000, ThreadPath: "overworld/isran-empire/threads/peace"}}
+	later := []loreMention{{Name: "Isra", Kind: "faction", Aliases: []string{"The Empire"}, Note: "Isra made peace.", PostIDs: []string{"post-7"}}}
+	if err := SaveLoreMentions(db, "hash-2", second, later); err != nil {
+		t.Fatal(err)
+	}
+	// So does a place of the same name, as a separate entity
+	place := []loreMention{{Name: "Isra", Kind: "place", Note: "A plain.", PostIDs: []string{"post-7"}}}
+	if err := SaveLoreMentions(db, "hash-3", second, place); err != nil {
+		t.Fatal(err)
+	}
+	if !loreExtracted(db, "hash-2") {
+		t.Error("chunk not recorded as extracted")
+	}
+
+	entities, err := FindLoreEntities(db, "the empire")
+	if err != nil || len(entities) != 1 {
+		t.Fatalf("entities = %+v, %v", entities, err)
+	}
+	e := entities[0]
+	if e.Name != "Isran Empire" || strings.Join(e.Aliases, ",") != "Isra,The Empire" || strings.Join(e.PostIDs, ",") != "post-2,post-7" ||
+		e.FirstMentionAt != 1459729300 || e.LastMentionAt != 1459900000 {
+		t.Errorf("entity = %+v", e)
+	}
+	if both, _ := FindLoreEntities(db, "isra"); len(both) != 2 {
+		t.Errorf("%d entities named Isra, want 2", len(both))
+	}
+	if prefix, _ := FindLoreEntities(db, "Isran"); len(prefix) != 1 {
+		t.Errorf("%d entities starting with Isran, want 1", len(prefix))
+	}
+
+	stale, _ := staleLoreEntities(db)
+	if len(stale) != 2 {
+		t.Fatalf("stale = %v", stale)
+	}
+	notes, _ := loreNotes(db, e.ID)
+	if strings.Join(notes, "|") != "An empire ruled by Empress Naoki.|Isra made peace." {
+		t.Errorf("notes = %q", notes)
+	}
+	// A single note is the description as is, without a call
+	if err := synthesizeLoreEntity(db, nil, stale[1]); err != nil {
+		t.Fatal(err)
+	}
+	if stale, _ := staleLoreEntities(db); len(stale) != 1 {
+		t.Errorf("stale after describing = %v", stale)
+	}
+}
+
+// A thread that grows gets a new last chunk; the old one's notes go, and
+// entities only it mentioned go with them
+func TestBuildLorePrunesStaleChunks(t *testing.T) {
+	db := openTestDB(t)
+	const tp = "overworld/isran-empire/threads/siege"
+	addPost := func(id string, ts int64) {
+		if _, err := db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES (?, 'Puck', 0, ?, 'The walls hold.', ?)`, id, ts, tp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	extract := func(chunk []ForumPost) ([]loreMention, error) {
+		last := chunk[len(chunk)-1].PostID
+		mentions := []loreMention{{Name: "Black Vale", Kind: "place", Note: "A fortress.", PostIDs: []string{last}}}
+		if len(chunk) == 1 {
+			mentions = append(mentions, loreMention{Name: "The Sunblade", Kind: "artifact", Note: "A sword.", PostIDs: []string{last}})
+		}
+		return mentions, nil
+	}
+	count := func(table string) int {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	addPost("post-1", 1459729209)
+	if _, err := extractLoreInThread(db, tp, false, false, extract); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE lore_entities SET synthesized_at = ?`, time.Now().Unix()+60); err != nil {
+		t.Fatal(err)
+	}
+	addPost("post-2", 1459729300)
+	if stats, err := extractLoreInThread(db, tp, false, false, extract); err != nil || stats.todo != 1 {
+		t.Fatalf("second run = %+v, %v", stats, err)
+	}
+	for table, want := range map[string]int{"lore_mentions": 1, "lore_posts": 1, "lore_extractions": 1, "lore_entities": 1, "lore_aliases": 1} {
+		if n := count(table); n != want {
+			t.Errorf("%d rows in %s, want %d", n, table, want)
+		}
+	}
+	if found, _ := FindLoreEntities(db, "The Sunblade"); len(found) != 0 {
+		t.Errorf("entity from the old chunk kept: %+v", found[0])
+	}
+	vale, err := FindLoreEntities(db, "Black Vale")
+	if err != nil || len(vale) != 1 || len(vale[0].PostIDs) != 1 || vale[0].PostIDs[0] != "post-2" {
+		t.Fatalf("Black Vale = %+v, %v", vale, err)
+	}
+	// It lost a note, so it is described again
+	if stale, _ := staleLoreEntities(db); len(stale) != 1 || stale[0] != vale[0].ID {
+		t.Errorf("stale = %v", stale)
+	}
+}
@@ -2,27 +2,31 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 )
 
 // ---- ForumPost Struct ----
 type ForumPost struct {
-	PostID     string
-	User       string
-	UserNum    int
-	Timestamp  int64
-	Message    string
-	ThreadPath string
+	PostID       string
+	User         string
+	UserNum      int
+	Timestamp    int64
+	Message      string
+	ThreadPath   string
+	CleanMessage string // normalized Message, see normalize.go
 }
 
 func CountLines(filename string) (int, error) {
@@ -60,18 +64,20 @@ func FindPostsFiles(root string) ([]string, error) {
 }
 
 // ---- Parse a Single Posts File ----
-func ParsePostsFile(path string, threadPath string) ([]ForumPost, error) {
+// Posts whose timestamp can't be read are left out and returned as issues.
+func ParsePostsFile(path string, threadPath string) ([]ForumPost, []ValidationIssue, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var raw map[string]map[string]interface{}
 	if err := json.Unmarshal(data, &raw); err != nil {
-		return nil, fmt.Errorf("error parsing %s: %w", path, err)
+		return nil, nil, fmt.Errorf("error parsing %s: %w", path, err)
 	}
 
 	var posts []ForumPost
+	var issues []ValidationIssue
 	for postID, post := range raw {
 		user, _ := post["user"].(string)
 		var userNum int
@@ -81,16 +87,19 @@ func ParsePostsFile(path string, threadPath string) ([]ForumPost, error) {
 		var timestamp int64
 		switch v := post["timestamp"].(type) {
 		case float64:
-			timestamp = int64(v)
+			timestamp = unixSeconds(int64(v))
 		case string:
 			parsed, err := strconv.ParseInt(v, 10, 64)
-			if err == nil {
-				timestamp = parsed
-			} else {
-				fmt.Println("Failed to parse timestamp string:", v)
+			if err != nil {
+				issues = append(issues, ValidationIssue{ThreadPath: threadPath, PostID: postID,
+					Reason: ReasonBadTimestamp, Detail: fmt.Sprintf("unparseable timestamp string %q", v)})
+				continue
 			}
+			timestamp = unixSeconds(parsed)
 		default:
-			fmt.Println("timestamp field missing or unknown type:", post["timestamp"])
+			issues = append(issues, ValidationIssue{ThreadPath: threadPath, PostID: postID,
+				Reason: ReasonBadTimestamp, Detail: fmt.Sprintf("timestamp missing or of type %T", v)})
+			continue
 		}
 		message, _ := post["message"].(string)
 		posts = append(posts, ForumPost{
@@ -102,100 +111,104 @@ func ParsePostsFile(path string, threadPath string) ([]ForumPost, error) {
 			ThreadPath: threadPath,
 		})
 	}
-	return posts, nil
+	return posts, issues, nil
 }
 
-// ---- Scrape and Batch Insert into DB ----
-func ScrapeAndInsertPosts(db *sql.DB, basePath string) error {
-	const batchSize = 1000 // Tune this for your system
-
+// ---- Incremental Scrape into DB ----
+// Only posts files whose mtime and hash differ from the manifest are re-parsed.
+func ScrapeAndInsertPosts(ctx context.Context, db *sql.DB, basePath string, workers int) (*ScrapeReport, error) {
 	files, err := FindPostsFiles(basePath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	manifest, err := LoadManifest(db)
+	if err != nil {
+		return nil, fmt.Errorf("load manifest failed: %w", err)
 	}
 
-	// Prepare statement for inserting posts
-	stmt, err := db.Prepare(`
-		INSERT OR REPLACE INTO forum_posts
-		(post_id, user, user_num, timestamp, message, thread_path)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`)
+	runID, err := startIngestRun(db)
 	if err != nil {
-		return fmt.Errorf("prepare statement failed: %w", err)
+		return nil, fmt.Errorf("start ingest run failed: %w", err)
 	}
-	defer stmt.Close()
+	report := &ScrapeReport{RunID: runID}
 
+	seen := make(map[string]bool)
+	jobs := make([]sourceJob, 0, len(files))
 	for _, postsPath := range files {
-		fmt.Printf("Processing %s...\n", postsPath)
+		postsPath := postsPath
+		seen[postsPath] = true
 		relPath, _ := filepath.Rel(basePath, postsPath)
 		threadPath := strings.TrimSuffix(relPath, "/posts")
-		posts, err := ParsePostsFile(postsPath, threadPath)
-		if err != nil {
-			fmt.Printf("Error parsing %s: %v\n", postsPath, err)
-			continue
-		}
-
-		// Batch insert
-		for i := 0; i < len(posts); i += batchSize {
-			end := i + batchSize
-			if end > len(posts) {
-				end = len(posts)
-			}
-			batch := posts[i:end]
-			tx, err := db.Begin()
+		jobs = append(jobs, sourceJob{Path: postsPath, Parse: func() (*ParsedSource, error) {
+			posts, issues, err := ParsePostsFile(postsPath, threadPath)
 			if err != nil {
-				fmt.Printf("Failed to begin transaction: %v\n", err)
-				continue
-			}
-			for _, p := range batch {
-				_, err := tx.Stmt(stmt).Exec(p.PostID, p.User, p.UserNum, p.Timestamp, p.Message, p.ThreadPath)
-				if err != nil {
-					fmt.Printf("Insert error (post_id=%s): %v\n", p.PostID, err)
-				}
+				return nil, err
 			}
-			if err := tx.Commit(); err != nil {
-				fmt.Printf("Commit error: %v\n", err)
-			}
-			fmt.Print(".")
-		}
+			posts, quotes := NormalizeThread(posts, nil)
+			return &ParsedSource{ThreadPath: threadPath, Posts: posts, Quotes: quotes, Issues: issues}, nil
+		}})
+	}
+	removeVanishedFiles(db, report, manifest, seen, basePath)
+	if err := ingestSources(ctx, db, report, manifest, jobs, workers); err != nil {
+		finishIngestRun(db, report)
+		return report, err
 	}
-	return nil
-}
 
-func ensureForumPostsTable(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS forum_posts (
-			post_id TEXT PRIMARY KEY,
-			user TEXT,
-			user_num INTEGER,
-			timestamp INTEGER,
-			message TEXT,
-			thread_path TEXT
-		)
-	`)
-	return err
+	if err := finishIngestRun(db, report); err != nil {
+		fmt.Printf("Failed to finish ingest run: %v\n", err)
+	}
+	return report, nil
 }
 
-func Scrape() {
+func Scrape(workers int) {
 	db, err := sql.Open("sqlite", "data/docs.db")
 	if err != nil {
 		panic(fmt.Sprintf("failed to connect database: %v", err))
 	}
 	defer db.Close()
-	if err := ensureForumPostsTable(db); err != nil {
-		panic(fmt.Sprintf("failed to create table: %v", err))
-	}
+
+	// Ctrl-C stops the scrape after the files applied so far are committed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
 	basePath := "data/tfs/forum/"
-	if err := ScrapeAndInsertPosts(db, basePath); err != nil {
+	report, err := ScrapeAndInsertPosts(ctx, db, basePath, workers)
+	if err != nil {
 		fmt.Println("Error:", err)
 	}
+	if report != nil {
+		report.Print()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := RebuildBoardsAndThreads(db, "data/tfs/data/"); err != nil {
+		fmt.Println("Error indexing boards and threads:", err)
+	}
+	if err := RebuildForumUsers(db); err != nil {
+		fmt.Println("Error indexing forum users:", err)
+	}
+}
+
+func flagPassed(name string) bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
 }
 
 // ---- Main Entrypoint ----
 func main() {
 	mode := flag.String("mode", "", "Mode to run: scrape, summarize, timeline, character, chat, or best")
 	dryRun := flag.Bool("dry-run", false, "Run without making changes (for testing)")
+	force := flag.Bool("force", false, "Re-summarize timeline windows that already have a summary, or re-extract events, lore and relationships")
+	sessionGap := flag.Duration("session-gap", DefaultSessionOptions.MaxGap, "Idle time that ends a timeline conversation")
+	sessionMax := flag.Duration("session-max", DefaultSessionOptions.MaxLength, "Longest timeline conversation")
 	threadPath := flag.String("thread", "", "Thread path to summarize (e.g. overworld/isran-empire/free-plains-isra/isra-free-city/threads/midnight-sun)")
 	username := flag.String("username", "Empress Naoki", "Username for timeline generation")
 
@@ -203,17 +216,138 @@ func main() {
 	writingPath := flag.String("writing", "data/tfs/writing/empress-naoki-posts.txt", "Path to original writing sample")
 	userMessage := flag.String("message", "Hello, how are you?", "User message for chat")
 	num := flag.Int("num", 5, "Number of results")
+	name := flag.String("name", "", "Lore entry to look up for lore-lookup")
+	other := flag.String("other", "", "Only relationships with this character for relationship-export")
+	date := flag.String("date", "", "Date to convert for calendar (YYYY-MM-DD, default today)")
+	textMode := flag.String("text", string(TextClean), "Post text to feed consumers: raw or clean")
+	format := flag.String("format", "", "Output format: dot, graphml or json for graph (default json); jsonl, csv or md for export (default jsonl); md, html or json for timeline-export (default md); text or json for events-list; md, json or csv for relationship-export (default md)")
+	since := flag.String("since", "", "Only posts on or after this date (YYYY-MM-DD)")
+	until := flag.String("until", "", "Only posts before this date (YYYY-MM-DD)")
+	outPath := flag.String("out", "", "Output file (default stdout)")
+	outDir := flag.String("out-dir", "", "Directory for rollup to write one markdown file per category")
+	overlap := flag.Int("overlap", 0, "Posts repeated at the start of each summarization chunk for continuity")
+	workers := flag.Int("workers", 0, "Parser goroutines for scrape and import (default one per CPU)")
+	importPath := flag.String("path", "", "File or directory to import (default data/discord or data/tfs/html)")
+	mappingPath := flag.String("mapping", "data/discord/mapping.json", "Discord channel/author mapping JSON")
 	flag.Parse()
 
+	PostTextMode = TextMode(*textMode)
+	ChunkOverlap = *overlap
+	if PostTextMode != TextRaw && PostTextMode != TextClean {
+		fmt.Println("Invalid -text value, use raw or clean")
+		return
+	}
+	if ChunkOverlap < 0 {
+		fmt.Println("Invalid -overlap value, use 0 or more posts")
+		return
+	}
+
+	// Refuse to run against an out-of-date schema. chat and count-lines only
+	// read local files; the Discord bot also keeps its memory in memory.db.
 	switch *mode {
+	case "", "migrate", "chat", "count-lines", "calendar":
+	default:
+		if err := CheckSchema(dbPath, docsMigrations); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	if *mode == "discord" {
+		if err := CheckSchema(memoryDBPath, memoryMigrations); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	switch *mode {
+	case "migrate":
+		MigrateMode(*dryRun)
 	case "scrape":
-		Scrape()
+		Scrape(*workers)
+	case "import-discord":
+		if *importPath == "" {
+			*importPath = "data/discord"
+		}
+		ImportDiscord(*importPath, *mappingPath, *workers)
+	case "import-html":
+		if *importPath == "" {
+			*importPath = "data/tfs/html"
+		}
+		ImportProBoards(*importPath, *workers)
 	case "summarize":
 		Summarize(*dryRun, *threadPath)
+	case "summarize-stale":
+		SummarizeStale(*dryRun, *threadPath)
+	case "rollup":
+		RollUpBoards(*dryRun, *threadPath, *outDir)
 	case "timeline":
-		Timeline(*dryRun, *username)
+		Timeline(*dryRun, *force, *username, SessionOptions{MaxGap: *sessionGap, MaxLength: *sessionMax})
+	case "timeline-export":
+		var from, to time.Time
+		var err error
+		if *since != "" {
+			if from, err = parseDateFlag(*since); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if *until != "" {
+			if to, err = parseDateFlag(*until); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if *format == "" {
+			*format = "md"
+		}
+		ExportTimeline(*username, *format, *outPath, from, to)
+	case "events":
+		ExtractThreadEvents(*dryRun, *force, *threadPath)
+	case "events-list":
+		// -username, -message and -num have defaults for the other modes
+		filter := EventFilter{ThreadPrefix: *threadPath}
+		if flagPassed("username") {
+			filter.Participant = *username
+		}
+		if flagPassed("message") {
+			filter.Text = *userMessage
+		}
+		if flagPassed("num") {
+			filter.Limit = *num
+		}
+		var err error
+		if *since != "" {
+			if filter.Since, err = parseDateFlag(*since); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if *until != "" {
+			if filter.Until, err = parseDateFlag(*until); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		ListEvents(filter, *format, *outPath)
+	case "relationships":
+		ExtractRelationshipHistory(*dryRun, *force, *username, SessionOptions{MaxGap: *sessionGap, MaxLength: *sessionMax})
+	case "relationship-export":
+		if *format == "" {
+			*format = "md"
+		}
+		ExportRelationships(*username, *other, *format, *outPath)
+	case "lore":
+		BuildLore(*dryRun, *force, *threadPath)
+	case "lore-lookup":
+		if *name == "" {
+			fmt.Println("lore-lookup needs -name")
+			return
+		}
+		LookupLore(*name)
 	case "character":
-		Charactar(*username, *dryRun)
+		if err := Charactar(*username, *dryRun); err != nil {
+			fmt.Println("Character error:", err)
+		}
 	case "chat":
 		msg, err := Chat(*csPath, *writingPath, *userMessage)
 		if err != nil {
@@ -237,10 +371,65 @@ func main() {
 		BatchesFromFile()
 	case "batch-status":
 		CheckBatchStatuses()
+	case "submit-summary-batches":
+		SubmitSummaryBatches(*dryRun)
+	case "collect-summary-batches":
+		CollectSummaryBatches()
 	case "load-embeddings":
 		LoadEmbeddings()
 	case "search":
-		SearchForumPosts(*userMessage, *num)
+		if _, err := SearchForumPosts(*userMessage, *num); err != nil {
+			fmt.Printf("Semantic search unavailable (%v), falling back to keyword search\n", err)
+			KeywordSearchPosts(*userMessage, SearchOptions{Limit: *num})
+		}
+	case "fts":
+		opts := SearchOptions{ThreadPrefix: *threadPath, Limit: *num}
+		if flagPassed("username") {
+			opts.User = *username
+		}
+		KeywordSearchPosts(*userMessage, opts)
+	case "search-index":
+		RebuildSearch()
+	case "normalize":
+		NormalizeAll()
+	case "quarantine":
+		ListQuarantine(*num)
+	case "calendar":
+		ShowCalendar(*date)
+	case "users":
+		ListUsers(*num)
+	case "user":
+		InspectUser(*username)
+	case "graph":
+		if *format == "" {
+			*format = "json"
+		}
+		ExportInteractionGraph(*threadPath, *format, *outPath)
+	case "export":
+		filter := ExportFilter{ThreadPrefix: *threadPath}
+		// -username has a default for the other modes; only filter on it if given
+		if flagPassed("username") {
+			filter.User = *username
+		}
+		var err error
+		if *since != "" {
+			if filter.Since, err = parseDateFlag(*since); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if *until != "" {
+			if filter.Until, err = parseDateFlag(*until); err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+		if *format == "" {
+			*format = "jsonl"
+		}
+		ExportPosts(filter, *format, *outPath)
+	case "interactions":
+		TopInteractions(*username, *threadPath, *num)
 	case "count-lines":
 		CountLines(*csPath)
 	default:
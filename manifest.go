@@ -0,0 +1,486 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- Ingestion Manifest ----
+// One row per `posts` file we have ingested, so re-scrapes only touch files
+// whose content actually changed.
+type ManifestEntry struct {
+	FilePath   string
+	ThreadPath string
+	Hash       string
+	ModTime    int64 // unix nanoseconds
+	PostCount  int
+	ScrapedAt  int64  // unix seconds
+	Title      string // the thread's title, if the source has one
+}
+
+// Per-thread result of a scrape run
+type ThreadChange struct {
+	ThreadPath string
+	Added      []string
+	Updated    []string
+	Removed    []string
+}
+
+type ScrapeReport struct {
+	RunID          int64
+	FilesScanned   int
+	FilesChanged   int
+	FilesUnchanged int
+	FilesFailed    int
+	Threads        []ThreadChange
+	Issues         []ValidationIssue
+	Quarantined    int // items in quarantine after the run, from every source
+}
+
+func (r *ScrapeReport) Totals() (added, updated, removed int) {
+	for _, t := range r.Threads {
+		added += len(t.Added)
+		updated += len(t.Updated)
+		removed += len(t.Removed)
+	}
+	return
+}
+
+func (r *ScrapeReport) Print() {
+	added, updated, removed := r.Totals()
+	fmt.Printf("\n=== Scrape Report (run %d) ===\n", r.RunID)
+	fmt.Printf("Files: %d scanned, %d changed, %d unchanged, %d failed\n",
+		r.FilesScanned, r.FilesChanged, r.FilesUnchanged, r.FilesFailed)
+	fmt.Printf("Posts: %d added, %d updated, %d removed\n", added, updated, removed)
+	PrintValidationSummary(r.Issues, 3)
+	if r.Quarantined > len(r.Issues) {
+		fmt.Printf("Quarantine holds %d items in total (-mode quarantine to list)\n", r.Quarantined)
+	}
+	sort.Slice(r.Threads, func(i, j int) bool { return r.Threads[i].ThreadPath < r.Threads[j].ThreadPath })
+	for _, t := range r.Threads {
+		if len(t.Added)+len(t.Updated)+len(t.Removed) == 0 {
+			continue
+		}
+		fmt.Printf("  %s: +%d ~%d -%d\n", t.ThreadPath, len(t.Added), len(t.Updated), len(t.Removed))
+	}
+}
+
+func LoadManifest(db *sql.DB) (map[string]ManifestEntry, error) {
+	rows, err := db.Query(`SELECT file_path, thread_path, hash, mtime, post_count, scraped_at, COALESCE(title, '') FROM ingest_manifest`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	manifest := make(map[string]ManifestEntry)
+	for rows.Next() {
+		var e ManifestEntry
+		if err := rows.Scan(&e.FilePath, &e.ThreadPath, &e.Hash, &e.ModTime, &e.PostCount, &e.ScrapedAt, &e.Title); err != nil {
+			return nil, err
+		}
+		manifest[e.FilePath] = e
+	}
+	return manifest, rows.Err()
+}
+
+func saveManifestEntry(tx *sql.Tx, e ManifestEntry) error {
+	_, err := tx.Exec(`
+		INSERT OR REPLACE INTO ingest_manifest (file_path, thread_path, hash, mtime, post_count, scraped_at, title)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, e.FilePath, e.ThreadPath, e.Hash, e.ModTime, e.PostCount, e.ScrapedAt, e.Title)
+	return err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func startIngestRun(db *sql.DB) (int64, error) {
+	res, err := db.Exec(`INSERT INTO ingest_runs (started_at) VALUES (?)`, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func finishIngestRun(db *sql.DB, report *ScrapeReport) error {
+	if err := db.QueryRow(`SELECT COUNT(*) FROM quarantine`).Scan(&report.Quarantined); err != nil {
+		return err
+	}
+	added, updated, removed := report.Totals()
+	_, err := db.Exec(`UPDATE ingest_runs SET finished_at = ?, added = ?, updated = ?, removed = ? WHERE id = ?`,
+		time.Now().Unix(), added, updated, removed, report.RunID)
+	return err
+}
+
+// Existing posts for a thread, keyed by post_id
+func getThreadPostMap(tx *sql.Tx, threadPath string) (map[string]ForumPost, error) {
+	rows, err := tx.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message) FROM forum_posts WHERE thread_path = ?`, threadPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	posts := make(map[string]ForumPost)
+	for rows.Next() {
+		var p ForumPost
+		if err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage); err != nil {
+			return nil, err
+		}
+		posts[p.PostID] = p
+	}
+	return posts, rows.Err()
+}
+
+// Move a post out of forum_posts into the tombstone table
+func tombstonePost(tx *sql.Tx, p ForumPost) error {
+	_, err := tx.Exec(`
+		INSERT OR REPLACE INTO forum_post_tombstones
+		(post_id, user, user_num, timestamp, message, thread_path, removed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, p.PostID, p.User, p.UserNum, p.Timestamp, p.Message, p.ThreadPath, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM forum_posts WHERE post_id = ? AND thread_path = ?`, p.PostID, p.ThreadPath)
+	return err
+}
+
+func recordChange(tx *sql.Tx, runID int64, postID, threadPath, change string) error {
+	_, err := tx.Exec(`INSERT INTO ingest_changes (run_id, post_id, thread_path, change) VALUES (?, ?, ?, ?)`,
+		runID, postID, threadPath, change)
+	return err
+}
+
+// Diff a freshly parsed thread against what is stored and apply the changes
+// in a single transaction.
+func applyThreadPosts(tx *sql.Tx, runID int64, threadPath string, posts []ForumPost, quotes []PostQuote) (ThreadChange, error) {
+	change := ThreadChange{ThreadPath: threadPath}
+	existing, err := getThreadPostMap(tx, threadPath)
+	if err != nil {
+		return change, err
+	}
+
+	postIDs := make([]string, 0, len(posts)+len(existing))
+	for _, p := range posts {
+		postIDs = append(postIDs, p.PostID)
+		old, found := existing[p.PostID]
+		delete(existing, p.PostID)
+		if found && sameSourcePost(old, p) {
+			if old.CleanMessage != p.CleanMessage {
+				// Normalization rules changed, not the post itself
+				if _, err := tx.Exec(`UPDATE forum_posts SET clean_message = ? WHERE post_id = ?`, p.CleanMessage, p.PostID); err != nil {
+					return change, err
+				}
+			}
+			continue
+		}
+		_, err := tx.Exec(`
+			INSERT OR REPLACE INTO forum_posts
+			(post_id, user, user_num, timestamp, message, thread_path, clean_message)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, p.PostID, p.User, p.UserNum, p.Timestamp, p.Message, p.ThreadPath, p.CleanMessage)
+		if err != nil {
+			return change, fmt.Errorf("insert post_id=%s: %w", p.PostID, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM forum_post_tombstones WHERE post_id = ?`, p.PostID); err != nil {
+			return change, err
+		}
+		kind := "added"
+		if found {
+			kind = "updated"
+			change.Updated = append(change.Updated, p.PostID)
+		} else {
+			change.Added = append(change.Added, p.PostID)
+		}
+		if err := recordChange(tx, runID, p.PostID, threadPath, kind); err != nil {
+			return change, err
+		}
+	}
+
+	// Anything left over disappeared from the source file
+	for _, p := range existing {
+		postIDs = append(postIDs, p.PostID)
+		if err := tombstonePost(tx, p); err != nil {
+			return change, fmt.Errorf("tombstone post_id=%s: %w", p.PostID, err)
+		}
+		if err := recordChange(tx, runID, p.PostID, threadPath, "removed"); err != nil {
+			return change, err
+		}
+		change.Removed = append(change.Removed, p.PostID)
+	}
+	if err := savePostQuotes(tx, postIDs, quotes); err != nil {
+		return change, fmt.Errorf("save quotes: %w", err)
+	}
+	return change, nil
+}
+
+// Compare the fields that come from the source file
+func sameSourcePost(a, b ForumPost) bool {
+	return a.PostID == b.PostID && a.User == b.User && a.UserNum == b.UserNum &&
+		a.Timestamp == b.Timestamp && a.Message == b.Message && a.ThreadPath == b.ThreadPath
+}
+
+// A posts file that no longer exists: tombstone every post of its thread
+func removeManifestEntry(db *sql.DB, runID int64, e ManifestEntry) (ThreadChange, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return ThreadChange{}, err
+	}
+	change, err := applyThreadPosts(tx, runID, e.ThreadPath, nil, nil)
+	if err != nil {
+		tx.Rollback()
+		return change, err
+	}
+	if _, err := tx.Exec(`DELETE FROM ingest_manifest WHERE file_path = ?`, e.FilePath); err != nil {
+		tx.Rollback()
+		return change, err
+	}
+	if err := saveQuarantine(tx, runID, e.FilePath, nil); err != nil {
+		tx.Rollback()
+		return change, err
+	}
+	return change, tx.Commit()
+}
+
+// A parsed source file: its thread, posts and the quotes found in them
+type ParsedSource struct {
+	ThreadPath string
+	Title      string // "" when the source only knows the slug
+	Posts      []ForumPost
+	Quotes     []PostQuote
+	Issues     []ValidationIssue // posts the parser had to leave out
+}
+
+type sourceParser func() (*ParsedSource, error)
+
+// A source file to ingest. Salt is mixed into the hash for sources whose
+// parse also depends on other inputs (e.g. a mapping file); the mtime
+// shortcut is skipped for those.
+type sourceJob struct {
+	Path  string
+	Salt  string
+	Parse sourceParser
+}
+
+type prepareStatus int
+
+const (
+	prepareFailed     prepareStatus = iota // could not stat or hash
+	prepareUnchanged                       // same mtime, or same hash
+	prepareTouched                         // same hash, new mtime to remember
+	prepareParseError                      // changed but unparseable
+	prepareParsed                          // changed and parsed
+)
+
+// The result of the database-free half of ingesting a file, so it can run
+// on any goroutine
+type preparedSource struct {
+	Job     sourceJob
+	Status  prepareStatus
+	Err     error
+	Entry   ManifestEntry // previous manifest entry, if any
+	ModTime int64
+	Hash    string
+	Src     *ParsedSource
+	Posts   []ForumPost // posts that passed validation
+	Issues  []ValidationIssue
+}
+
+// prepareSource re-parses a file if its mtime and hash differ from the
+// manifest and validates the posts. It only reads the manifest.
+func prepareSource(manifest map[string]ManifestEntry, job sourceJob) *preparedSource {
+	p := &preparedSource{Job: job}
+	info, err := os.Stat(job.Path)
+	if err != nil {
+		p.Status, p.Err = prepareFailed, err
+		return p
+	}
+	p.ModTime = info.ModTime().UnixNano()
+	entry, known := manifest[job.Path]
+	p.Entry = entry
+	if known && job.Salt == "" && entry.ModTime == p.ModTime {
+		p.Status = prepareUnchanged
+		return p
+	}
+	if p.Hash, err = hashFile(job.Path); err != nil {
+		p.Status, p.Err = prepareFailed, err
+		return p
+	}
+	if job.Salt != "" {
+		sum := sha256.Sum256([]byte(p.Hash + job.Salt))
+		p.Hash = hex.EncodeToString(sum[:])
+	}
+	if known && entry.Hash == p.Hash {
+		p.Status = prepareTouched
+		return p
+	}
+
+	if p.Src, err = job.Parse(); err != nil {
+		p.Status, p.Err = prepareParseError, err
+		return p
+	}
+	p.Status = prepareParsed
+	p.Posts, p.Issues = ValidatePosts(p.Src.Posts)
+	p.Issues = append(p.Src.Issues, p.Issues...)
+	return p
+}
+
+// applySource writes a prepared file inside the writer's transaction. Each
+// file goes into its own savepoint so a failing file does not take the rest
+// of the batch with it. Only database failures are returned; per-file
+// problems are printed and counted in the report.
+func applySource(tx *sql.Tx, report *ScrapeReport, p *preparedSource) error {
+	path := p.Job.Path
+	report.FilesScanned++
+	switch p.Status {
+	case prepareFailed:
+		fmt.Printf("Error reading %s: %v\n", path, p.Err)
+		report.FilesFailed++
+		return nil
+	case prepareUnchanged:
+		report.FilesUnchanged++
+		return nil
+	case prepareTouched:
+		// Touched but not modified: just remember the new mtime
+		if _, err := tx.Exec(`UPDATE ingest_manifest SET mtime = ? WHERE file_path = ?`, p.ModTime, path); err != nil {
+			return fmt.Errorf("manifest update (%s): %w", path, err)
+		}
+		report.FilesUnchanged++
+		return nil
+	case prepareParseError:
+		fmt.Printf("Error parsing %s: %v\n", path, p.Err)
+		report.FilesFailed++
+		issue := ValidationIssue{FilePath: path, ThreadPath: p.Entry.ThreadPath, Reason: ReasonMalformedJSON, Detail: p.Err.Error()}
+		report.Issues = append(report.Issues, issue)
+		if err := saveQuarantine(tx, report.RunID, path, []ValidationIssue{issue}); err != nil {
+			return fmt.Errorf("failed to save quarantine for %s: %w", path, err)
+		}
+		return nil
+	}
+
+	if _, err := tx.Exec(`SAVEPOINT ingest_file`); err != nil {
+		return err
+	}
+	change, issues, err := applyParsedSource(tx, report.RunID, p)
+	if err != nil {
+		if _, rbErr := tx.Exec(`ROLLBACK TO ingest_file; RELEASE ingest_file`); rbErr != nil {
+			return fmt.Errorf("rollback %s: %w", path, rbErr)
+		}
+		fmt.Printf("Error applying %s: %v\n", path, err)
+		report.FilesFailed++
+		return nil
+	}
+	if _, err := tx.Exec(`RELEASE ingest_file`); err != nil {
+		return err
+	}
+	report.Issues = append(report.Issues, issues...)
+	report.FilesChanged++
+	report.Threads = append(report.Threads, change)
+	return nil
+}
+
+func applyParsedSource(tx *sql.Tx, runID int64, p *preparedSource) (ThreadChange, []ValidationIssue, error) {
+	path, threadPath := p.Job.Path, p.Src.ThreadPath
+	posts, dups, err := quarantineCrossThreadDuplicates(tx, threadPath, p.Posts)
+	if err != nil {
+		return ThreadChange{}, nil, fmt.Errorf("validate: %w", err)
+	}
+	issues := append(p.Issues, dups...)
+	for i := range issues {
+		issues[i].FilePath = path
+		if issues[i].PostID == "" {
+			continue
+		}
+		// Quarantined, not removed: keep them out of forum_posts without a tombstone
+		if _, err := tx.Exec(`DELETE FROM forum_posts WHERE post_id = ? AND thread_path = ?`, issues[i].PostID, threadPath); err != nil {
+			return ThreadChange{}, nil, fmt.Errorf("drop quarantined post %s: %w", issues[i].PostID, err)
+		}
+	}
+	if err := saveQuarantine(tx, runID, path, issues); err != nil {
+		return ThreadChange{}, nil, fmt.Errorf("save quarantine: %w", err)
+	}
+	quotes := withoutQuotesFrom(p.Src.Quotes, issues)
+
+	change, err := applyThreadPosts(tx, runID, threadPath, posts, quotes)
+	if err != nil {
+		return change, nil, err
+	}
+	entry := ManifestEntry{
+		FilePath:   path,
+		ThreadPath: threadPath,
+		Hash:       p.Hash,
+		ModTime:    p.ModTime,
+		PostCount:  len(posts),
+		ScrapedAt:  time.Now().Unix(),
+		Title:      p.Src.Title,
+	}
+	if len(dups) > 0 {
+		// Keep the file tracked but without its hash, so the next run reads it
+		// again and takes the duplicates once the other thread lets them go
+		entry.Hash, entry.ModTime = "", 0
+	}
+	return change, issues, saveManifestEntry(tx, entry)
+}
+
+// removeVanishedFiles tombstones the threads of manifest entries under the
+// root directory that were not seen this run. It runs before the new files
+// are applied, so the posts of a renamed or moved file are not taken for
+// duplicates of its old thread. Other sources share the manifest, hence
+// root. Manifest paths come from filepath.Walk, which cleans
+// them, so root is cleaned too.
+func removeVanishedFiles(db *sql.DB, report *ScrapeReport, manifest map[string]ManifestEntry, seen map[string]bool, root string) {
+	root = filepath.Clean(root)
+	for path, entry := range manifest {
+		if seen[path] || root != "." && !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			continue
+		}
+		fmt.Printf("Source file removed: %s\n", path)
+		change, err := removeManifestEntry(db, report.RunID, entry)
+		if err != nil {
+			fmt.Printf("Error removing %s: %v\n", path, err)
+			report.FilesFailed++
+			continue
+		}
+		report.Threads = append(report.Threads, change)
+	}
+}
+
+// Post IDs touched by a given ingest run, filtered by change kind ("" for all)
+func GetChangedPostIDs(db *sql.DB, runID int64, change string) ([]string, error) {
+	query := `SELECT post_id FROM ingest_changes WHERE run_id = ?`
+	args := []interface{}{runID}
+	if change != "" {
+		query += ` AND change = ?`
+		args = append(args, change)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB returns a migrated docs database in a temporary directory
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// A re-scrape applies edits, removals and vanished files, tombstoning what
+// went away
+func TestScrapeDiff(t *testing.T) {
+	db := openTestDB(t)
+	forum := filepath.Join(t.TempDir(), "forum") + "/"
+	write := func(threadPath, content string) {
+		path := filepath.Join(forum, threadPath, "posts")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("board/threads/a", `{
+		"post-1": {"user": "Puck", "user_num": 42, "timestamp": "1459729209000", "message": "One."},
+		"post-2": {"user": "Fly", "user_num": 43, "timestamp": "1459729309000", "message": "Two."}
+	}`)
+	write("board/threads/b", `{
+		"post-3": {"user": "Puck", "user_num": 42, "timestamp": "1459729409000", "message": "Three."}
+	}`)
+	write("board/threads/c", `{
+		"post-4": {"user": "Fly", "user_num": 43, "timestamp": "1459729509000", "message": "Four."}
+	}`)
+	report, err := ScrapeAndInsertPosts(context.Background(), db, forum, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, updated, removed := report.Totals(); added != 4 || updated != 0 || removed != 0 || report.FilesChanged != 3 {
+		t.Fatalf("first scrape: %d files changed, +%d ~%d -%d", report.FilesChanged, added, updated, removed)
+	}
+
+	// Edit post-1, drop post-2, and delete thread b's file
+	write("board/threads/a", `{
+		"post-1": {"user": "Puck", "user_num": 42, "timestamp": "1459729209000", "message": "One, edited."}
+	}`)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(forum, "board/threads/a/posts"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(forum, "board/threads/b/posts")); err != nil {
+		t.Fatal(err)
+	}
+	report, err = ScrapeAndInsertPosts(context.Background(), db, forum, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FilesScanned != 2 || report.FilesChanged != 1 || report.FilesUnchanged != 1 || report.FilesFailed != 0 {
+		t.Errorf("rescrape files: %d scanned, %d changed, %d unchanged, %d failed",
+			report.FilesScanned, report.FilesChanged, report.FilesUnchanged, report.FilesFailed)
+	}
+	if added, updated, removed := report.Totals(); added != 0 || updated != 1 || removed != 2 {
+		t.Errorf("rescrape posts: +%d ~%d -%d, want +0 ~1 -2", added, updated, removed)
+	}
+	removed, _ := GetChangedPostIDs(db, report.RunID, "removed")
+	sort.Strings(removed)
+	if strings.Join(removed, ",") != "post-2,post-3" {
+		t.Errorf("removed = %v", removed)
+	}
+	if updated, _ := GetChangedPostIDs(db, report.RunID, "updated"); strings.Join(updated, ",") != "post-1" {
+		t.Errorf("updated = %v", updated)
+	}
+
+	var message string
+	if err := db.QueryRow(`SELECT message FROM forum_posts WHERE post_id = 'post-1'`).Scan(&message); err != nil || message != "One, edited." {
+		t.Errorf("post-1 = %q, %v", message, err)
+	}
+	tombstones := map[string]string{}
+	rows, err := db.Query(`SELECT post_id, thread_path FROM forum_post_tombstones`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id, tp string
+		if err := rows.Scan(&id, &tp); err != nil {
+			t.Fatal(err)
+		}
+		tombstones[id] = tp
+	}
+	rows.Close()
+	if len(tombstones) != 2 || tombstones["post-2"] != "board/threads/a" || tombstones["post-3"] != "board/threads/b" {
+		t.Errorf("tombstones = %v", tombstones)
+	}
+	var live int
+	db.QueryRow(`SELECT COUNT(*) FROM forum_posts`).Scan(&live)
+	if live != 2 {
+		t.Errorf("%d posts left, want 2", live)
+	}
+
+	manifest, err := LoadManifest(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != 2 {
+		t.Errorf("manifest has %d files, want 2", len(manifest))
+	}
+	for path, e := range manifest {
+		if strings.Contains(path, "threads/b") {
+			t.Errorf("manifest kept the deleted file %s", path)
+		}
+		if e.ThreadPath == "board/threads/a" && e.PostCount != 1 {
+			t.Errorf("manifest counts %d posts for thread a, want 1", e.PostCount)
+		}
+	}
+}
@@ -34,11 +34,10 @@ var (
 
 func StartMemory() {
 	LogToFile("memory.log")
-	memoryDb, err := sql.Open("sqlite", "data/memory.db")
+	memoryDb, err := sql.Open("sqlite", memoryDBPath)
 	if err != nil {
 		log.Fatalf("failed to open memoryDb: %v", err)
 	}
-	initMemoryDB(memoryDb)
 
 	postDb, err := sql.Open("sqlite", "data/docs.db")
 	if err != nil {
@@ -48,31 +47,6 @@ func StartMemory() {
 	// Do NOT block forever or defer memoryDb.Close() here
 }
 
-// DB schema setup
-func initMemoryDB(memoryDb *sql.DB) {
-	_, err := memoryDb.Exec(`
-	CREATE TABLE IF NOT EXISTS contexts (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		channel_id TEXT,
-		author_id TEXT,
-		username TEXT,
-		content TEXT,
-		time INTEGER,
-		type TEXT DEFAULT 'message'
-	);
-	CREATE TABLE IF NOT EXISTS summaries (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		channel_id TEXT,
-		summary_text TEXT,
-		context_ids TEXT,  -- JSON array of int64
-		time INTEGER
-	);
-	`)
-	if err != nil {
-		log.Fatalf("failed to create tables: %v", err)
-	}
-}
-
 // Memory loop: receives update/fetch requests and manages DB + OpenAI summarization
 func memoryLoop(postDb, memoryDb *sql.DB, ch <-chan MemoryRequest) {
 	for req := range ch {
@@ -246,8 +220,8 @@ func getLatestSummary(memoryDb *sql.DB, channelID string) (MemorySummary, error)
 func messagesToString(msgs []ChatMessage) string {
 	s := ""
 	for _, m := range msgs {
-		tm := time.Unix(m.Time, 0).Format("2006-01-02 15:04")
-		s += fmt.Sprintf("[%s] %s: %s\n", tm, m.Username, m.Content)
+		// Chat history stays in the bot's local time
+		s += fmt.Sprintf("[%s] %s: %s\n", formatWorldTime(time.Unix(m.Time, 0)), m.Username, m.Content)
 	}
 	return s
 }
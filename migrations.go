@@ -0,0 +1,631 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ---- Schema Migrations ----
+// Every table in docs.db and memory.db is created by an ordered list of
+// up-migrations. Applied versions are recorded in schema_migrations, so a
+// column added later still reaches databases created before it existed.
+// Never edit a migration once it has shipped; append a new one instead.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+}
+
+const memoryDBPath = "data/memory.db"
+
+func execSQL(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// The early migrations use IF NOT EXISTS so that databases created before
+// migrations existed can be brought under version control as-is.
+var docsMigrations = []Migration{
+	{1, "create_forum_posts", execSQL(`
+		CREATE TABLE IF NOT EXISTS forum_posts (
+			post_id TEXT PRIMARY KEY,
+			user TEXT,
+			user_num INTEGER,
+			timestamp INTEGER,
+			message TEXT,
+			thread_path TEXT
+		);
+	`)},
+	{2, "create_summarization_tables", execSQL(`
+		CREATE TABLE IF NOT EXISTS summarization_contexts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			prompt TEXT,
+			chunk_text TEXT
+		);
+		CREATE TABLE IF NOT EXISTS summarized_thread_contexts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			prompt TEXT,
+			thread_path TEXT,
+			ids TEXT
+		);
+	`)},
+	{3, "create_timeline_tables", execSQL(`
+		CREATE TABLE IF NOT EXISTS conversation_summaries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT,
+			thread_path TEXT,
+			start INTEGER,
+			end INTEGER,
+			summary TEXT
+		);
+		CREATE TABLE IF NOT EXISTS conversation_timeline_contexts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			prompt TEXT,
+			username TEXT,
+			thread_path TEXT,
+			start INTEGER,
+			end INTEGER,
+			chunk_ids TEXT
+		);
+	`)},
+	{4, "create_batch_jobs", execSQL(`
+		CREATE TABLE IF NOT EXISTS batch_jobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			batch_id TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			completed BOOLEAN DEFAULT 0
+		);
+	`)},
+	{5, "create_ingest_manifest", execSQL(`
+		CREATE TABLE IF NOT EXISTS ingest_manifest (
+			file_path TEXT PRIMARY KEY,
+			thread_path TEXT,
+			hash TEXT,
+			mtime INTEGER,
+			post_count INTEGER,
+			scraped_at INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS forum_post_tombstones (
+			post_id TEXT PRIMARY KEY,
+			user TEXT,
+			user_num INTEGER,
+			timestamp INTEGER,
+			message TEXT,
+			thread_path TEXT,
+			removed_at INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS ingest_runs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			started_at INTEGER,
+			finished_at INTEGER,
+			added INTEGER DEFAULT 0,
+			updated INTEGER DEFAULT 0,
+			removed INTEGER DEFAULT 0
+		);
+		CREATE TABLE IF NOT EXISTS ingest_changes (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			run_id INTEGER,
+			post_id TEXT,
+			thread_path TEXT,
+			change TEXT -- added, updated or removed
+		);
+		CREATE INDEX IF NOT EXISTS idx_ingest_changes_run ON ingest_changes(run_id);
+	`)},
+	{6, "create_boards_and_threads", execSQL(`
+		CREATE TABLE IF NOT EXISTS boards (
+			board_path TEXT PRIMARY KEY,
+			slug TEXT,
+			title TEXT,
+			parent_path TEXT,
+			depth INTEGER,
+			url TEXT,
+			board_num INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS threads (
+			thread_path TEXT PRIMARY KEY,
+			board_path TEXT,
+			slug TEXT,
+			title TEXT,
+			url TEXT,
+			thread_num INTEGER,
+			first_post_at INTEGER,
+			last_post_at INTEGER,
+			participants TEXT, -- JSON array of usernames
+			post_count INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS idx_boards_parent ON boards(parent_path);
+		CREATE INDEX IF NOT EXISTS idx_threads_board ON threads(board_path);
+	`)},
+	{7, "create_forum_users", execSQL(`
+		CREATE TABLE IF NOT EXISTS forum_users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_num INTEGER,
+			name TEXT,
+			aliases TEXT, -- JSON array of every name seen
+			first_post_at INTEGER,
+			last_post_at INTEGER,
+			post_count INTEGER,
+			boards TEXT, -- JSON array of board paths
+			character_path TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_forum_users_num ON forum_users(user_num);
+		CREATE INDEX IF NOT EXISTS idx_forum_users_name ON forum_users(name);
+	`)},
+	{8, "add_clean_message_and_post_quotes", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "forum_posts", "clean_message", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS post_quotes (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				post_id TEXT,
+				quoted_post_id TEXT,
+				quoted_user TEXT,
+				quoted_at INTEGER
+			);
+			CREATE INDEX IF NOT EXISTS idx_post_quotes_post ON post_quotes(post_id);
+			CREATE INDEX IF NOT EXISTS idx_post_quotes_quoted ON post_quotes(quoted_post_id);
+		`)
+		return err
+	}},
+	{9, "create_quarantine", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE IF NOT EXISTS quarantine (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				run_id INTEGER,
+				file_path TEXT,
+				thread_path TEXT,
+				post_id TEXT,
+				reason TEXT,
+				detail TEXT,
+				quarantined_at INTEGER
+			);
+			CREATE INDEX IF NOT EXISTS idx_quarantine_file ON quarantine(file_path);
+		`)
+		if err != nil {
+			return err
+		}
+		// Make the next scrape re-read every file so existing data gets validated
+		_, err = tx.Exec(`UPDATE ingest_manifest SET hash = '', mtime = 0`)
+		return err
+	}},
+	// Every ingest diffs a thread against its stored posts
+	{10, "index_forum_posts_thread_path", execSQL(`
+		CREATE INDEX IF NOT EXISTS idx_forum_posts_thread ON forum_posts(thread_path);
+	`)},
+	// Timestamps used to be stored in whatever unit the source had; the forum
+	// export's milliseconds become seconds like everything else. The range
+	// check leaves seconds alone, and the max int64 "open ended" marker too.
+	{11, "normalize_timestamps_to_seconds", execSQL(`
+		UPDATE forum_posts SET timestamp = timestamp / 1000 WHERE timestamp BETWEEN 100000000000 AND 100000000000000;
+		UPDATE forum_post_tombstones SET timestamp = timestamp / 1000 WHERE timestamp BETWEEN 100000000000 AND 100000000000000;
+		UPDATE threads SET first_post_at = first_post_at / 1000 WHERE first_post_at BETWEEN 100000000000 AND 100000000000000;
+		UPDATE threads SET last_post_at = last_post_at / 1000 WHERE last_post_at BETWEEN 100000000000 AND 100000000000000;
+		UPDATE forum_users SET first_post_at = first_post_at / 1000 WHERE first_post_at BETWEEN 100000000000 AND 100000000000000;
+		UPDATE forum_users SET last_post_at = last_post_at / 1000 WHERE last_post_at BETWEEN 100000000000 AND 100000000000000;
+		UPDATE conversation_summaries SET start = start / 1000 WHERE start BETWEEN 100000000000 AND 100000000000000;
+		UPDATE conversation_summaries SET end = end / 1000 WHERE end BETWEEN 100000000000 AND 100000000000000;
+		UPDATE conversation_timeline_contexts SET start = start / 1000 WHERE start BETWEEN 100000000000 AND 100000000000000;
+		UPDATE conversation_timeline_contexts SET end = end / 1000 WHERE end BETWEEN 100000000000 AND 100000000000000;
+	`)},
+	// Keyword search index, kept in sync by triggers. The FTS rowid is the
+	// forum_posts rowid; INSERT OR REPLACE gives a post a new rowid without
+	// firing delete triggers, hence the BEFORE INSERT cleanup.
+	{12, "create_forum_posts_fts", execSQL(`
+		CREATE VIRTUAL TABLE IF NOT EXISTS forum_posts_fts USING fts5(body, tokenize = 'porter unicode61');
+		CREATE TRIGGER IF NOT EXISTS forum_posts_fts_replace BEFORE INSERT ON forum_posts BEGIN
+			DELETE FROM forum_posts_fts WHERE rowid IN (SELECT rowid FROM forum_posts WHERE post_id = new.post_id);
+		END;
+		CREATE TRIGGER IF NOT EXISTS forum_posts_fts_insert AFTER INSERT ON forum_posts BEGIN
+			INSERT INTO forum_posts_fts (rowid, body) VALUES (new.rowid, COALESCE(new.clean_message, new.message));
+		END;
+		CREATE TRIGGER IF NOT EXISTS forum_posts_fts_delete AFTER DELETE ON forum_posts BEGIN
+			DELETE FROM forum_posts_fts WHERE rowid = old.rowid;
+		END;
+		CREATE TRIGGER IF NOT EXISTS forum_posts_fts_update AFTER UPDATE OF message, clean_message ON forum_posts BEGIN
+			DELETE FROM forum_posts_fts WHERE rowid = old.rowid;
+			INSERT INTO forum_posts_fts (rowid, body) VALUES (new.rowid, COALESCE(new.clean_message, new.message));
+		END;
+		DELETE FROM forum_posts_fts;
+		INSERT INTO forum_posts_fts (rowid, body) SELECT rowid, COALESCE(clean_message, message) FROM forum_posts;
+	`)},
+	{13, "create_chunk_summaries", execSQL(`
+		CREATE TABLE IF NOT EXISTS chunk_summaries (
+			hash TEXT PRIMARY KEY, -- sha256 of post IDs and chunk text, or of the child hashes
+			level INTEGER,         -- 0 for post chunks, n for reductions of level n-1
+			thread_path TEXT,
+			post_ids TEXT,         -- JSON array, level 0 only
+			children TEXT,         -- JSON array of child hashes, level > 0 only
+			summary TEXT,
+			created_at INTEGER
+		);
+	`)},
+	{14, "create_thread_summaries", execSQL(`
+		CREATE TABLE IF NOT EXISTS thread_summaries (
+			thread_path TEXT PRIMARY KEY, -- a thread, or the prefix that was summarized
+			summary TEXT,
+			last_post_at INTEGER, -- newest post covered
+			post_count INTEGER,
+			summarized_at INTEGER,
+			ingest_run INTEGER -- newest ingest run at the time; later changes make it stale
+		);
+	`)},
+	{15, "create_board_summaries", execSQL(`
+		CREATE TABLE IF NOT EXISTS board_summaries (
+			board_path TEXT PRIMARY KEY,
+			kind TEXT,          -- world, region or board
+			summary TEXT,
+			thread_count INTEGER, -- summarized threads it covers
+			source_hash TEXT,   -- of the summaries it was rolled up from
+			summarized_at INTEGER
+		);
+	`)},
+	// Dry-run summarization contexts can be replayed through the Batch API;
+	// these track each context from pending through submitted to done.
+	{16, "track_summarization_batches", execSQL(`
+		ALTER TABLE summarization_contexts ADD COLUMN chunk_hash TEXT;
+		ALTER TABLE summarization_contexts ADD COLUMN thread_path TEXT;
+		ALTER TABLE summarization_contexts ADD COLUMN post_ids TEXT; -- JSON array
+		ALTER TABLE summarization_contexts ADD COLUMN status TEXT DEFAULT 'pending'; -- pending, submitted, done or failed
+		ALTER TABLE summarization_contexts ADD COLUMN batch_id TEXT;
+		ALTER TABLE summarization_contexts ADD COLUMN summary TEXT;
+		ALTER TABLE summarization_contexts ADD COLUMN error TEXT;
+		CREATE INDEX IF NOT EXISTS idx_summarization_contexts_status ON summarization_contexts(status);
+		CREATE INDEX IF NOT EXISTS idx_summarization_contexts_hash ON summarization_contexts(chunk_hash);
+		ALTER TABLE conversation_timeline_contexts ADD COLUMN summary_id INTEGER; -- conversation_summaries row once finalized
+		ALTER TABLE batch_jobs ADD COLUMN kind TEXT DEFAULT 'embeddings'; -- embeddings or summaries
+		ALTER TABLE batch_jobs ADD COLUMN status TEXT;
+	`)},
+	// Timeline runs resume by skipping windows that already have a summary, so
+	// duplicates from earlier runs go (keeping the newest) and the window
+	// becomes unique. Windows that failed are recorded until they succeed.
+	{17, "make_timeline_resumable", execSQL(`
+		ALTER TABLE conversation_summaries ADD COLUMN post_count INTEGER;
+		DELETE FROM conversation_summaries WHERE id NOT IN (
+			SELECT MAX(id) FROM conversation_summaries GROUP BY username, thread_path, start, end
+		);
+		UPDATE conversation_timeline_contexts SET summary_id = (
+			SELECT s.id FROM conversation_summaries s
+			WHERE s.username = conversation_timeline_contexts.username AND s.thread_path = conversation_timeline_contexts.thread_path
+				AND s.start = conversation_timeline_contexts.start AND s.end = conversation_timeline_contexts.end
+		) WHERE summary_id IS NOT NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_conversation_summaries_window ON conversation_summaries(username, thread_path, start, end);
+		CREATE TABLE IF NOT EXISTS timeline_failures (
+			username TEXT,
+			thread_path TEXT,
+			start INTEGER,
+			end INTEGER,
+			error TEXT,
+			attempts INTEGER,
+			failed_at INTEGER,
+			PRIMARY KEY (username, thread_path, start, end)
+		);
+	`)},
+	// Summaries pair each point with the posts it is based on, as a JSON
+	// array of {"text", "post_ids"}; NULL for summaries made before.
+	{18, "add_summary_citations", execSQL(`
+		ALTER TABLE chunk_summaries ADD COLUMN citations TEXT;
+		ALTER TABLE summarization_contexts ADD COLUMN citations TEXT;
+		ALTER TABLE thread_summaries ADD COLUMN citations TEXT;
+		ALTER TABLE conversation_summaries ADD COLUMN citations TEXT;
+	`)},
+	// Events extracted from thread chunks (see events.go). Participants are
+	// also kept one per row so events can be looked up by who took part, and
+	// every chunk that was run is recorded, even if it had no events.
+	{19, "create_events", execSQL(`
+		CREATE TABLE IF NOT EXISTS events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			thread_path TEXT,
+			chunk_hash TEXT,
+			participants TEXT, -- JSON array
+			location TEXT,
+			action TEXT,
+			outcome TEXT,
+			timestamp INTEGER,
+			post_ids TEXT -- JSON array
+		);
+		CREATE INDEX IF NOT EXISTS idx_events_thread ON events(thread_path);
+		CREATE INDEX IF NOT EXISTS idx_events_timestamp ON events(timestamp);
+		CREATE INDEX IF NOT EXISTS idx_events_chunk ON events(chunk_hash);
+		CREATE TABLE IF NOT EXISTS event_participants (
+			event_id INTEGER,
+			name TEXT,
+			PRIMARY KEY (event_id, name)
+		);
+		CREATE INDEX IF NOT EXISTS idx_event_participants_name ON event_participants(name COLLATE NOCASE);
+		CREATE TABLE IF NOT EXISTS event_extractions (
+			chunk_hash TEXT PRIMARY KEY,
+			thread_path TEXT,
+			event_count INTEGER,
+			extracted_at INTEGER
+		);
+	`)},
+	// The lore knowledge base (see lore.go). An entity's name is one of its
+	// aliases; notes are kept per entity and chunk, and the posts behind them
+	// give the first and last mention.
+	{20, "create_lore", execSQL(`
+		CREATE TABLE IF NOT EXISTS lore_entities (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT,
+			kind TEXT, -- place, faction, artifact, creature or npc
+			description TEXT,
+			synthesized_at INTEGER
+		);
+		CREATE TABLE IF NOT EXISTS lore_aliases (
+			alias TEXT COLLATE NOCASE,
+			entity_id INTEGER,
+			PRIMARY KEY (alias, entity_id)
+		);
+		CREATE TABLE IF NOT EXISTS lore_mentions (
+			entity_id INTEGER,
+			chunk_hash TEXT,
+			thread_path TEXT,
+			note TEXT,
+			added_at INTEGER,
+			PRIMARY KEY (entity_id, chunk_hash)
+		);
+		CREATE INDEX IF NOT EXISTS idx_lore_mentions_chunk ON lore_mentions(chunk_hash);
+		CREATE TABLE IF NOT EXISTS lore_posts (
+			entity_id INTEGER,
+			post_id TEXT,
+			chunk_hash TEXT,
+			thread_path TEXT,
+			timestamp INTEGER,
+			PRIMARY KEY (entity_id, post_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_lore_posts_chunk ON lore_posts(chunk_hash);
+		CREATE TABLE IF NOT EXISTS lore_extractions (
+			chunk_hash TEXT PRIMARY KEY,
+			thread_path TEXT,
+			entity_count INTEGER,
+			extracted_at INTEGER
+		);
+	`)},
+	// Relationships observed per conversation window (see relationships.go),
+	// and the windows that were extracted.
+	{21, "create_relationships", execSQL(`
+		CREATE TABLE IF NOT EXISTS relationship_observations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT,
+			other TEXT,
+			type TEXT,
+			sentiment INTEGER, -- -2 hostile to 2 close
+			note TEXT,
+			thread_path TEXT,
+			start INTEGER,
+			end INTEGER,
+			observed_at INTEGER,
+			post_ids TEXT -- JSON array
+		);
+		CREATE INDEX IF NOT EXISTS idx_relationship_observations_pair ON relationship_observations(username, other COLLATE NOCASE, observed_at);
+		CREATE INDEX IF NOT EXISTS idx_relationship_observations_window ON relationship_observations(username, thread_path, start);
+		CREATE TABLE IF NOT EXISTS relationship_windows (
+			username TEXT,
+			thread_path TEXT,
+			start INTEGER,
+			end INTEGER,
+			post_count INTEGER,
+			extracted_at INTEGER,
+			PRIMARY KEY (username, thread_path, start, end)
+		);
+	`)},
+	// Sources that know a thread's real title keep it in the manifest; saved
+	// pages are re-read so threads imported before this get theirs
+	{22, "add_manifest_titles", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "ingest_manifest", "title", "TEXT"); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`UPDATE ingest_manifest SET hash = '', mtime = 0 WHERE file_path LIKE '%.html' OR file_path LIKE '%.htm'`)
+		return err
+	}},
+}
+
+var memoryMigrations = []Migration{
+	{1, "create_contexts_and_summaries", execSQL(`
+		CREATE TABLE IF NOT EXISTS contexts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel_id TEXT,
+			author_id TEXT,
+			username TEXT,
+			content TEXT,
+			time INTEGER,
+			type TEXT DEFAULT 'message'
+		);
+		CREATE TABLE IF NOT EXISTS summaries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel_id TEXT,
+			summary_text TEXT,
+			context_ids TEXT,  -- JSON array of int64
+			time INTEGER
+		);
+	`)},
+}
+
+// addColumn adds a column unless it is already there. Only needed for
+// columns that older builds may have added outside of a migration.
+func addColumn(tx *sql.Tx, table, column, decl string) error {
+	rows, err := tx.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			found = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || found {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, decl))
+	return err
+}
+
+func ensureMigrationsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT,
+			applied_at INTEGER
+		)
+	`)
+	return err
+}
+
+// AppliedMigrations returns applied_at (unix seconds) by version.
+func AppliedMigrations(db *sql.DB) (map[int]int64, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := make(map[int]int64)
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+func PendingMigrations(db *sql.DB, migrations []Migration) ([]Migration, error) {
+	applied, err := AppliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies pending migrations in order, each in its own transaction.
+func Migrate(db *sql.DB, migrations []Migration) ([]Migration, error) {
+	pending, err := PendingMigrations(db, migrations)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range pending {
+		tx, err := db.Begin()
+		if err != nil {
+			return done, err
+		}
+		if err := m.Up(tx); err != nil {
+			tx.Rollback()
+			return done, fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)`,
+			m.Version, m.Name, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return done, err
+		}
+		if err := tx.Commit(); err != nil {
+			return done, err
+		}
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// isEmptyDB reports whether a database has no tables besides schema_migrations.
+func isEmptyDB(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')`).Scan(&n)
+	return n == 0, err
+}
+
+// CheckSchema refuses to continue against a database with pending
+// migrations. A brand new (empty) database is migrated on the spot.
+func CheckSchema(path string, migrations []Migration) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	pending, err := PendingMigrations(db, migrations)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	empty, err := isEmptyDB(db)
+	if err != nil {
+		return err
+	}
+	if empty {
+		_, err := Migrate(db, migrations)
+		return err
+	}
+	return fmt.Errorf("%s schema is out of date (%d pending migrations starting at %d %s); run -mode migrate",
+		path, len(pending), pending[0].Version, pending[0].Name)
+}
+
+// ---- CLI ----
+// MigrateMode prints migration status for both databases and applies
+// anything pending unless dryRun is set.
+func MigrateMode(dryRun bool) {
+	for _, target := range []struct {
+		path       string
+		migrations []Migration
+	}{
+		{dbPath, docsMigrations},
+		{memoryDBPath, memoryMigrations},
+	} {
+		db, err := sql.Open("sqlite", target.path)
+		if err != nil {
+			log.Fatalf("failed to open %s: %v", target.path, err)
+		}
+		applied, err := AppliedMigrations(db)
+		if err != nil {
+			log.Fatalf("failed to read schema_migrations in %s: %v", target.path, err)
+		}
+		fmt.Printf("%s:\n", target.path)
+		pending := 0
+		for _, m := range target.migrations {
+			if at, ok := applied[m.Version]; ok {
+				fmt.Printf("  [x] %03d %-40s applied %s\n", m.Version, m.Name, time.Unix(at, 0).Format("2006-01-02 15:04"))
+			} else {
+				fmt.Printf("  [ ] %03d %s\n", m.Version, m.Name)
+				pending++
+			}
+		}
+		if pending == 0 {
+			fmt.Println("  up to date")
+		} else if dryRun {
+			fmt.Printf("  %d pending (dry run, nothing applied)\n", pending)
+		} else {
+			done, err := Migrate(db, target.migrations)
+			for _, m := range done {
+				fmt.Printf("  applied %03d %s\n", m.Version, m.Name)
+			}
+			if err != nil {
+				db.Close()
+				log.Fatalf("migration failed in %s: %v", target.path, err)
+			}
+		}
+		db.Close()
+	}
+}
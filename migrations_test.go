@@ -0,0 +1,39 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateLegacyDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docs.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// A database from before migrations, which already has clean_message
+	if _, err := db.Exec(`CREATE TABLE forum_posts (post_id TEXT PRIMARY KEY, user TEXT, user_num INTEGER,
+		timestamp INTEGER, message TEXT, thread_path TEXT, clean_message TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSchema(path, docsMigrations); err == nil {
+		t.Fatal("expected CheckSchema to refuse an unversioned database")
+	}
+
+	done, err := Migrate(db, docsMigrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(docsMigrations) {
+		t.Errorf("applied %d migrations, want %d", len(done), len(docsMigrations))
+	}
+	if err := CheckSchema(path, docsMigrations); err != nil {
+		t.Errorf("CheckSchema after migrate: %v", err)
+	}
+	if done, err := Migrate(db, docsMigrations); err != nil || len(done) != 0 {
+		t.Errorf("second Migrate applied %d migrations, err %v", len(done), err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ---- Forum Markup Normalization ----
+// The scraped messages are flattened HTML: paragraph breaks are gone, quotes
+// are inlined as "Apr 3, 2016 16:20:09 GMT -8 @birdman said:<quoted text>",
+// and a few bits of forum chrome are left behind. Normalization produces the
+// clean_message column; message keeps the original text.
+
+type TextMode string
+
+const (
+	TextRaw   TextMode = "raw"
+	TextClean TextMode = "clean"
+)
+
+// PostTextMode picks which text consumers (summaries, character sheets,
+// embeddings) read from a post. Set from the -text flag.
+var PostTextMode = TextClean
+
+// Text returns the post body according to PostTextMode. Post queries select
+// COALESCE(clean_message, message), so posts that were never normalized fall
+// back to the raw text.
+func (p ForumPost) Text() string {
+	if PostTextMode == TextClean {
+		return p.CleanMessage
+	}
+	return p.Message
+}
+
+type PostQuote struct {
+	PostID       string
+	QuotedPostID string // "" if the quoted post could not be found
+	QuotedUser   string
+	QuotedAt     int64 // unix seconds, from the quote header
+}
+
+var (
+	quoteHeaderRe  = regexp.MustCompile(`([A-Z][a-z]{2,3} \d{1,2}, \d{4} \d{1,2}:\d{2}:\d{2}) GMT ([-+]\d+)\s+(.+?) said:`)
+	bbcodeRe       = regexp.MustCompile(`(?i)\[/?(quote|b|i|u|s|url|img|color|size|font|center|left|right|spoiler|smear|hr)([:=][^\]]*)?\]`)
+	separatorRe    = regexp.MustCompile(`[=_\-*~]{8,}`)
+	spoilerRe      = regexp.MustCompile(`SPOILER: Click to (show|hide)`)
+	movedNoticeRe  = regexp.MustCompile(`This message has been moved to .{1,120}? by [^.]{1,60}\.`)
+	gluedSentRe    = regexp.MustCompile(`([a-z0-9][.!?]["”’)]?)([A-Z])`)
+	whitespaceRe   = regexp.MustCompile(`[ \t\x{00a0}]+`)
+	blankLinesRe   = regexp.MustCompile(`\s*\n\s*`)
+	quoteTailChars = 40
+)
+
+// NormalizeMessage cleans up markup in a single message. Quotes are left in
+// place; they need the rest of the thread to resolve (see NormalizeThread).
+func NormalizeMessage(msg string) string {
+	s := html.UnescapeString(msg)
+	s = bbcodeRe.ReplaceAllString(s, "")
+	s = spoilerRe.ReplaceAllString(s, "")
+	s = movedNoticeRe.ReplaceAllString(s, "")
+	s = separatorRe.ReplaceAllString(s, "\n")
+	s = gluedSentRe.ReplaceAllString(s, "$1 $2")
+	s = whitespaceRe.ReplaceAllString(s, " ")
+	s = blankLinesRe.ReplaceAllString(s, "\n")
+	return strings.TrimSpace(s)
+}
+
+// Index of posts by the second they were made, for resolving quote headers
+type QuoteIndex map[int64][]ForumPost
+
+func NewQuoteIndex(posts []ForumPost) QuoteIndex {
+	idx := make(QuoteIndex)
+	for _, p := range posts {
+		sec := unixSeconds(p.Timestamp)
+		idx[sec] = append(idx[sec], p)
+	}
+	return idx
+}
+
+// unixSeconds normalizes a source timestamp to Unix seconds. The forum
+// export uses milliseconds, other sources seconds or finer; any value past
+// the year 5138 in seconds can only be a finer unit.
+func unixSeconds(ts int64) int64 {
+	for ts > 1e11 || ts < -1e11 {
+		ts /= 1000
+	}
+	return ts
+}
+
+// find returns the post by user at the quoted time. Boards renders quote
+// times in a fixed GMT -8, so an hour either way allows for DST drift. A
+// post by anyone else is never taken for the quoted one; failing a match,
+// the only post at a time whose account was deleted (no author) is.
+func (idx QuoteIndex) find(at int64, user string) (ForumPost, bool) {
+	deltas := []int64{0, -3600, 3600}
+	for _, delta := range deltas {
+		for _, c := range idx[at+delta] {
+			if quotedAuthor(c.User, user) {
+				return c, true
+			}
+		}
+	}
+	for _, delta := range deltas {
+		if candidates := idx[at+delta]; len(candidates) == 1 && strings.TrimSpace(candidates[0].User) == "" {
+			return candidates[0], true
+		}
+	}
+	return ForumPost{}, false
+}
+
+// quotedAuthor reports whether a quote header's user is author. Headers
+// give either the display name or the "@handle" of the account, and a
+// handle is the display name, or one word of it, in lower case without
+// spaces (@naoki for Empress Naoki).
+func quotedAuthor(author, user string) bool {
+	handle, isHandle := strings.CutPrefix(user, "@")
+	if strings.EqualFold(strings.Join(strings.Fields(author), " "), strings.Join(strings.Fields(handle), " ")) {
+		return true
+	}
+	if !isHandle {
+		return false
+	}
+	squash := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsNumber(r) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, s)
+	}
+	handle = squash(handle)
+	if handle == "" {
+		return false
+	}
+	if squash(author) == handle {
+		return true
+	}
+	for _, word := range strings.Fields(author) {
+		if squash(word) == handle {
+			return true
+		}
+	}
+	return false
+}
+
+func parseQuoteTime(stamp, offset string) (int64, error) {
+	var hours int
+	if _, err := fmt.Sscanf(offset, "%d", &hours); err != nil {
+		return 0, err
+	}
+	loc := time.FixedZone("GMT"+offset, hours*3600)
+	stamp = strings.Replace(stamp, "Sept ", "Sep ", 1)
+	t, err := time.ParseInLocation("Jan 2, 2006 15:04:05", stamp, loc)
+	if err != nil {
+		return 0, err
+	}
+	return t.Unix(), nil
+}
+
+// stripQuotes removes inlined quotes from an already normalized message.
+// quotedText returns the normalized (quotes still included) text of a post,
+// which is what the forum inlined when it was quoted.
+func stripQuotes(postID, text string, thread, global QuoteIndex, quotedText func(ForumPost) string) (string, []PostQuote) {
+	var quotes []PostQuote
+	var out strings.Builder
+	rest := text
+	for {
+		loc := quoteHeaderRe.FindStringSubmatchIndex(rest)
+		if loc == nil {
+			out.WriteString(rest)
+			break
+		}
+		out.WriteString(rest[:loc[0]])
+		stamp, offset, user := rest[loc[2]:loc[3]], rest[loc[4]:loc[5]], rest[loc[6]:loc[7]]
+		body := strings.TrimLeft(rest[loc[1]:], " ")
+		rest = body
+
+		q := PostQuote{PostID: postID, QuotedUser: strings.TrimPrefix(user, "@")}
+		at, err := parseQuoteTime(stamp, offset)
+		if err == nil {
+			q.QuotedAt = at
+			quoted, ok := thread.find(at, user)
+			if !ok && global != nil {
+				quoted, ok = global.find(at, user)
+			}
+			if ok && quoted.PostID != postID {
+				q.QuotedPostID = quoted.PostID
+				q.QuotedUser = quoted.User
+				if end := quoteEnd(body, quotedText(quoted)); end > 0 {
+					rest = body[end:]
+				}
+			}
+		}
+		quotes = append(quotes, q)
+		out.WriteString("\n")
+	}
+	return NormalizeMessage(out.String()), quotes
+}
+
+// quoteEnd finds where the inlined copy of quoted ends inside body. The quote
+// is usually an exact prefix; if the quoted post was edited afterwards we
+// fall back to anchoring on the end of its text.
+func quoteEnd(body, quoted string) int {
+	if quoted == "" {
+		return 0
+	}
+	if strings.HasPrefix(body, quoted) {
+		return len(quoted)
+	}
+	tail := quoted
+	if len(tail) > quoteTailChars {
+		tail = tail[len(tail)-quoteTailChars:]
+	}
+	// Only look as far as a quote of roughly that size could reach
+	limit := len(quoted)*3/2 + quoteTailChars
+	if limit > len(body) {
+		limit = len(body)
+	}
+	if i := strings.LastIndex(body[:limit], tail); i >= 0 {
+		return i + len(tail)
+	}
+	return 0
+}
+
+// NormalizeThread fills in CleanMessage for every post in a thread and
+// returns the quote relations it found. global may be nil; when set it is
+// used for quotes of posts in other threads.
+func NormalizeThread(posts []ForumPost, global QuoteIndex) ([]ForumPost, []PostQuote) {
+	normalized := make(map[string]string, len(posts))
+	for _, p := range posts {
+		normalized[p.PostID] = NormalizeMessage(p.Message)
+	}
+	quotedText := func(p ForumPost) string {
+		if s, ok := normalized[p.PostID]; ok {
+			return s
+		}
+		return NormalizeMessage(p.Message)
+	}
+	thread := NewQuoteIndex(posts)
+
+	var quotes []PostQuote
+	out := make([]ForumPost, len(posts))
+	for i, p := range posts {
+		clean, qs := stripQuotes(p.PostID, normalized[p.PostID], thread, global, quotedText)
+		p.CleanMessage = clean
+		out[i] = p
+		quotes = append(quotes, qs...)
+	}
+	return out, quotes
+}
+
+// ---- Storage ----
+// Replace the stored quotes for the given posts
+func savePostQuotes(tx *sql.Tx, postIDs []string, quotes []PostQuote) error {
+	for _, id := range postIDs {
+		if _, err := tx.Exec(`DELETE FROM post_quotes WHERE post_id = ?`, id); err != nil {
+			return err
+		}
+	}
+	for _, q := range quotes {
+		_, err := tx.Exec(`INSERT INTO post_quotes (post_id, quoted_post_id, quoted_user, quoted_at) VALUES (?, ?, ?, ?)`,
+			q.PostID, q.QuotedPostID, q.QuotedUser, q.QuotedAt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func GetPostQuotes(db *sql.DB, postID string) ([]PostQuote, error) {
+	rows, err := db.Query(`SELECT post_id, quoted_post_id, quoted_user, quoted_at FROM post_quotes WHERE post_id = ? ORDER BY id`, postID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var quotes []PostQuote
+	for rows.Next() {
+		var q PostQuote
+		if err := rows.Scan(&q.PostID, &q.QuotedPostID, &q.QuotedUser, &q.QuotedAt); err != nil {
+			return nil, err
+		}
+		quotes = append(quotes, q)
+	}
+	return quotes, rows.Err()
+}
+
+// NormalizeAll re-runs normalization over every stored post. Use it to
+// backfill clean_message on an existing database or after changing the rules.
+func NormalizeAll() {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	posts, err := GetAllForumPosts(db)
+	if err != nil {
+		log.Fatalf("failed to get posts: %v", err)
+	}
+	global := NewQuoteIndex(posts)
+	byThread := make(map[string][]ForumPost)
+	for _, p := range posts {
+		byThread[p.ThreadPath] = append(byThread[p.ThreadPath], p)
+	}
+	threadPaths := make([]string, 0, len(byThread))
+	for tp := range byThread {
+		threadPaths = append(threadPaths, tp)
+	}
+	sort.Strings(threadPaths)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("failed to begin transaction: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM post_quotes`); err != nil {
+		tx.Rollback()
+		log.Fatalf("failed to clear post_quotes: %v", err)
+	}
+	var totalQuotes, resolved int
+	for _, tp := range threadPaths {
+		normalized, quotes := NormalizeThread(byThread[tp], global)
+		for _, p := range normalized {
+			if _, err := tx.Exec(`UPDATE forum_posts SET clean_message = ? WHERE post_id = ?`, p.CleanMessage, p.PostID); err != nil {
+				tx.Rollback()
+				log.Fatalf("failed to update post %s: %v", p.PostID, err)
+			}
+		}
+		if err := savePostQuotes(tx, nil, quotes); err != nil {
+			tx.Rollback()
+			log.Fatalf("failed to save quotes for %s: %v", tp, err)
+		}
+		for _, q := range quotes {
+			totalQuotes++
+			if q.QuotedPostID != "" {
+				resolved++
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("commit failed: %v", err)
+	}
+	fmt.Printf("Normalized %d posts in %d threads; %d quotes found, %d resolved to a post.\n",
+		len(posts), len(threadPaths), totalQuotes, resolved)
+}
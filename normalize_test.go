@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalizeMessage(t *testing.T) {
+	cases := map[string]string{
+		"flee.There is magic":                                     "flee. There is magic",
+		"heels &nbsp;were reinforced":                             "heels were reinforced",
+		"[smear:FF0000]Rumor Has It[/smear:00FF00]":               "Rumor Has It",
+		"Prices==========Clothing":                                "Prices\nClothing",
+		"Hi.This message has been moved to Governments by Bucky.": "Hi.",
+	}
+	for in, want := range cases {
+		if got := NormalizeMessage(in); got != want {
+			t.Errorf("NormalizeMessage(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNormalizeThreadQuotes(t *testing.T) {
+	// Apr 3, 2016 16:20:09 GMT -8
+	quotedAt := int64(1459729209)
+	posts := []ForumPost{
+		{PostID: "post-1", User: "Birdman", Timestamp: quotedAt * 1000, Message: "Adventure awaits.Come along."},
+		{PostID: "post-2", User: "Puck", Timestamp: (quotedAt + 60) * 1000,
+			Message: "Apr 3, 2016 16:20:09 GMT -8  @birdman said:Adventure awaits.Come along.I shall accompany you."},
+		{PostID: "post-3", User: "Tanis", Timestamp: (quotedAt + 120) * 1000,
+			Message: "Jan 1, 2015 1:00:00 GMT -8 Nobody said:Lost words. Count me in."},
+	}
+
+	normalized, quotes := NormalizeThread(posts, nil)
+	if got := normalized[1].CleanMessage; got != "I shall accompany you." {
+		t.Errorf("quoted reply clean text = %q", got)
+	}
+	if len(quotes) != 2 {
+		t.Fatalf("expected 2 quotes, got %d", len(quotes))
+	}
+	if quotes[0].PostID != "post-2" || quotes[0].QuotedPostID != "post-1" || quotes[0].QuotedUser != "Birdman" {
+		t.Errorf("unexpected resolved quote: %+v", quotes[0])
+	}
+	// Unresolvable quotes keep their text but lose the header
+	if quotes[1].QuotedPostID != "" || quotes[1].QuotedUser != "Nobody" {
+		t.Errorf("unexpected unresolved quote: %+v", quotes[1])
+	}
+	if got := normalized[2].CleanMessage; got != "Lost words. Count me in." {
+		t.Errorf("unresolved quote clean text = %q", got)
+	}
+}
+
+func TestQuoteIndexFind(t *testing.T) {
+	at := int64(1459729209)
+	idx := NewQuoteIndex([]ForumPost{
+		{PostID: "post-1", User: "Wandering Bard", Timestamp: at},
+		{PostID: "post-2", User: "Empress Naoki", Timestamp: at + 3600},
+		{PostID: "post-3", User: "", Timestamp: at + 7200},
+	})
+	cases := []struct {
+		user string
+		want string // "" when nothing matches
+	}{
+		{"@naoki", "post-2"},         // an hour off, but the only post by its author
+		{"Empress  Naoki", "post-2"}, // display name
+		{"@wander", ""},              // handles are a whole word, not part of one
+		{"Puck", ""},                 // the single post at the time is someone else's
+		{"@wanderingbard", "post-1"},
+	}
+	for _, c := range cases {
+		got, ok := idx.find(at, c.user)
+		if c.want == "" && ok {
+			t.Errorf("find(%q) = %s, want no match", c.user, got.PostID)
+		} else if c.want != "" && got.PostID != c.want {
+			t.Errorf("find(%q) = %s, want %s", c.user, got.PostID, c.want)
+		}
+	}
+	// A post by a deleted account is taken when it is the only one
+	if got, ok := idx.find(at+7200, "@someone"); !ok || got.PostID != "post-3" {
+		t.Errorf("find for a deleted account = %+v, %v", got, ok)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// ---- ProBoards HTML Import ----
+// Parses thread pages saved straight from boards.net, so the archive can be
+// refreshed without the external posts JSON conversion. A thread imported
+// this way replaces whatever the posts scrape stored for the same thread
+// path, so use one source per thread.
+type ProBoardsPage struct {
+	URL       string // canonical thread URL without the page query
+	ThreadNum int
+	Slug      string
+	Title     string // the thread's title, without the forum name
+	Page      int
+	Posts     []ForumPost // ThreadPath is left empty
+}
+
+func hasClass(n *html.Node, class string) bool {
+	for _, a := range n.Attr {
+		if a.Key == "class" {
+			for _, c := range strings.Fields(a.Val) {
+				if c == class {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func attr(n *html.Node, key string) string {
+	return attrValue(n.Attr, key)
+}
+
+func attrValue(attrs []html.Attribute, key string) string {
+	for _, a := range attrs {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// findNode returns the first node below n (depth first) that matches
+func findNode(n *html.Node, match func(*html.Node) bool) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && match(c) {
+			return c
+		}
+		if found := findNode(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func findAllNodes(n *html.Node, match func(*html.Node) bool, out []*html.Node) []*html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && match(c) {
+			out = append(out, c)
+			continue
+		}
+		out = findAllNodes(c, match, out)
+	}
+	return out
+}
+
+// textContent flattens a node the way the posts JSON conversion did: text
+// nodes are concatenated without separators, scripts and styles dropped.
+func textContent(n *html.Node) string {
+	var b strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			return
+		}
+		if n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style") {
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+var errNoThreadURL = errors.New("no canonical thread URL found; is this a ProBoards thread page?")
+
+// threadURLAndPage splits a canonical link into the thread URL without the
+// page query and the page number, 0 if the link has none.
+func threadURLAndPage(raw string) (string, int) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", 0
+	}
+	page, _ := strconv.Atoi(u.Query().Get("page"))
+	u.RawQuery, u.Fragment = "", ""
+	return u.String(), page
+}
+
+// ParseProBoardsPage extracts the posts of one saved thread page.
+func ParseProBoardsPage(r io.Reader) (*ProBoardsPage, error) {
+	doc, err := html.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	page := &ProBoardsPage{Page: 1}
+
+	canonical := findNode(doc, func(n *html.Node) bool {
+		return n.Data == "link" && attr(n, "rel") == "canonical"
+	})
+	if canonical == nil {
+		canonical = findNode(doc, func(n *html.Node) bool {
+			return n.Data == "meta" && attr(n, "property") == "og:url"
+		})
+	}
+	if canonical != nil {
+		raw := attr(canonical, "href")
+		if raw == "" {
+			raw = attr(canonical, "content")
+		}
+		var n int
+		if page.URL, n = threadURLAndPage(raw); n > 0 {
+			page.Page = n
+		}
+		page.ThreadNum, page.Slug = urlNumAndSlug(page.URL)
+	}
+	if page.ThreadNum == 0 {
+		return nil, errNoThreadURL
+	}
+	// boards.net titles pages "Thread title | Forum name"
+	if title := findNode(doc, func(n *html.Node) bool { return n.Data == "title" }); title != nil {
+		page.Title = strings.TrimSpace(textContent(title))
+		if i := strings.LastIndex(page.Title, " | "); i > 0 {
+			page.Title = strings.TrimSpace(page.Title[:i])
+		}
+	}
+	// Pages saved without ?page= in the canonical link still mark the
+	// current page in the pagination bar
+	if sel := findNode(doc, func(n *html.Node) bool {
+		return hasClass(n, "ui-pagination-page") && hasClass(n, "state-selected")
+	}); sel != nil {
+		if p, err := strconv.Atoi(strings.TrimSpace(textContent(sel))); err == nil {
+			page.Page = p
+		}
+	}
+
+	rows := findAllNodes(doc, func(n *html.Node) bool {
+		return hasClass(n, "post") && strings.HasPrefix(attr(n, "id"), "post-")
+	}, nil)
+	for _, row := range rows {
+		post := ForumPost{PostID: attr(row, "id")}
+		if link := findNode(row, func(n *html.Node) bool { return hasClass(n, "user-link") }); link != nil {
+			post.User = strings.TrimSpace(textContent(link))
+			post.UserNum, _ = urlNumAndSlug(attr(link, "href"))
+		} else if guest := findNode(row, func(n *html.Node) bool { return hasClass(n, "user-guest") }); guest != nil {
+			post.User = strings.TrimSpace(textContent(guest))
+		}
+		if ts := findNode(row, func(n *html.Node) bool { return attr(n, "data-timestamp") != "" && hasClass(n, "time") }); ts != nil {
+			ms, _ := strconv.ParseInt(attr(ts, "data-timestamp"), 10, 64)
+			post.Timestamp = unixSeconds(ms)
+		}
+		msg := findNode(row, func(n *html.Node) bool { return hasClass(n, "message") })
+		if msg == nil {
+			fmt.Printf("Skipping %s: no message body\n", post.PostID)
+			continue
+		}
+		post.Message = strings.TrimSpace(textContent(msg))
+		page.Posts = append(page.Posts, post)
+	}
+	return page, nil
+}
+
+func ParseProBoardsFile(path string) (*ProBoardsPage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	page, err := ParseProBoardsPage(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return page, nil
+}
+
+// A thread's saved pages, grouped before any of them is parsed
+type proBoardsThread struct {
+	ThreadNum int
+	Slug      string
+	URL       string
+	Files     []string // page 1 first when saved as name.html, name-page-2.html, ...
+}
+
+// proBoardsPageURL reads a saved page only as far as the end of its head to
+// find the canonical thread URL, so pages can be grouped without parsing
+// them.
+func proBoardsPageURL(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var canonical, ogURL string
+	z := html.NewTokenizer(f)
+	for canonical == "" {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return "", fmt.Errorf("%s: %w", path, z.Err())
+			}
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		tok := z.Token()
+		if tok.Data == "body" {
+			break
+		}
+		switch {
+		case tok.Data == "link" && attrValue(tok.Attr, "rel") == "canonical":
+			canonical = attrValue(tok.Attr, "href")
+		case tok.Data == "meta" && attrValue(tok.Attr, "property") == "og:url":
+			ogURL = attrValue(tok.Attr, "content")
+		}
+	}
+	if canonical == "" {
+		canonical = ogURL
+	}
+	u, _ := threadURLAndPage(canonical)
+	if num, _ := urlNumAndSlug(u); num == 0 {
+		return "", fmt.Errorf("%s: %w", path, errNoThreadURL)
+	}
+	return u, nil
+}
+
+// GroupProBoardsPages groups every .html page under dir by thread. Only the
+// canonical link is read here; the pages are parsed by the ingest workers.
+func GroupProBoardsPages(dir string) ([]*proBoardsThread, error) {
+	var files []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && (strings.HasSuffix(p, ".html") || strings.HasSuffix(p, ".htm")) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Without the extension "name" sorts before "name-page-2", so the first
+	// page's file stays the manifest key
+	base := func(f string) string { return strings.TrimSuffix(f, filepath.Ext(f)) }
+	sort.Slice(files, func(i, j int) bool { return base(files[i]) < base(files[j]) })
+
+	byNum := make(map[int]*proBoardsThread)
+	for _, f := range files {
+		u, err := proBoardsPageURL(f)
+		if err != nil {
+			fmt.Printf("Skipping %v\n", err)
+			continue
+		}
+		num, slug := urlNumAndSlug(u)
+		t, ok := byNum[num]
+		if !ok {
+			t = &proBoardsThread{ThreadNum: num, Slug: slug, URL: u}
+			byNum[num] = t
+		}
+		t.Files = append(t.Files, f)
+	}
+
+	var threads []*proBoardsThread
+	for _, t := range byNum {
+		threads = append(threads, t)
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i].ThreadNum < threads[j].ThreadNum })
+	return threads, nil
+}
+
+// parsePages parses every page of the thread, in page order
+func (t *proBoardsThread) parsePages() ([]*ProBoardsPage, error) {
+	var pages []*ProBoardsPage
+	for _, f := range t.Files {
+		page, err := ParseProBoardsFile(f)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	sort.SliceStable(pages, func(i, j int) bool { return pages[i].Page < pages[j].Page })
+	return pages, nil
+}
+
+// proBoardsPosts returns the posts of all pages in order, without the
+// duplicates that appear when a thread grew between saving two pages
+func proBoardsPosts(pages []*ProBoardsPage, threadPath string) []ForumPost {
+	seen := make(map[string]bool)
+	var posts []ForumPost
+	for _, page := range pages {
+		for _, p := range page.Posts {
+			if seen[p.PostID] {
+				continue
+			}
+			seen[p.PostID] = true
+			p.ThreadPath = threadPath
+			posts = append(posts, p)
+		}
+	}
+	return posts
+}
+
+// proBoardsThreadPaths maps thread numbers onto the thread paths the forum
+// URL index knows about.
+func proBoardsThreadPaths(index *ForumURLIndex) map[int]string {
+	paths := make(map[int]string)
+	for threadPath, u := range index.Threads {
+		num, _ := urlNumAndSlug(u)
+		paths[num] = threadPath
+	}
+	return paths
+}
+
+// ImportProBoardsPages ingests saved thread pages through the shared
+// manifest. The first page's file is the manifest key; the other pages are
+// folded into its hash so a new or changed page re-imports the thread.
+func ImportProBoardsPages(ctx context.Context, db *sql.DB, dir string, index *ForumURLIndex, workers int) (*ScrapeReport, error) {
+	threads, err := GroupProBoardsPages(dir)
+	if err != nil {
+		return nil, err
+	}
+	knownPaths := proBoardsThreadPaths(index)
+
+	manifest, err := LoadManifest(db)
+	if err != nil {
+		return nil, fmt.Errorf("load manifest failed: %w", err)
+	}
+	runID, err := startIngestRun(db)
+	if err != nil {
+		return nil, fmt.Errorf("start ingest run failed: %w", err)
+	}
+	report := &ScrapeReport{RunID: runID}
+
+	seen := make(map[string]bool)
+	var jobs []sourceJob
+	for _, t := range threads {
+		t := t
+		threadPath, ok := knownPaths[t.ThreadNum]
+		if !ok {
+			threadPath = "imported/threads/" + t.Slug
+			fmt.Printf("Thread %d is not in the URL index, importing as %s\n", t.ThreadNum, threadPath)
+		}
+		salt := fmt.Sprintf("pages:%d", len(t.Files))
+		for _, f := range t.Files[1:] {
+			h, err := hashFile(f)
+			if err != nil {
+				return report, err
+			}
+			salt += ":" + h
+		}
+		seen[t.Files[0]] = true
+		jobs = append(jobs, sourceJob{Path: t.Files[0], Salt: salt, Parse: func() (*ParsedSource, error) {
+			pages, err := t.parsePages()
+			if err != nil {
+				return nil, err
+			}
+			posts, quotes := NormalizeThread(proBoardsPosts(pages, threadPath), nil)
+			return &ParsedSource{ThreadPath: threadPath, Title: pages[0].Title, Posts: posts, Quotes: quotes}, nil
+		}})
+	}
+	removeVanishedFiles(db, report, manifest, seen, dir)
+	if err := ingestSources(ctx, db, report, manifest, jobs, workers); err != nil {
+		finishIngestRun(db, report)
+		return report, err
+	}
+
+	if err := finishIngestRun(db, report); err != nil {
+		fmt.Printf("Failed to finish ingest run: %v\n", err)
+	}
+	return report, nil
+}
+
+// ---- CLI ----
+func ImportProBoards(dir string, workers int) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	index, err := LoadForumURLIndex("data/tfs/data/")
+	if err != nil {
+		fmt.Printf("Warning: could not load forum URL index: %v\n", err)
+		index = &ForumURLIndex{Boards: map[string]string{}, Threads: map[string]string{}}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := ImportProBoardsPages(ctx, db, dir, index, workers)
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+	if report != nil {
+		report.Print()
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	if err := RebuildBoardsAndThreads(db, "data/tfs/data/"); err != nil {
+		fmt.Println("Error indexing boards and threads:", err)
+	}
+	if err := RebuildForumUsers(db); err != nil {
+		fmt.Println("Error indexing forum users:", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProBoardsPage(t *testing.T) {
+	page, err := ParseProBoardsFile("testdata/proboards/midnight-sun.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.ThreadNum != 1409 || page.Slug != "midnight-sun" || page.Page != 1 || page.Title != "Midnight Sun" {
+		t.Errorf("page = %d %q %q page %d", page.ThreadNum, page.Slug, page.Title, page.Page)
+	}
+	if len(page.Posts) != 2 {
+		t.Fatalf("expected 2 posts, got %d", len(page.Posts))
+	}
+	first := page.Posts[0]
+	if first.PostID != "post-20001" || first.User != "Empress Naoki" || first.UserNum != 607 || first.Timestamp != 1459729209 {
+		t.Errorf("first post = %+v", first)
+	}
+	// Flattened like the posts JSON, and without the signature
+	if first.Message != "The sun did not set.It hung low over Isra." {
+		t.Errorf("first message = %q", first.Message)
+	}
+	if guest := page.Posts[1]; guest.User != "Wandering Bard" || guest.UserNum != 0 {
+		t.Errorf("guest post = %+v", guest)
+	}
+}
+
+func TestGroupProBoardsPages(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"midnight-sun-page-2.html", "midnight-sun.html"} {
+		data, err := os.ReadFile(filepath.Join("testdata/proboards", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.html"), []byte("<html><head><title>Notes</title></head><body>Hi</body></html>"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	threads, err := GroupProBoardsPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != 1 {
+		t.Fatalf("%d threads, want 1", len(threads))
+	}
+	th := threads[0]
+	if th.ThreadNum != 1409 || th.URL != "https://tfs.boards.net/thread/1409/midnight-sun" || len(th.Files) != 2 ||
+		filepath.Base(th.Files[0]) != "midnight-sun.html" {
+		t.Errorf("thread = %+v", th)
+	}
+	pages, err := th.parsePages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 || pages[0].Page != 1 || pages[1].Page != 2 {
+		t.Errorf("pages parsed out of order")
+	}
+}
+
+func TestImportProBoardsPages(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	threadPath := "overworld/isran-empire/free-plains-isra/isra-free-city/threads/midnight-sun"
+	index := &ForumURLIndex{Threads: map[string]string{threadPath: "https://tfs.boards.net/thread/1409/midnight-sun"}}
+
+	report, err := ImportProBoardsPages(context.Background(), db, "testdata/proboards", index, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two pages, one thread; the post repeated on page 2 is stored once
+	if added, _, _ := report.Totals(); added != 3 || report.FilesScanned != 1 {
+		t.Errorf("import: %d threads scanned, %d posts added", report.FilesScanned, added)
+	}
+	posts, err := GetPostsByThread(db, threadPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(posts) != 3 || posts[2].User != "Puck" || posts[2].CleanMessage != "Then we shall not sleep." {
+		t.Fatalf("stored posts = %+v", posts)
+	}
+	quotes, err := GetPostQuotes(db, "post-20003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quotes) != 1 || quotes[0].QuotedPostID != "post-20001" {
+		t.Errorf("quotes = %+v", quotes)
+	}
+	manifest, err := LoadManifest(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := manifest["testdata/proboards/midnight-sun.html"]; e.Title != "Midnight Sun" {
+		t.Errorf("manifest title = %q", e.Title)
+	}
+
+	report, err = ImportProBoardsPages(context.Background(), db, "testdata/proboards", index, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added, updated, removed := report.Totals(); added+updated+removed != 0 {
+		t.Errorf("re-import touched posts: +%d ~%d -%d", added, updated, removed)
+	}
+}
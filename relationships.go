@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ---- Relationships ----
+// Unlike the flat important_relationships of a character sheet, these are
+// observed per conversation window (see Sessionize): each window records
+// how the character stood with the others in it, so a relationship can be
+// followed over time. Windows are skipped once extracted, like timeline
+// windows.
+type RelationshipObservation struct {
+	Username   string   `json:"username"`
+	Other      string   `json:"other"`
+	Type       string   `json:"type"`      // e.g. ally, rival, mentor, lover
+	Sentiment  int      `json:"sentiment"` // -2 (hostile) to 2 (close)
+	Note       string   `json:"note"`
+	ThreadPath string   `json:"thread_path"`
+	Start      int64    `json:"start"` // the window observed
+	End        int64    `json:"end"`
+	ObservedAt int64    `json:"observed_at"` // the earliest post behind it
+	PostIDs    []string `json:"post_ids"`
+}
+
+var sentimentLabels = map[int]string{-2: "hostile", -1: "unfriendly", 0: "neutral", 1: "friendly", 2: "close"}
+
+func sentimentLabel(n int) string {
+	return fmt.Sprintf("%+d %s", n, sentimentLabels[n])
+}
+
+var relationshipsFunction = openai.FunctionDefinition{
+	Name:        "record_relationships",
+	Description: "Record how a roleplay character relates to the other characters in a conversation.",
+	Parameters: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"relationships": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"name":      map[string]string{"type": "string", "description": "The other character"},
+						"type":      map[string]string{"type": "string", "description": "The kind of relationship, e.g. ally, rival, subordinate, friend, enemy, stranger"},
+						"sentiment": map[string]interface{}{"type": "integer", "minimum": -2, "maximum": 2, "description": "-2 hostile, -1 unfriendly, 0 neutral, 1 friendly, 2 close"},
+						"note":      map[string]string{"type": "string", "description": "What happens between them here, in one sentence"},
+						"post_ids":  map[string]interface{}{"type": "array", "items": map[string]string{"type": "string"}, "description": "IDs of the posts that show it"},
+					},
+					"required": []string{"name", "type", "sentiment", "post_ids"},
+				},
+			},
+		},
+		"required": []string{"relationships"},
+	},
+}
+
+func relationshipsPrompt(username, chunkText string) string {
+	return fmt.Sprintf("Describe how %s relates to each other character they deal with in the following conversation, as it stands in these posts. Each post is headed by its author, its ID in parentheses and its time.\n\nConversation:\n%s", username, chunkText)
+}
+
+// parseRelationships reads the arguments of a record_relationships call
+// for a chunk of convo. Post IDs outside the chunk are dropped and the
+// observation dates from the earliest post left.
+func parseRelationships(arguments, username string, convo Conversation, chunk []ForumPost) ([]RelationshipObservation, error) {
+	var call struct {
+		Relationships []struct {
+			Name      string   `json:"name"`
+			Type      string   `json:"type"`
+			Sentiment int      `json:"sentiment"`
+			Note      string   `json:"note"`
+			PostIDs   []string `json:"post_ids"`
+		} `json:"relationships"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &call); err != nil {
+		return nil, err
+	}
+	byID := make(map[string]ForumPost, len(chunk))
+	for _, p := range chunk {
+		byID[p.PostID] = p
+	}
+	var observations []RelationshipObservation
+	for _, r := range call.Relationships {
+		o := RelationshipObservation{
+			Username:   username,
+			Other:      strings.TrimSpace(r.Name),
+			Type:       strings.ToLower(strings.TrimSpace(r.Type)),
+			Sentiment:  r.Sentiment,
+			Note:       strings.TrimSpace(r.Note),
+			ThreadPath: convo.ThreadPath,
+			Start:      convo.Start,
+			End:        convo.End,
+			ObservedAt: chunk[0].Timestamp,
+			PostIDs:    []string{},
+		}
+		if o.Other == "" || strings.EqualFold(o.Other, username) {
+			continue
+		}
+		if o.Sentiment < -2 {
+			o.Sentiment = -2
+		} else if o.Sentiment > 2 {
+			o.Sentiment = 2
+		}
+		first := true
+		for _, id := range r.PostIDs {
+			p, ok := byID[id]
+			if !ok {
+				continue
+			}
+			o.PostIDs = append(o.PostIDs, id)
+			if first || p.Timestamp < o.ObservedAt {
+				o.ObservedAt, first = p.Timestamp, false
+			}
+		}
+		observations = append(observations, o)
+	}
+	return observations, nil
+}
+
+func ExtractRelationships(client *openai.Client, username string, convo Conversation, chunk []ForumPost) ([]RelationshipObservation, error) {
+	resp, err := client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
+		Model: openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: "You are an expert at reading the relationships between characters in fantasy roleplay forum posts."},
+			{Role: openai.ChatMessageRoleUser, Content: relationshipsPrompt(username, renderChunk(chunk))},
+		},
+		Functions:    []openai.FunctionDefinition{relationshipsFunction},
+		FunctionCall: openai.FunctionCall{Name: relationshipsFunction.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, choice := range resp.Choices {
+		if choice.Message.FunctionCall != nil && choice.Message.FunctionCall.Arguments != "" {
+			return parseRelationships(choice.Message.FunctionCall.Arguments, username, convo, chunk)
+		}
+	}
+	return nil, fmt.Errorf("No function response in completion")
+}
+
+// relationshipWindowDone reports whether convo was extracted, and for an
+// open window, with the posts it has now
+func relationshipWindowDone(db *sql.DB, username string, convo Conversation) bool {
+	var postCount int
+	err := db.QueryRow(`SELECT post_count FROM relationship_windows WHERE username = ? AND thread_path = ? AND start = ? AND end = ?`,
+		username, convo.ThreadPath, convo.Start, convo.End).Scan(&postCount)
+	return err == nil && (!convo.Open || postCount == len(convo.Posts))
+}
+
+// saveRelationshipWindow replaces the observations of a window, including
+// those of the shorter session it grew from.
+func saveRelationshipWindow(db *sql.DB, username string, convo Conversation, observations []RelationshipObservation) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"relationship_observations", "relationship_windows"} {
+		_, err := tx.Exec(`DELETE FROM `+table+` WHERE username = ? AND thread_path = ? AND start = ?`, username, convo.ThreadPath, convo.Start)
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range observations {
+		postIDs, _ := json.Marshal(o.PostIDs)
+		_, err := tx.Exec(`
+			INSERT INTO relationship_observations (username, other, type, sentiment, note, thread_path, start, end, observed_at, post_ids)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, username, o.Other, o.Type, o.Sentiment, o.Note, convo.ThreadPath, convo.Start, convo.End, o.ObservedAt, string(postIDs))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO relationship_windows (username, thread_path, start, end, post_count, extracted_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		username, convo.ThreadPath, convo.Start, convo.End, len(convo.Posts), time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetRelationshipHistory returns what was observed between username and
+// other (or everyone, when other is empty), oldest first.
+func GetRelationshipHistory(db *sql.DB, username, other string) ([]RelationshipObservation, error) {
+	query := `SELECT username, other, type, sentiment, note, thread_path, start, end, observed_at, post_ids FROM relationship_observations WHERE username = ?`
+	args := []interface{}{username}
+	if other != "" {
+		query += ` AND other = ? COLLATE NOCASE`
+		args = append(args, other)
+	}
+	rows, err := db.Query(query+` ORDER BY observed_at, other COLLATE NOCASE`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var history []RelationshipObservation
+	for rows.Next() {
+		var o RelationshipObservation
+		var postIDs string
+		if err := rows.Scan(&o.Username, &o.Other, &o.Type, &o.Sentiment, &o.Note, &o.ThreadPath, &o.Start, &o.End, &o.ObservedAt, &postIDs); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(postIDs), &o.PostIDs)
+		history = append(history, o)
+	}
+	return history, rows.Err()
+}
+
+// groupByOther splits a history per other character, ignoring case in the
+// names, in order of first appearance
+func groupByOther(history []RelationshipObservation) [][]RelationshipObservation {
+	index := make(map[string]int)
+	var groups [][]RelationshipObservation
+	for _, o := range history {
+		key := strings.ToLower(o.Other)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], o)
+	}
+	return groups
+}
+
+func WriteRelationshipsMarkdown(w io.Writer, username string, history []RelationshipObservation) error {
+	groups := groupByOther(history)
+	fmt.Fprintf(w, "# Relationships: %s\n\n_%d characters, %d observations_\n", username, len(groups), len(history))
+	for _, g := range groups {
+		first, last := g[0], g[len(g)-1]
+		fmt.Fprintf(w, "\n## %s\n\n", first.Other)
+		if len(g) > 1 {
+			fmt.Fprintf(w, "From %s (%s) to %s (%s), %s to %s.\n\n",
+				first.Type, sentimentLabel(first.Sentiment), last.Type, sentimentLabel(last.Sentiment),
+				formatPostDate(first.ObservedAt), formatPostDate(last.ObservedAt))
+		}
+		fmt.Fprintln(w, "| Date | Type | Sentiment | Thread | Note |")
+		fmt.Fprintln(w, "|---|---|---|---|---|")
+		for _, o := range g {
+			_, slug := SplitThreadPath(o.ThreadPath)
+			note := strings.ReplaceAll(o.Note, "|", "\\|")
+			fmt.Fprintf(w, "| %s | %s | %s | %s | %s |\n", FormatWorldTime(o.ObservedAt), o.Type, sentimentLabel(o.Sentiment), titleFromSlug(slug), note)
+		}
+	}
+	return nil
+}
+
+func WriteRelationshipsCSV(w io.Writer, history []RelationshipObservation) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"username", "other", "observed_at", "type", "sentiment", "note", "thread_path", "post_ids"})
+	for _, o := range history {
+		cw.Write([]string{o.Username, o.Other, time.Unix(o.ObservedAt, 0).UTC().Format(time.RFC3339), o.Type,
+			fmt.Sprint(o.Sentiment), o.Note, o.ThreadPath, strings.Join(o.PostIDs, " ")})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func WriteRelationshipsJSON(w io.Writer, history []RelationshipObservation) error {
+	if history == nil {
+		history = []RelationshipObservation{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(history)
+}
+
+// ---- CLI ----
+// ExtractRelationshipHistory observes username's relationships in each of
+// their conversation windows. Windows done before are skipped unless force
+// is set; with dryRun nothing is sent to OpenAI.
+func ExtractRelationshipHistory(dryRun, force bool, username string, opts SessionOptions) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	convos, err := FindUserConversations(db, username, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(convos) == 0 {
+		log.Fatal(noPostsError(db, username))
+	}
+
+	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	todo, skipped, saved, failed := 0, 0, 0, 0
+	for i, convo := range convos {
+		if !force && relationshipWindowDone(db, username, convo) {
+			skipped++
+			continue
+		}
+		todo++
+		if dryRun {
+			continue
+		}
+		fmt.Printf("Conversation %d/%d (%s, %s, %d posts)\n", i+1, len(convos), convo.ThreadPath, FormatWorldTime(convo.Start), len(convo.Posts))
+		chunks := ChunkPosts(convo.Posts, ChunkOptions{Model: openai.GPT4o, MaxTokens: TokenBudget(openai.GPT4o, 25000)})
+		var observations []RelationshipObservation
+		var extractErr error
+		for _, chunk := range chunks {
+			found, err := ExtractRelationships(client, username, convo, chunk)
+			if err != nil {
+				extractErr = err
+				break
+			}
+			observations = append(observations, found...)
+		}
+		if extractErr != nil {
+			log.Printf("Extraction failed: %v", extractErr)
+			failed++
+			continue
+		}
+		if err := saveRelationshipWindow(db, username, convo, observations); err != nil {
+			log.Fatalf("failed to save relationships: %v", err)
+		}
+		for _, o := range observations {
+			fmt.Printf("  %s: %s (%s)\n", o.Other, o.Type, sentimentLabel(o.Sentiment))
+		}
+		saved++
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d of %d conversations would be sent, %d were done before\n", todo, len(convos), skipped)
+		return
+	}
+	fmt.Printf("\n%d conversations extracted, %d already done, %d failed\n", saved, skipped, failed)
+}
+
+// ExportRelationships writes the relationship history of username, with
+// one other character or all of them, as md, json or csv.
+func ExportRelationships(username, other, format, outPath string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	name, err := ResolveUsername(db, username)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	history, err := GetRelationshipHistory(db, name, other)
+	if err != nil {
+		log.Fatalf("failed to load relationships: %v", err)
+	}
+	if len(history) == 0 {
+		fmt.Printf("No relationships recorded for %s; run -mode relationships -username %q first\n", name, name)
+		return
+	}
+
+	w := os.Stdout
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			log.Fatalf("failed to create %s: %v", outPath, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	switch format {
+	case "md", "markdown":
+		err = WriteRelationshipsMarkdown(w, name, history)
+	case "json":
+		err = WriteRelationshipsJSON(w, history)
+	case "csv":
+		err = WriteRelationshipsCSV(w, history)
+	default:
+		log.Fatalf("unknown relationship format %q (use md, json or csv)", format)
+	}
+	if err != nil {
+		log.Fatalf("failed to write relationships: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRelationshipHistory(t *testing.T) {
+	db := openTestDB(t)
+	chunk := []ForumPost{
+		{PostID: "post-1", User: "Tanis", Timestamp: 1459729209, ThreadPath: "board/threads/treaty"},
+		{PostID: "post-2", User: "Puck", Timestamp: 1459729300, ThreadPath: "board/threads/treaty"},
+	}
+	convo := Conversation{ThreadPath: "board/threads/treaty", Start: 1459729209, End: 1459729301, Posts: chunk, Open: true}
+	args := `{"relationships": [
+		{"name": "Tanis", "type": "Diplomatic Partner", "sentiment": 1, "note": "They sign a treaty.", "post_ids": ["post-2", "post-1", "post-5"]},
+		{"name": "Puck", "type": "self", "sentiment": 2, "post_ids": []},
+		{"name": "Lamina", "type": "subordinate", "sentiment": 5, "note": "Lamina is sent away.", "post_ids": []}
+	]}`
+	observed, err := parseRelationships(args, "Puck", convo, chunk)
+	if err != nil || len(observed) != 2 {
+		t.Fatalf("observed = %+v, %v", observed, err)
+	}
+	if o := observed[0]; o.Type != "diplomatic partner" || o.ObservedAt != 1459729209 || strings.Join(o.PostIDs, ",") != "post-2,post-1" {
+		t.Errorf("Tanis = %+v", o)
+	}
+	if observed[1].Sentiment != 2 {
+		t.Errorf("sentiment not clamped: %d", observed[1].Sentiment)
+	}
+	if err := saveRelationshipWindow(db, "Puck", convo, observed); err != nil {
+		t.Fatal(err)
+	}
+	if !relationshipWindowDone(db, "Puck", convo) {
+		t.Error("window not recorded")
+	}
+
+	// The session grows: the longer window replaces the shorter one
+	later := ForumPost{PostID: "post-3", User: "Tanis", Timestamp: 1459900000, ThreadPath: "board/threads/treaty"}
+	convo.Posts, convo.End = append(convo.Posts, later), later.Timestamp+1
+	if relationshipWindowDone(db, "Puck", convo) {
+		t.Error("grown window counted as done")
+	}
+	broken := []RelationshipObservation{observed[0], {Other: "tanis", Type: "enemy", Sentiment: -2, Note: "Tanis breaks the treaty.", ObservedAt: later.Timestamp, PostIDs: []string{"post-3"}}}
+	if err := saveRelationshipWindow(db, "Puck", convo, broken); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := GetRelationshipHistory(db, "Puck", "TANIS")
+	if err != nil || len(history) != 2 || history[1].Type != "enemy" {
+		t.Fatalf("history = %+v, %v", history, err)
+	}
+	if all, _ := GetRelationshipHistory(db, "Puck", ""); len(all) != 2 {
+		t.Errorf("%d observations after the window grew, want 2", len(all))
+	}
+
+	var md, csv bytes.Buffer
+	WriteRelationshipsMarkdown(&md, "Puck", history)
+	if !strings.Contains(md.String(), "## Tanis") || !strings.Contains(md.String(), "From diplomatic partner (+1 friendly) to enemy (-2 hostile)") {
+		t.Errorf("markdown:\n%s", md.String())
+	}
+	WriteRelationshipsCSV(&csv, history)
+	if lines := strings.Split(strings.TrimSpace(csv.String()), "\n"); len(lines) != 3 || !strings.Contains(lines[2], "tanis,2016-04-05") {
+		t.Errorf("csv:\n%s", csv.String())
+	}
+}
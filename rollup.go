@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// ---- Board Roll-ups ----
+// Thread summaries are rolled up the board hierarchy: boards, then regions
+// (the boards right under a category), then one "state of the world"
+// document per top-level category. A board is only re-summarized when one of
+// the summaries below it changed.
+type BoardSummary struct {
+	BoardPath    string
+	Kind         string
+	Summary      string
+	ThreadCount  int
+	SourceHash   string
+	SummarizedAt int64
+}
+
+func boardKind(depth int) string {
+	switch depth {
+	case 0:
+		return "world"
+	case 1:
+		return "region"
+	}
+	return "board"
+}
+
+func GetBoardSummary(db *sql.DB, boardPath string) (*BoardSummary, error) {
+	var s BoardSummary
+	err := db.QueryRow(`SELECT board_path, kind, summary, thread_count, source_hash, summarized_at FROM board_summaries WHERE board_path = ?`, boardPath).
+		Scan(&s.BoardPath, &s.Kind, &s.Summary, &s.ThreadCount, &s.SourceHash, &s.SummarizedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func saveBoardSummary(db *sql.DB, s BoardSummary) error {
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO board_summaries (board_path, kind, summary, thread_count, source_hash, summarized_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, s.BoardPath, s.Kind, s.Summary, s.ThreadCount, s.SourceHash, time.Now().Unix())
+	return err
+}
+
+func labeledNode(label, summary string) summaryNode {
+	text := label + "\n" + summary
+	sum := sha256.Sum256([]byte(text))
+	return summaryNode{Hash: hex.EncodeToString(sum[:]), Summary: text}
+}
+
+func sourceHash(nodes []summaryNode) string {
+	h := sha256.New()
+	for _, n := range nodes {
+		io.WriteString(h, n.Hash+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type rollUp struct {
+	db        *sql.DB
+	client    *openai.Client
+	dryRun    bool
+	maxTokens int
+	stale     map[string]bool // thread paths whose summary is out of date
+
+	threadsSummarized int
+	threadsMissing    int // left out in dry-run mode
+	boardsSummarized  int
+	boardsUnchanged   int
+}
+
+// thread returns the thread's summary, summarizing it first if it has none
+// or it is stale.
+func (r *rollUp) thread(t *Thread) (*summaryNode, error) {
+	label := fmt.Sprintf("Thread %q:", t.Title)
+	if s, err := GetThreadSummary(r.db, t.ThreadPath); err == nil && !r.stale[t.ThreadPath] {
+		n := labeledNode(label, s.Summary)
+		return &n, nil
+	}
+	if r.dryRun {
+		r.threadsMissing++
+		return nil, nil
+	}
+	posts, err := GetPostsByThread(r.db, t.ThreadPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(posts) == 0 {
+		return nil, nil
+	}
+	summary, citations, err := SummarizeThread(r.db, r.client, t.ThreadPath, r.maxTokens, false, posts)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveThreadSummary(r.db, t.ThreadPath, summary, citations, posts); err != nil {
+		return nil, err
+	}
+	r.threadsSummarized++
+	n := labeledNode(label, summary)
+	return &n, nil
+}
+
+// board rolls up a board after its sub-boards. It returns nil for boards
+// without any summarized threads below them.
+func (r *rollUp) board(b Board) (*summaryNode, int, error) {
+	var inputs []summaryNode
+	threadCount := 0
+	children, err := GetChildBoards(r.db, b.BoardPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, child := range children {
+		n, count, err := r.board(child)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n != nil {
+			inputs = append(inputs, labeledNode(fmt.Sprintf("%s %q:", boardKind(child.Depth), child.Title), n.Summary))
+			threadCount += count
+		}
+	}
+	threads, err := GetThreadsUnderBoard(r.db, b.BoardPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, t := range threads {
+		if t.BoardPath != b.BoardPath {
+			continue // rolled up through its own board
+		}
+		n, err := r.thread(t)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n != nil {
+			inputs = append(inputs, *n)
+			threadCount++
+		}
+	}
+	if len(inputs) == 0 {
+		return nil, 0, nil
+	}
+
+	kind := boardKind(b.Depth)
+	hash := sourceHash(inputs)
+	if stored, err := GetBoardSummary(r.db, b.BoardPath); err == nil && stored.SourceHash == hash {
+		r.boardsUnchanged++
+		return &summaryNode{Hash: hash, Summary: stored.Summary}, threadCount, nil
+	}
+	if r.dryRun {
+		fmt.Printf("Would summarize %s %s from %d summaries\n", kind, b.BoardPath, len(inputs))
+		r.boardsSummarized++
+		return &summaryNode{Hash: hash}, threadCount, nil
+	}
+
+	fmt.Printf("Rolling up %s %s (%d summaries)\n", kind, b.BoardPath, len(inputs))
+	prompt := fmt.Sprintf("These are summaries of the threads and sub-boards of %q, a %s of a fantasy roleplay forum. Combine them into one summary of what has happened there: the places, factions and characters involved, and how things stand now.", b.Title, kind)
+	root, err := reduceSummaries(r.db, r.client, b.BoardPath, inputs, r.maxTokens, prompt)
+	if err != nil {
+		return nil, 0, err
+	}
+	summary := root.Summary
+	if kind == "world" || len(inputs) == 1 {
+		// Categories get a document of their own, and a lone input would
+		// otherwise be passed up unchanged
+		summary, err = r.finalize(b, kind, root)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	err = saveBoardSummary(r.db, BoardSummary{BoardPath: b.BoardPath, Kind: kind, Summary: summary, ThreadCount: threadCount, SourceHash: hash})
+	if err != nil {
+		return nil, 0, err
+	}
+	r.boardsSummarized++
+	return &summaryNode{Hash: hash, Summary: summary}, threadCount, nil
+}
+
+func (r *rollUp) finalize(b Board, kind string, root summaryNode) (string, error) {
+	var prompt string
+	if kind == "world" {
+		prompt = fmt.Sprintf("Write a \"state of the world\" briefing for game masters covering the %q category of a fantasy roleplay forum, based on the summary below. Describe the major powers, regions and ongoing conflicts, who the key characters are and what they are doing, and any open plot threads a GM should know about.\n\n%s", b.Title, root.Summary)
+	} else {
+		prompt = fmt.Sprintf("Summarize what has happened in %q, a %s of a fantasy roleplay forum, based on the summary below: the places, factions and characters involved, and how things stand now.\n\n%s", b.Title, kind, root.Summary)
+	}
+	sum := sha256.Sum256([]byte(prompt))
+	hash := hex.EncodeToString(sum[:])
+	if summary, ok := getCachedSummary(r.db, hash); ok {
+		return summary, nil
+	}
+	summary, err := complete(r.client, "You are a skilled fantasy forum summarizer.", prompt)
+	if err != nil {
+		return "", err
+	}
+	if err := saveCachedSummary(r.db, hash, -1, b.BoardPath, nil, []string{root.Hash}, summary, nil); err != nil {
+		fmt.Printf("Failed to cache summary: %v\n", err)
+	}
+	return summary, nil
+}
+
+// ---- CLI ----
+// RollUpBoards summarizes boardPath and everything below it, or every
+// top-level category when boardPath is empty. World documents are also
+// written to outDir as markdown when it is set.
+func RollUpBoards(dryRun bool, boardPath, outDir string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	var roots []Board
+	if boardPath == "" {
+		if roots, err = GetChildBoards(db, ""); err != nil {
+			log.Fatalf("failed to list categories: %v", err)
+		}
+	} else {
+		var b Board
+		err := db.QueryRow(`SELECT board_path, slug, title, parent_path, depth, url, board_num FROM boards WHERE board_path = ?`, boardPath).
+			Scan(&b.BoardPath, &b.Slug, &b.Title, &b.ParentPath, &b.Depth, &b.URL, &b.BoardNum)
+		if err != nil {
+			log.Fatalf("unknown board %q", boardPath)
+		}
+		roots = []Board{b}
+	}
+
+	stale, err := FindStaleThreadSummaries(db, boardPath)
+	if err != nil {
+		log.Fatalf("failed to check thread summaries: %v", err)
+	}
+	r := &rollUp{
+		db:        db,
+		client:    openai.NewClient(os.Getenv("OPENAI_API_KEY")),
+		dryRun:    dryRun,
+		maxTokens: summaryChunkTokens,
+		stale:     make(map[string]bool),
+	}
+	for _, s := range stale {
+		r.stale[s.ThreadPath] = true
+	}
+
+	for _, b := range roots {
+		n, count, err := r.board(b)
+		if err != nil {
+			log.Fatalf("roll-up of %s failed: %v", b.BoardPath, err)
+		}
+		if n == nil || dryRun {
+			continue
+		}
+		fmt.Printf("\n=== %s (%s, %d threads) ===\n%s\n", b.Title, boardKind(b.Depth), count, n.Summary)
+		if outDir != "" && b.Depth == 0 {
+			if err := os.MkdirAll(outDir, 0755); err != nil {
+				log.Fatalf("failed to create %s: %v", outDir, err)
+			}
+			path := filepath.Join(outDir, b.Slug+".md")
+			doc := fmt.Sprintf("# State of the World: %s\n\n_Rolled up from %d thread summaries on %s_\n\n%s\n", b.Title, count, time.Now().Format("2006-01-02"), n.Summary)
+			if err := os.WriteFile(path, []byte(doc), 0644); err != nil {
+				log.Fatalf("failed to write %s: %v", path, err)
+			}
+			fmt.Printf("Wrote %s\n", path)
+		}
+	}
+	if dryRun {
+		fmt.Printf("\nDry run: %d threads need a summary first, %d boards would be summarized, %d are up to date\n",
+			r.threadsMissing, r.boardsSummarized, r.boardsUnchanged)
+		return
+	}
+	fmt.Printf("\nSummarized %d threads and %d boards; %d boards were up to date\n", r.threadsSummarized, r.boardsSummarized, r.boardsUnchanged)
+}
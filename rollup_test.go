@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollUpDryRun(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []Board{
+		{BoardPath: "overworld", Title: "Overworld"},
+		{BoardPath: "overworld/vessia", Title: "Vessia", ParentPath: "overworld", Depth: 1},
+		{BoardPath: "overworld/vessia/capital", Title: "Capital", ParentPath: "overworld/vessia", Depth: 2},
+		{BoardPath: "overworld/toragana", Title: "Toragana", ParentPath: "overworld", Depth: 1},
+	} {
+		if _, err := db.Exec(`INSERT INTO boards (board_path, slug, title, parent_path, depth, url, board_num) VALUES (?, '', ?, ?, ?, '', 0)`,
+			b.BoardPath, b.Title, b.ParentPath, b.Depth); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tp := range []string{"overworld/vessia/capital/threads/a", "overworld/vessia/threads/b", "overworld/toragana/threads/c"} {
+		board, slug := SplitThreadPath(tp)
+		if _, err := db.Exec(`INSERT INTO threads (thread_path, board_path, slug, title, url, thread_num, first_post_at, last_post_at, participants, post_count)
+			VALUES (?, ?, ?, ?, '', 0, 0, 0, '[]', 0)`, tp, board, slug, slug); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SaveThreadSummary(db, "overworld/vessia/capital/threads/a", "A happened.", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveThreadSummary(db, "overworld/vessia/threads/b", "B happened.", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &rollUp{db: db, dryRun: true, maxTokens: summaryChunkTokens, stale: map[string]bool{}}
+	root := Board{BoardPath: "overworld", Title: "Overworld"}
+	n, count, err := r.board(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Toragana has no summarized thread yet, so it is left out
+	if n == nil || count != 2 || r.threadsMissing != 1 || r.boardsSummarized != 3 {
+		t.Errorf("roll-up: node %v, %d threads, %d missing, %d boards", n != nil, count, r.threadsMissing, r.boardsSummarized)
+	}
+
+	// A board whose inputs did not change is reused as is
+	capital, _, err := (&rollUp{db: db, dryRun: true, stale: map[string]bool{}}).board(Board{BoardPath: "overworld/vessia/capital", Depth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveBoardSummary(db, BoardSummary{BoardPath: "overworld/vessia/capital", Kind: "board", Summary: "The capital.", SourceHash: capital.Hash}); err != nil {
+		t.Fatal(err)
+	}
+	r = &rollUp{db: db, dryRun: true, maxTokens: summaryChunkTokens, stale: map[string]bool{}}
+	if _, _, err := r.board(root); err != nil {
+		t.Fatal(err)
+	}
+	if r.boardsUnchanged != 1 || r.boardsSummarized != 2 {
+		t.Errorf("second roll-up: %d unchanged, %d summarized", r.boardsUnchanged, r.boardsSummarized)
+	}
+}
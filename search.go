@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// ---- Keyword Search ----
+// Offline full-text search over forum_posts through the forum_posts_fts
+// index (see migration 12). Unlike SearchForumPosts it needs neither OpenAI
+// nor Qdrant, which makes it the fallback whenever those are unavailable.
+type SearchOptions struct {
+	User         string // exact name as stored; "" for everyone
+	ThreadPrefix string // "" for all threads
+	Limit        int
+	Highlight    [2]string // markers around matched terms in snippets
+}
+
+type SearchHit struct {
+	Post    ForumPost
+	Snippet string
+	Rank    float64 // bm25, lower is better
+}
+
+// ftsQuery turns free text into an FTS5 query: "quoted phrases" stay
+// phrases, other words become terms that must all match, and a trailing *
+// keeps prefix matching. Everything else FTS5 would treat as syntax is
+// dropped, so user input cannot produce a query error.
+func ftsQuery(input string) string {
+	var terms []string
+	for i, part := range strings.Split(input, `"`) {
+		if i%2 == 1 {
+			if words := ftsWords(part); len(words) > 0 {
+				terms = append(terms, `"`+strings.Join(words, " ")+`"`)
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			prefix := strings.HasSuffix(field, "*")
+			for _, w := range ftsWords(field) {
+				terms = append(terms, `"`+w+`"`)
+			}
+			if prefix && len(terms) > 0 {
+				terms[len(terms)-1] += "*"
+			}
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+func ftsWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func KeywordSearch(db *sql.DB, input string, opts SearchOptions) ([]SearchHit, error) {
+	match := ftsQuery(input)
+	if match == "" {
+		return nil, fmt.Errorf("empty search query")
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = 10
+	}
+	if opts.Highlight == [2]string{} {
+		opts.Highlight = [2]string{"[", "]"}
+	}
+	query := `
+		SELECT p.post_id, p.user, p.user_num, p.timestamp, p.message, p.thread_path, COALESCE(p.clean_message, p.message),
+			snippet(forum_posts_fts, 0, ?, ?, '…', 24), bm25(forum_posts_fts)
+		FROM forum_posts_fts
+		JOIN forum_posts p ON p.rowid = forum_posts_fts.rowid
+		WHERE forum_posts_fts MATCH ?`
+	args := []interface{}{opts.Highlight[0], opts.Highlight[1], match}
+	if opts.User != "" {
+		query += ` AND p.user = ?`
+		args = append(args, opts.User)
+	}
+	if opts.ThreadPrefix != "" {
+		query += ` AND p.thread_path LIKE ?`
+		args = append(args, opts.ThreadPrefix+"%")
+	}
+	query += ` ORDER BY bm25(forum_posts_fts) LIMIT ?`
+	args = append(args, opts.Limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("search failed: %w", err)
+	}
+	defer rows.Close()
+	var hits []SearchHit
+	for rows.Next() {
+		var h SearchHit
+		p := &h.Post
+		if err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage, &h.Snippet, &h.Rank); err != nil {
+			return nil, err
+		}
+		hits = append(hits, h)
+	}
+	return hits, rows.Err()
+}
+
+// RebuildSearchIndex refills forum_posts_fts from forum_posts. The triggers
+// keep it in sync; this is only needed after a VACUUM, which may renumber
+// the rowids the index is keyed on.
+func RebuildSearchIndex(db *sql.DB) error {
+	_, err := db.Exec(`
+		DELETE FROM forum_posts_fts;
+		INSERT INTO forum_posts_fts (rowid, body) SELECT rowid, COALESCE(clean_message, message) FROM forum_posts;
+	`)
+	return err
+}
+
+// FormatSearchHits renders hits compactly for chat
+func FormatSearchHits(hits []SearchHit) string {
+	var b strings.Builder
+	for _, h := range hits {
+		_, slug := SplitThreadPath(h.Post.ThreadPath)
+		fmt.Fprintf(&b, "%s in %s (%s):\n%s\n", h.Post.User, titleFromSlug(slug), postTime(h.Post.Timestamp).Format("Jan 2, 2006"), h.Snippet)
+	}
+	return b.String()
+}
+
+// ---- CLI ----
+func KeywordSearchPosts(input string, opts SearchOptions) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	if opts.User != "" {
+		name, err := ResolveUsername(db, opts.User)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		opts.User = name
+	}
+	hits, err := KeywordSearch(db, input, opts)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(hits) == 0 {
+		fmt.Println("No results found.")
+		return
+	}
+	for i, h := range hits {
+		fmt.Printf("%d. %s — %s (%s, score %.2f)\n   %s\n   %s\n\n", i+1, h.Post.User, h.Post.ThreadPath,
+			postTime(h.Post.Timestamp).Format("2006-01-02"), -h.Rank, h.Post.PostID, h.Snippet)
+	}
+}
+
+func RebuildSearch() {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+	if err := RebuildSearchIndex(db); err != nil {
+		log.Fatalf("failed to rebuild search index: %v", err)
+	}
+	fmt.Println("Search index rebuilt.")
+}
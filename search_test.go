@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestFTSQuery(t *testing.T) {
+	cases := map[string]string{
+		`dragon fire`:            `"dragon" "fire"`,
+		`"the sun did not" set`:  `"the sun did not" "set"`,
+		`Naoki's drag* (OR) -x:`: `"Naoki" "s" "drag"* "OR" "x"`,
+		`"`:                      ``,
+	}
+	for in, want := range cases {
+		if got := ftsQuery(in); got != want {
+			t.Errorf("ftsQuery(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestKeywordSearchStaysInSync(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	insert := func(id, user, thread, msg string) {
+		t.Helper()
+		_, err := db.Exec(`INSERT OR REPLACE INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES (?, ?, 0, 1459729209, ?, ?)`,
+			id, user, msg, thread)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("post-1", "Empress Naoki", "overworld/threads/midnight-sun", "The sun did not set over Isra.")
+	insert("post-2", "Puck", "overworld/threads/midnight-sun", "Then we shall not sleep under the sun.")
+	insert("post-3", "Puck", "history/threads/old-tales", "The dragons slept beneath the mountain.")
+
+	search := func(q string, opts SearchOptions) []SearchHit {
+		t.Helper()
+		hits, err := KeywordSearch(db, q, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hits
+	}
+	if hits := search(`"did not set"`, SearchOptions{}); len(hits) != 1 || hits[0].Post.PostID != "post-1" ||
+		hits[0].Snippet != "The sun [did not set] over Isra." {
+		t.Errorf("phrase search = %+v", hits)
+	}
+	if hits := search("sun", SearchOptions{User: "Puck"}); len(hits) != 1 || hits[0].Post.PostID != "post-2" {
+		t.Errorf("author filter = %+v", hits)
+	}
+	if hits := search("dragon", SearchOptions{ThreadPrefix: "history/"}); len(hits) != 1 {
+		t.Errorf("thread filter = %+v", hits)
+	}
+
+	// Replaced, re-cleaned and deleted posts are reflected in the index
+	insert("post-1", "Empress Naoki", "overworld/threads/midnight-sun", "The moon rose instead.")
+	if hits := search("sun", SearchOptions{}); len(hits) != 1 {
+		t.Errorf("after replace: %+v", hits)
+	}
+	db.Exec(`UPDATE forum_posts SET clean_message = 'Dragons everywhere.' WHERE post_id = 'post-2'`)
+	db.Exec(`DELETE FROM forum_posts WHERE post_id = 'post-3'`)
+	if hits := search("dragons", SearchOptions{}); len(hits) != 1 || hits[0].Post.PostID != "post-2" {
+		t.Errorf("after update and delete: %+v", hits)
+	}
+	var indexed int
+	db.QueryRow(`SELECT COUNT(*) FROM forum_posts_fts`).Scan(&indexed)
+	if indexed != 2 {
+		t.Errorf("index holds %d rows, want 2", indexed)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 	"github.com/sashabaranov/go-openai"
@@ -26,33 +31,9 @@ type SummarizedThreadContext struct {
 	IDs        string
 }
 
-// --- Ensure tables exist ---
-func ensureTables(db *sql.DB) error {
-	// forum_posts table is assumed to exist already.
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS summarization_contexts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			prompt TEXT,
-			chunk_text TEXT
-		);
-	`)
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS summarized_thread_contexts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			prompt TEXT,
-			thread_path TEXT,
-			ids TEXT
-		);
-	`)
-	return err
-}
-
 // --- Query all posts in a thread, sorted by timestamp ---
 func GetPostsByThread(db *sql.DB, threadPath string) ([]ForumPost, error) {
-	rows, err := db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path FROM forum_posts WHERE thread_path = ? ORDER BY timestamp ASC`, threadPath)
+	rows, err := db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message) FROM forum_posts WHERE thread_path = ? ORDER BY timestamp ASC`, threadPath)
 	if err != nil {
 		return nil, err
 	}
@@ -60,7 +41,7 @@ func GetPostsByThread(db *sql.DB, threadPath string) ([]ForumPost, error) {
 	var posts []ForumPost
 	for rows.Next() {
 		var p ForumPost
-		err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath)
+		err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage)
 		if err != nil {
 			return nil, err
 		}
@@ -71,7 +52,7 @@ func GetPostsByThread(db *sql.DB, threadPath string) ([]ForumPost, error) {
 
 func GetPostsByThreadPrefix(db *sql.DB, threadPrefix string) ([]ForumPost, error) {
 	query := `
-        SELECT post_id, user, user_num, timestamp, message, thread_path
+        SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message)
         FROM forum_posts
         WHERE thread_path LIKE ? 
         ORDER BY timestamp ASC
@@ -86,7 +67,7 @@ func GetPostsByThreadPrefix(db *sql.DB, threadPrefix string) ([]ForumPost, error
 	var posts []ForumPost
 	for rows.Next() {
 		var p ForumPost
-		err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath)
+		err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage)
 		if err != nil {
 			return nil, err
 		}
@@ -95,115 +76,511 @@ func GetPostsByThreadPrefix(db *sql.DB, threadPrefix string) ([]ForumPost, error
 	return posts, nil
 }
 
-// --- Split posts into text chunks that fit within a window ---
-func ChunkPosts(posts []ForumPost, maxChars int) [][]ForumPost {
-	var chunks [][]ForumPost
-	var current []ForumPost
-	currentLen := 0
+// ---- Token Budgets ----
+type modelLimits struct {
+	Encoding string
+	Context  int // tokens per request, prompt and reply together
+	Reserve  int // left for instructions and the reply
+}
+
+var modelLimitsByName = map[string]modelLimits{
+	"gpt-4.1-2025-04-14":           {"o200k_base", 1047576, 33000},
+	"gpt-4.1-nano-2025-04-14":      {"o200k_base", 1047576, 33000},
+	openai.GPT4o:                   {"o200k_base", 128000, 17000},
+	string(openai.LargeEmbedding3): {"cl100k_base", 8191, 0},
+	string(openai.SmallEmbedding3): {"cl100k_base", 8191, 0},
+	string(openai.AdaEmbeddingV2):  {"cl100k_base", 8191, 0},
+}
+
+func limitsFor(model string) modelLimits {
+	if l, ok := modelLimitsByName[model]; ok {
+		return l
+	}
+	return modelLimits{"o200k_base", 128000, 17000}
+}
+
+// TokenizerFor returns the tokenizer for model's encoding. A rank file that
+// exists but cannot be read stops the run.
+func TokenizerFor(model string) *Tokenizer {
+	tok, err := LoadTokenizer(limitsFor(model).Encoding)
+	if err != nil {
+		log.Fatalf("Fatal: no tokenizer for %s: %v", model, err)
+	}
+	return tok
+}
+
+// TokenBudget is how many tokens of input fit in one request to model, at
+// most want when that is positive.
+func TokenBudget(model string, want int) int {
+	l := limitsFor(model)
+	budget := l.Context - l.Reserve
+	if want > 0 && want < budget {
+		return want
+	}
+	return budget
+}
+
+// Posts repeated at the start of the next chunk, set by -overlap
+var ChunkOverlap int
+
+type ChunkOptions struct {
+	Model     string // picks the tokenizer
+	MaxTokens int    // per chunk, as rendered by renderChunk
+	Overlap   int    // posts carried over from the end of the previous chunk
+}
+
+// --- Split posts into chunks that fit within a token budget ---
+// Posts too long for a chunk of their own are split into parts that keep
+// the post's ID, author and time.
+func ChunkPosts(posts []ForumPost, opts ChunkOptions) [][]ForumPost {
+	tok := TokenizerFor(opts.Model)
+	type sized struct {
+		post   ForumPost
+		tokens int
+	}
+	var items []sized
 	for _, post := range posts {
-		msgLen := len(post.Message)
-		if currentLen+msgLen+64 > maxChars && len(current) > 0 {
-			chunks = append(chunks, current)
-			current = nil
-			currentLen = 0
+		tokens := tok.Count(renderChunk([]ForumPost{post}))
+		if tokens <= opts.MaxTokens {
+			items = append(items, sized{post, tokens})
+			continue
+		}
+		// One token to spare where the text meets the header and newline
+		header := tok.Count(renderChunk([]ForumPost{{PostID: post.PostID, User: post.User, Timestamp: post.Timestamp}}))
+		for _, p := range splitPost(tok, post, opts.MaxTokens-header-1) {
+			items = append(items, sized{p, tok.Count(renderChunk([]ForumPost{p}))})
 		}
-		current = append(current, post)
-		currentLen += msgLen + 64
+	}
+
+	var chunks [][]ForumPost
+	var current []sized
+	currentTokens := 0
+	for _, item := range items {
+		if currentTokens+item.tokens > opts.MaxTokens && len(current) > 0 {
+			chunk := make([]ForumPost, len(current))
+			for i, c := range current {
+				chunk[i] = c.post
+			}
+			chunks = append(chunks, chunk)
+			// Carry over what fits, but always leave room to move on
+			keep := opts.Overlap
+			if keep >= len(current) {
+				keep = len(current) - 1
+			}
+			if keep < 0 {
+				keep = 0
+			}
+			current = append([]sized(nil), current[len(current)-keep:]...)
+			currentTokens = 0
+			for _, c := range current {
+				currentTokens += c.tokens
+			}
+			for len(current) > 0 && currentTokens+item.tokens > opts.MaxTokens {
+				currentTokens -= current[0].tokens
+				current = current[1:]
+			}
+		}
+		current = append(current, item)
+		currentTokens += item.tokens
 	}
 	if len(current) > 0 {
-		chunks = append(chunks, current)
+		chunk := make([]ForumPost, len(current))
+		for i, c := range current {
+			chunk[i] = c.post
+		}
+		chunks = append(chunks, chunk)
 	}
 	return chunks
 }
 
-// --- Generate a summary for a chunk of posts ---
-func SummarizeChunk(db *sql.DB, client *openai.Client, posts []ForumPost, dryRun bool) (string, error) {
+// splitPost cuts a post's text into parts of at most max tokens, each
+// keeping the post's ID, author and time
+func splitPost(tok *Tokenizer, post ForumPost, max int) []ForumPost {
+	var parts []ForumPost
+	for _, text := range tok.Split(post.Text(), max) {
+		p := post
+		p.Message, p.CleanMessage = text, text
+		parts = append(parts, p)
+	}
+	return parts
+}
+
+// ---- Chunk Summary Cache ----
+// Summaries are cached by content: a post chunk by its post IDs and rendered
+// text, a reduction by the hashes it combines. Re-running a thread only calls
+// the API for chunks that are new or changed, and for the reductions above
+// them.
+const summaryModel = "gpt-4.1-2025-04-14"
+
+// Upper bound on the summaries combined by one reduction call
+const summaryFanIn = 8
+
+// Tokens of posts per chunk, and of summaries per reduction. Small chunks
+// keep the summaries detailed.
+const summaryChunkTokens = 3000
+
+type summaryNode struct {
+	Hash      string
+	Summary   string
+	Citations []Citation // nil for summaries without any
+}
+
+func renderChunk(posts []ForumPost) string {
 	var builder strings.Builder
 	for _, post := range posts {
-		fmt.Fprintf(&builder, "%s:\n%s\n", post.User, post.Message)
+		fmt.Fprintf(&builder, "%s (%s) [%s]:\n%s\n", post.User, post.PostID, FormatWorldTime(post.Timestamp), post.Text())
+	}
+	return builder.String()
+}
+
+func chunkHash(posts []ForumPost, chunkText string) string {
+	h := sha256.New()
+	for _, p := range posts {
+		io.WriteString(h, p.PostID+"\n")
+	}
+	io.WriteString(h, "\x00"+chunkText)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Reductions with different prompts get different hashes, so a board
+// roll-up never picks up a thread reduction of the same summaries.
+func reductionHash(level int, prompt string, children []summaryNode) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "level %d\n%s\n", level, prompt)
+	for _, c := range children {
+		io.WriteString(h, c.Hash+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func getCachedSummary(db *sql.DB, hash string) (string, bool) {
+	node, ok := getCachedNode(db, hash)
+	return node.Summary, ok
+}
+
+func getCachedNode(db *sql.DB, hash string) (summaryNode, bool) {
+	node := summaryNode{Hash: hash}
+	var citations sql.NullString
+	if err := db.QueryRow(`SELECT summary, citations FROM chunk_summaries WHERE hash = ?`, hash).Scan(&node.Summary, &citations); err != nil {
+		return node, false
+	}
+	node.Citations = decodeCitations(citations)
+	return node, true
+}
+
+func saveCachedSummary(db *sql.DB, hash string, level int, threadPath string, postIDs, children []string, summary string, citations []Citation) error {
+	var idsJSON, childrenJSON []byte
+	if postIDs != nil {
+		idsJSON, _ = json.Marshal(postIDs)
+	}
+	if children != nil {
+		childrenJSON, _ = json.Marshal(children)
+	}
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO chunk_summaries (hash, level, thread_path, post_ids, children, summary, citations, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, hash, level, threadPath, string(idsJSON), string(childrenJSON), summary, encodeCitations(citations), time.Now().Unix())
+	return err
+}
+
+func complete(client *openai.Client, systemPrompt, prompt string) (string, error) {
+	req := openai.ChatCompletionRequest{
+		Model: summaryModel,
+		Messages: []openai.ChatCompletionMessage{
+			{Role: openai.ChatMessageRoleSystem, Content: systemPrompt},
+			{Role: openai.ChatMessageRoleUser, Content: prompt},
+		},
 	}
-	chunkText := builder.String()
+	resp, err := client.CreateChatCompletion(context.Background(), req)
+	if err != nil {
+		return "", err
+	}
+	return resp.Choices[0].Message.Content, nil
+}
 
-	systemPrompt := "You are a skilled fantasy forum summarizer."
+const chunkSystemPrompt = "You are a skilled fantasy forum summarizer."
+
+func chunkPrompt(chunkText string) string {
+	return "Summarize the following forum thread section as if you are explaining the key events. Keep the summaries close to the original tone and feel of the original posts.\n\n" + citationInstructions + "\n\nThread Section:\n" + chunkText
+}
+
+// saveSummarizationContext records a chunk for a later batch run. A chunk
+// that already has a context keeps it, unless that one failed, and a chunk
+// that is already in the cache is recorded as done.
+func saveSummarizationContext(db *sql.DB, hash, threadPath string, postIDs []string, chunkText string) (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT id FROM summarization_contexts WHERE chunk_hash = ? AND status != 'failed' ORDER BY id LIMIT 1`, hash).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	status, summary, citations := "pending", sql.NullString{}, sql.NullString{}
+	if cached, ok := getCachedNode(db, hash); ok {
+		status, summary, citations = "done", sql.NullString{String: cached.Summary, Valid: true}, encodeCitations(cached.Citations)
+	}
+	idsJSON, _ := json.Marshal(postIDs)
+	res, err := db.Exec(`INSERT INTO summarization_contexts (prompt, chunk_text, chunk_hash, thread_path, post_ids, status, summary, citations) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		chunkSystemPrompt, chunkText, hash, threadPath, string(idsJSON), status, summary, citations)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// --- Generate a summary for a chunk of posts ---
+func SummarizeChunk(db *sql.DB, client *openai.Client, posts []ForumPost, dryRun bool) (string, error) {
+	node, _, err := summarizeChunkNode(db, client, posts, dryRun)
+	return node.Summary, err
+}
+
+// summarizeChunkNode also reports whether the summary came from the cache.
+// In dry-run mode the summary is the ID of the saved context instead.
+func summarizeChunkNode(db *sql.DB, client *openai.Client, posts []ForumPost, dryRun bool) (summaryNode, bool, error) {
+	chunkText := renderChunk(posts)
+	node := summaryNode{Hash: chunkHash(posts, chunkText)}
+	if cached, ok := getCachedNode(db, node.Hash); ok && !dryRun {
+		return cached, true, nil
+	}
+
+	postIDs := make([]string, len(posts))
+	for i, p := range posts {
+		postIDs[i] = p.PostID
+	}
 
 	if dryRun {
 		fmt.Println("Dry run mode: not sending to OpenAI")
-		res, err := db.Exec(`INSERT INTO summarization_contexts (prompt, chunk_text) VALUES (?, ?)`, systemPrompt, chunkText)
+		id, err := saveSummarizationContext(db, node.Hash, posts[0].ThreadPath, postIDs, chunkText)
 		if err != nil {
-			return "", fmt.Errorf("failed to save dry run context: %w", err)
+			return node, false, fmt.Errorf("failed to save dry run context: %w", err)
 		}
-		id, _ := res.LastInsertId()
 		fmt.Printf("Dry run context saved with ID %d\n", id)
-		return fmt.Sprintf("%d", id), nil
-	} else {
-		prompt := fmt.Sprintf(
-			"Summarize the following forum thread section as if you are explaining the key events. Keep the summaries close to the original tone and feel of the original posts.\n\nThread Section:\n%s", chunkText,
-		)
-
-		req := openai.ChatCompletionRequest{
-			Model: "gpt-4.1-2025-04-14",
-			Messages: []openai.ChatCompletionMessage{
-				{Role: openai.ChatMessageRoleSystem, Content: systemPrompt},
-				{Role: openai.ChatMessageRoleUser, Content: prompt},
-			},
-		}
-		resp, err := client.CreateChatCompletion(context.Background(), req)
-		if err != nil {
-			return "", err
+		node.Summary = fmt.Sprintf("%d", id)
+		return node, false, nil
+	}
+	summary, citations, err := completeCited(client, chunkSystemPrompt, chunkPrompt(chunkText), postIDSet(posts))
+	if err != nil {
+		return node, false, err
+	}
+	node.Summary, node.Citations = summary, citations
+	if err := saveCachedSummary(db, node.Hash, 0, posts[0].ThreadPath, postIDs, nil, summary, citations); err != nil {
+		fmt.Printf("Failed to cache chunk summary: %v\n", err)
+	}
+	return node, false, nil
+}
+
+// groupSummaries splits one level of the tree into groups of at most
+// summaryFanIn summaries and roughly maxTokens tokens.
+func groupSummaries(nodes []summaryNode, maxTokens int) [][]summaryNode {
+	tok := TokenizerFor(summaryModel)
+	var groups [][]summaryNode
+	var current []summaryNode
+	currentTokens := 0
+	for _, n := range nodes {
+		size := tok.Count(n.Summary)
+		if len(current) > 0 && (len(current) >= summaryFanIn || currentTokens+size > maxTokens) {
+			groups = append(groups, current)
+			current, currentTokens = nil, 0
 		}
-		return resp.Choices[0].Message.Content, nil
+		current = append(current, n)
+		currentTokens += size
 	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+	// A lone summary left at the end would just be copied up a level
+	if last := len(groups) - 1; last > 0 && len(groups[last]) == 1 && len(groups[last-1]) < summaryFanIn {
+		groups[last-1] = append(groups[last-1], groups[last][0])
+		groups = groups[:last]
+	}
+	return groups
+}
+
+const threadReducePrompt = "Combine these consecutive thread section summaries, in order, into one concise but thorough summary:"
+
+// reduceSummaries combines summaries level by level until one is left,
+// prefixing each reduction with prompt. path is recorded with cached
+// reductions. Groups with citations are reduced into cited summaries.
+func reduceSummaries(db *sql.DB, client *openai.Client, path string, nodes []summaryNode, maxTokens int, prompt string) (summaryNode, error) {
+	systemPrompt := "You are a skilled fantasy forum summarizer. Your task is to combine multiple summaries into one concise but thorough summary."
+	for level := 1; len(nodes) > 1; level++ {
+		groups := groupSummaries(nodes, maxTokens)
+		fmt.Printf("Reducing %d summaries into %d (level %d)\n", len(nodes), len(groups), level)
+		next := make([]summaryNode, 0, len(groups))
+		for _, group := range groups {
+			if len(group) == 1 {
+				next = append(next, group[0])
+				continue
+			}
+			node := summaryNode{Hash: reductionHash(level, prompt, group)}
+			if cached, ok := getCachedNode(db, node.Hash); ok {
+				next = append(next, cached)
+				continue
+			}
+			cited := hasCitations(group)
+			input := prompt + "\n\n"
+			if cited {
+				input += citationInstructions + "\n\n"
+			}
+			children := make([]string, len(group))
+			known := make(map[string]bool)
+			for i, c := range group {
+				input += renderCited(c) + "\n\n"
+				children[i] = c.Hash
+				for _, citation := range c.Citations {
+					for _, id := range citation.PostIDs {
+						known[id] = true
+					}
+				}
+			}
+			var err error
+			if cited {
+				node.Summary, node.Citations, err = completeCited(client, systemPrompt, input, known)
+			} else {
+				node.Summary, err = complete(client, systemPrompt, input)
+			}
+			if err != nil {
+				return summaryNode{}, err
+			}
+			if err := saveCachedSummary(db, node.Hash, level, path, nil, children, node.Summary, node.Citations); err != nil {
+				fmt.Printf("Failed to cache summary: %v\n", err)
+			}
+			next = append(next, node)
+		}
+		nodes = next
+	}
+	return nodes[0], nil
 }
 
 // --- Summarize a whole thread ---
-func SummarizeThread(db *sql.DB, client *openai.Client, threadPath string, maxChars int, dryRun bool, posts []ForumPost) (string, error) {
+// Chunks are summarized and then reduced as a tree with bounded fan-in, so
+// the size of any single prompt does not grow with the thread. The
+// citations pair each point of the summary with the posts behind it.
+func SummarizeThread(db *sql.DB, client *openai.Client, threadPath string, maxTokens int, dryRun bool, posts []ForumPost) (string, []Citation, error) {
 	if len(posts) == 0 {
-		return "(No posts in thread)", nil
+		return "(No posts in thread)", nil, nil
 	}
 
-	chunks := ChunkPosts(posts, maxChars)
-	var summaries []string
+	chunks := ChunkPosts(posts, ChunkOptions{Model: summaryModel, MaxTokens: maxTokens, Overlap: ChunkOverlap})
+	var nodes []summaryNode
+	cached := 0
 	for idx, chunk := range chunks {
-		fmt.Printf("Summarizing chunk %d/%d for thread: %s\n", idx+1, len(chunks), threadPath)
-		summary, err := SummarizeChunk(db, client, chunk, dryRun)
+		node, hit, err := summarizeChunkNode(db, client, chunk, dryRun)
 		if err != nil {
-			return "", err
+			return "", nil, err
+		}
+		if hit {
+			cached++
+		} else {
+			fmt.Printf("Summarized chunk %d/%d for thread: %s\n", idx+1, len(chunks), threadPath)
 		}
-		summaries = append(summaries, summary)
+		nodes = append(nodes, node)
 	}
-
-	systemPrompt := "You are a skilled fantasy forum summarizer. Your task is to combine multiple summaries into one concise but thorough summary for the entire thread."
 	if dryRun {
+		// Reductions need real chunk summaries; record the chunk contexts only
 		fmt.Println("Dry run mode: not sending final summary to OpenAI")
-		ids := strings.Join(summaries, ",")
-		res, err := db.Exec(`INSERT INTO summarized_thread_contexts (prompt, thread_path, ids) VALUES (?, ?, ?)`, systemPrompt, threadPath, ids)
+		ids := make([]string, len(nodes))
+		for i, n := range nodes {
+			ids[i] = n.Summary
+		}
+		systemPrompt := "You are a skilled fantasy forum summarizer. Your task is to combine multiple summaries into one concise but thorough summary for the entire thread."
+		res, err := db.Exec(`INSERT INTO summarized_thread_contexts (prompt, thread_path, ids) VALUES (?, ?, ?)`, systemPrompt, threadPath, strings.Join(ids, ","))
 		if err != nil {
-			return "", fmt.Errorf("failed to save dry run context: %w", err)
+			return "", nil, fmt.Errorf("failed to save dry run context: %w", err)
 		}
 		id, _ := res.LastInsertId()
 		fmt.Printf("Dry run context saved with ID %d\n", id)
-		return fmt.Sprintf("%d", id), nil
-	} else {
-		if len(summaries) == 1 {
-			return summaries[0], nil
-		}
-		finalPrompt := "Combine these thread section summaries into one concise but thorough summary for the entire thread:\n\n"
-		for _, s := range summaries {
-			finalPrompt += s + "\n"
-		}
-		req := openai.ChatCompletionRequest{
-			Model: "gpt-4.1-2025-04-14",
-			Messages: []openai.ChatCompletionMessage{
-				{Role: openai.ChatMessageRoleSystem, Content: "You are a skilled fantasy forum summarizer."},
-				{Role: openai.ChatMessageRoleUser, Content: finalPrompt},
-			},
-		}
-		resp, err := client.CreateChatCompletion(context.Background(), req)
-		if err != nil {
-			return "", err
+		return fmt.Sprintf("%d", id), nil, nil
+	}
+	fmt.Printf("%d of %d chunks were already summarized\n", cached, len(chunks))
+	root, err := reduceSummaries(db, client, threadPath, nodes, maxTokens, threadReducePrompt)
+	if err != nil {
+		return "", nil, err
+	}
+	return root.Summary, root.Citations, nil
+}
+
+// ---- Stored Thread Summaries ----
+// The latest summary per thread (or summarized prefix), with the posts it
+// covered, so changed threads can be found and refreshed later.
+type ThreadSummary struct {
+	ThreadPath   string
+	Summary      string
+	Citations    []Citation
+	LastPostAt   int64
+	PostCount    int
+	SummarizedAt int64
+	IngestRun    int64
+}
+
+func SaveThreadSummary(db *sql.DB, threadPath, summary string, citations []Citation, posts []ForumPost) error {
+	var last int64
+	for _, p := range posts {
+		if p.Timestamp > last {
+			last = p.Timestamp
+		}
+	}
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO thread_summaries (thread_path, summary, citations, last_post_at, post_count, summarized_at, ingest_run)
+		VALUES (?, ?, ?, ?, ?, ?, (SELECT COALESCE(MAX(id), 0) FROM ingest_runs))
+	`, threadPath, summary, encodeCitations(citations), last, len(posts), time.Now().Unix())
+	return err
+}
+
+func GetThreadSummary(db *sql.DB, threadPath string) (*ThreadSummary, error) {
+	var s ThreadSummary
+	var citations sql.NullString
+	err := db.QueryRow(`SELECT thread_path, summary, citations, last_post_at, post_count, summarized_at, ingest_run FROM thread_summaries WHERE thread_path = ?`, threadPath).
+		Scan(&s.ThreadPath, &s.Summary, &citations, &s.LastPostAt, &s.PostCount, &s.SummarizedAt, &s.IngestRun)
+	if err != nil {
+		return nil, err
+	}
+	s.Citations = decodeCitations(citations)
+	return &s, nil
+}
+
+// A stored summary that no longer matches its posts
+type StaleSummary struct {
+	ThreadSummary
+	Reason string
+}
+
+// FindStaleThreadSummaries compares stored summaries under prefix with the
+// posts they cover now. Edits keep the count and newest timestamp, so posts
+// changed by a later ingest run count as well.
+func FindStaleThreadSummaries(db *sql.DB, prefix string) ([]StaleSummary, error) {
+	rows, err := db.Query(`
+		SELECT s.thread_path, s.last_post_at, s.post_count, s.summarized_at, s.ingest_run,
+			(SELECT COUNT(*) FROM forum_posts p WHERE p.thread_path LIKE s.thread_path || '%'),
+			(SELECT COALESCE(MAX(p.timestamp), 0) FROM forum_posts p WHERE p.thread_path LIKE s.thread_path || '%'),
+			(SELECT COUNT(*) FROM ingest_changes c WHERE c.run_id > s.ingest_run AND c.thread_path LIKE s.thread_path || '%')
+		FROM thread_summaries s
+		WHERE s.thread_path LIKE ?
+		ORDER BY s.thread_path
+	`, prefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stale []StaleSummary
+	for rows.Next() {
+		var s StaleSummary
+		var count, changes int
+		var last int64
+		if err := rows.Scan(&s.ThreadPath, &s.LastPostAt, &s.PostCount, &s.SummarizedAt, &s.IngestRun, &count, &last, &changes); err != nil {
+			return nil, err
 		}
-		return resp.Choices[0].Message.Content, nil
+		switch {
+		case count != s.PostCount:
+			s.Reason = fmt.Sprintf("%d posts, summary covers %d", count, s.PostCount)
+		case last != s.LastPostAt:
+			s.Reason = fmt.Sprintf("newest post %s, summary covers up to %s", formatPostDate(last), formatPostDate(s.LastPostAt))
+		case changes > 0:
+			s.Reason = fmt.Sprintf("%d post changes since %s", changes, time.Unix(s.SummarizedAt, 0).Format("2006-01-02 15:04"))
+		default:
+			continue
+		}
+		stale = append(stale, s)
 	}
+	return stale, rows.Err()
 }
 
 func Summarize(dryRun bool, threadPath string) {
@@ -213,22 +590,75 @@ func Summarize(dryRun bool, threadPath string) {
 	}
 	defer db.Close()
 
-	if err := ensureTables(db); err != nil {
-		log.Fatalf("failed to migrate: %v", err)
-	}
-
 	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
 	flag.Parse()
-	maxChars := 10000000
 
 	posts, err := GetPostsByThreadPrefix(db, threadPath)
 	if err != nil {
 		log.Fatalf("failed to get posts for thread %s: %v", threadPath, err)
 	}
 
-	summary, err := SummarizeThread(db, client, threadPath, maxChars, dryRun, posts)
+	summary, citations, err := SummarizeThread(db, client, threadPath, summaryChunkTokens, dryRun, posts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if !dryRun && len(posts) > 0 {
+		if err := SaveThreadSummary(db, threadPath, summary, citations, posts); err != nil {
+			log.Printf("Failed to save thread summary: %v", err)
+		}
+	}
+	if len(citations) > 0 {
+		summary = FormatCitations(citations)
+	}
 	fmt.Printf("\n=== Thread Summary ===\n%s\n", summary)
 }
+
+// SummarizeStale re-summarizes the stored summaries under prefix whose posts
+// changed. With dryRun it only lists them.
+func SummarizeStale(dryRun bool, prefix string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to connect db: %v", err)
+	}
+	defer db.Close()
+
+	stale, err := FindStaleThreadSummaries(db, prefix)
+	if err != nil {
+		log.Fatalf("failed to check summaries: %v", err)
+	}
+	if len(stale) == 0 {
+		fmt.Println("All thread summaries are up to date.")
+		return
+	}
+	fmt.Printf("%d stale thread summaries:\n", len(stale))
+	for _, s := range stale {
+		fmt.Printf("  %s: %s\n", s.ThreadPath, s.Reason)
+	}
+	if dryRun {
+		return
+	}
+
+	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+	for i, s := range stale {
+		fmt.Printf("\n[%d/%d] Refreshing %s\n", i+1, len(stale), s.ThreadPath)
+		posts, err := GetPostsByThreadPrefix(db, s.ThreadPath)
+		if err != nil {
+			log.Fatalf("failed to get posts for thread %s: %v", s.ThreadPath, err)
+		}
+		if len(posts) == 0 {
+			// Every post is gone; drop the summary rather than keep describing them
+			if _, err := db.Exec(`DELETE FROM thread_summaries WHERE thread_path = ?`, s.ThreadPath); err != nil {
+				log.Printf("Failed to remove summary: %v", err)
+			}
+			continue
+		}
+		summary, citations, err := SummarizeThread(db, client, s.ThreadPath, summaryChunkTokens, false, posts)
+		if err != nil {
+			log.Printf("Failed to summarize %s: %v", s.ThreadPath, err)
+			continue
+		}
+		if err := SaveThreadSummary(db, s.ThreadPath, summary, citations, posts); err != nil {
+			log.Printf("Failed to save thread summary: %v", err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGroupSummariesFanIn(t *testing.T) {
+	nodes := make([]summaryNode, 17)
+	for i := range nodes {
+		nodes[i] = summaryNode{Hash: fmt.Sprint(i), Summary: "a"} // one token
+	}
+	var sizes []int
+	for _, g := range groupSummaries(nodes, 1<<20) {
+		sizes = append(sizes, len(g))
+	}
+	// 8 + 8 + 1: the lone last summary cannot join a full group
+	if fmt.Sprint(sizes) != "[8 8 1]" {
+		t.Errorf("group sizes = %v", sizes)
+	}
+	sizes = nil
+	for _, g := range groupSummaries(nodes[:9], 2) {
+		sizes = append(sizes, len(g))
+	}
+	if fmt.Sprint(sizes) != "[2 2 2 3]" {
+		t.Errorf("group sizes with a token limit = %v", sizes)
+	}
+}
+
+func TestSummarizeThreadFromCache(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	var posts []ForumPost
+	for i := 0; i < 4; i++ {
+		posts = append(posts, ForumPost{PostID: fmt.Sprintf("post-%d", i), User: "Puck", Timestamp: 1459729209,
+			Message: strings.Repeat("word ", 20), ThreadPath: "board/threads/a"})
+	}
+	// A budget of one post per chunk
+	budget := TokenizerFor(summaryModel).Count(renderChunk(posts[:1]))
+	chunks := ChunkPosts(posts, ChunkOptions{Model: summaryModel, MaxTokens: budget})
+	if len(chunks) != 4 {
+		t.Fatalf("expected 4 chunks, got %d", len(chunks))
+	}
+	var nodes []summaryNode
+	for i, c := range chunks {
+		n := summaryNode{Hash: chunkHash(c, renderChunk(c)), Summary: fmt.Sprintf("part %d", i)}
+		saveCachedSummary(db, n.Hash, 0, "board/threads/a", []string{c[0].PostID}, nil, n.Summary, nil)
+		nodes = append(nodes, n)
+	}
+	saveCachedSummary(db, reductionHash(1, threadReducePrompt, nodes), 1, "board/threads/a", nil, nil, "the whole thread", nil)
+
+	// Everything is cached, so no client is needed
+	summary, _, err := SummarizeThread(db, nil, "board/threads/a", budget, false, posts)
+	if err != nil || summary != "the whole thread" {
+		t.Errorf("summary = %q, %v", summary, err)
+	}
+}
+
+func TestFindStaleThreadSummaries(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(tmp, "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	forum := filepath.Join(tmp, "forum") + "/"
+	post := `"post-%d": {"user": "Puck", "user_num": 42, "timestamp": "%d", "message": "%s"}`
+	writeThread := func(name string, posts ...string) {
+		writePostsFile(t, forum, "board/threads/"+name, "{"+strings.Join(posts, ",")+"}")
+	}
+	scrape := func() {
+		if _, err := ScrapeAndInsertPosts(context.Background(), db, forum, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeThread("a", fmt.Sprintf(post, 1, 1459729209, "One."))
+	writeThread("b", fmt.Sprintf(post, 2, 1459729209, "Two."))
+	writeThread("c", fmt.Sprintf(post, 3, 1459729209, "Three."))
+	scrape()
+	for _, name := range []string{"a", "b", "c"} {
+		posts, _ := GetPostsByThread(db, "board/threads/"+name)
+		if err := SaveThreadSummary(db, "board/threads/"+name, "summary", nil, posts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stale, _ := FindStaleThreadSummaries(db, ""); len(stale) != 0 {
+		t.Fatalf("fresh summaries reported stale: %+v", stale)
+	}
+
+	// a gets a reply, b an edit, c stays as it was
+	writeThread("a", fmt.Sprintf(post, 1, 1459729209, "One."), fmt.Sprintf(post, 4, 1459729309, "Four."))
+	writeThread("b", fmt.Sprintf(post, 2, 1459729209, "Two, edited."))
+	scrape()
+	stale, err := FindStaleThreadSummaries(db, "board/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale) != 2 || stale[0].ThreadPath != "board/threads/a" || stale[1].ThreadPath != "board/threads/b" {
+		t.Fatalf("stale = %+v", stale)
+	}
+	if stale[0].Reason != "2 posts, summary covers 1" || !strings.HasPrefix(stale[1].Reason, "1 post changes") {
+		t.Errorf("reasons = %q, %q", stale[0].Reason, stale[1].Reason)
+	}
+}
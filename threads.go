@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ---- Boards and Threads ----
+// Derived from the forum directory hierarchy, e.g.
+// governments/isran-empire/land-tillers-state/threads/land-tillers-tribe-overview
+// is thread "land-tillers-tribe-overview" on board governments/isran-empire/land-tillers-state.
+type Board struct {
+	BoardPath  string
+	Slug       string
+	Title      string
+	ParentPath string // "" for top-level categories (governments, overworld, ...)
+	Depth      int
+	URL        string
+	BoardNum   int
+}
+
+type Thread struct {
+	ThreadPath   string
+	BoardPath    string
+	Slug         string
+	Title        string
+	URL          string
+	ThreadNum    int
+	FirstPostAt  int64
+	LastPostAt   int64
+	Participants []string // in order of first appearance
+	PostCount    int
+}
+
+// SplitThreadPath returns the board path and thread slug for a thread path.
+func SplitThreadPath(threadPath string) (boardPath, slug string) {
+	if idx := strings.LastIndex(threadPath, "/threads/"); idx >= 0 {
+		return threadPath[:idx], threadPath[idx+len("/threads/"):]
+	}
+	if strings.HasSuffix(threadPath, "/threads") {
+		// Threads whose URL had no slug end up directly in the threads directory
+		return strings.TrimSuffix(threadPath, "/threads"), ""
+	}
+	return filepath.Dir(threadPath), filepath.Base(threadPath)
+}
+
+// titleFromSlug is the fallback title for boards and for threads whose
+// source had no title
+func titleFromSlug(slug string) string {
+	words := strings.Fields(strings.ReplaceAll(slug, "-", " "))
+	for i, w := range words {
+		r, size := utf8.DecodeRuneInString(w)
+		words[i] = string(unicode.ToUpper(r)) + w[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+// sourceTitles returns the titles the ingested sources gave their threads
+func sourceTitles(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query(`SELECT thread_path, title FROM ingest_manifest WHERE title != '' ORDER BY file_path`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	titles := make(map[string]string)
+	for rows.Next() {
+		var threadPath, title string
+		if err := rows.Scan(&threadPath, &title); err != nil {
+			return nil, err
+		}
+		titles[threadPath] = title
+	}
+	return titles, rows.Err()
+}
+
+// ---- URL index from data/tfs/data/*.json ----
+// Each file is a node: a list whose elements are either {boardURL: node} maps
+// (sub-boards) or a list of thread URLs on that board.
+type ForumURLIndex struct {
+	Boards  map[string]string // board_path -> url
+	Threads map[string]string // thread_path -> url
+}
+
+func LoadForumURLIndex(dataDir string) (*ForumURLIndex, error) {
+	index := &ForumURLIndex{Boards: make(map[string]string), Threads: make(map[string]string)}
+	files, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var node []json.RawMessage
+		if err := json.Unmarshal(data, &node); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", f, err)
+		}
+		category := strings.TrimSuffix(filepath.Base(f), ".json")
+		if err := index.walk(category, node); err != nil {
+			return nil, fmt.Errorf("error walking %s: %w", f, err)
+		}
+	}
+	return index, nil
+}
+
+func (idx *ForumURLIndex) walk(prefix string, node []json.RawMessage) error {
+	for _, el := range node {
+		var boards map[string][]json.RawMessage
+		if err := json.Unmarshal(el, &boards); err == nil {
+			for boardURL, sub := range boards {
+				_, slug := urlNumAndSlug(boardURL)
+				boardPath := prefix + "/" + slug
+				idx.Boards[boardPath] = boardURL
+				if err := idx.walk(boardPath, sub); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		var threads []string
+		if err := json.Unmarshal(el, &threads); err != nil {
+			return err
+		}
+		for _, threadURL := range threads {
+			_, slug := urlNumAndSlug(threadURL)
+			threadPath := prefix + "/threads"
+			if slug != "" {
+				threadPath += "/" + slug
+			}
+			idx.Threads[threadPath] = threadURL
+		}
+	}
+	return nil
+}
+
+// urlNumAndSlug parses .../board/63/isran-empire or .../thread/1409/some-slug
+func urlNumAndSlug(u string) (int, string) {
+	parts := strings.Split(strings.TrimRight(u, "/"), "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		if n, err := strconv.Atoi(parts[i]); err == nil {
+			slug := ""
+			if i+1 < len(parts) {
+				slug = parts[i+1]
+			}
+			return n, slug
+		}
+	}
+	return 0, parts[len(parts)-1]
+}
+
+// ---- Rebuild boards/threads from forum_posts ----
+func RebuildBoardsAndThreads(db *sql.DB, dataDir string) error {
+	index, err := LoadForumURLIndex(dataDir)
+	if err != nil {
+		fmt.Printf("Warning: could not load forum URL index: %v\n", err)
+		index = &ForumURLIndex{Boards: map[string]string{}, Threads: map[string]string{}}
+	}
+
+	threads, err := aggregateThreads(db)
+	if err != nil {
+		return err
+	}
+	titles, err := sourceTitles(db)
+	if err != nil {
+		return err
+	}
+
+	boards := make(map[string]*Board)
+	addBoard := func(boardPath string) {
+		for p := boardPath; p != "" && p != "."; p = parentBoardPath(p) {
+			if _, ok := boards[p]; ok {
+				break // ancestors were added along with it
+			}
+			slug := filepath.Base(p)
+			b := &Board{
+				BoardPath:  p,
+				Slug:       slug,
+				Title:      titleFromSlug(slug),
+				ParentPath: parentBoardPath(p),
+				Depth:      strings.Count(p, "/"),
+				URL:        index.Boards[p],
+			}
+			if b.URL != "" {
+				b.BoardNum, _ = urlNumAndSlug(b.URL)
+			}
+			boards[p] = b
+		}
+	}
+	for p := range index.Boards {
+		addBoard(p)
+	}
+	for _, t := range threads {
+		addBoard(t.BoardPath)
+		t.URL = index.Threads[t.ThreadPath]
+		if t.URL != "" {
+			t.ThreadNum, _ = urlNumAndSlug(t.URL)
+		}
+		if title, ok := titles[t.ThreadPath]; ok {
+			t.Title = title
+		}
+		if t.Title == "" {
+			t.Title = fmt.Sprintf("Thread %d", t.ThreadNum)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM boards; DELETE FROM threads;`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, b := range boards {
+		_, err := tx.Exec(`INSERT INTO boards (board_path, slug, title, parent_path, depth, url, board_num) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			b.BoardPath, b.Slug, b.Title, b.ParentPath, b.Depth, b.URL, b.BoardNum)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("insert board %s: %w", b.BoardPath, err)
+		}
+	}
+	for _, t := range threads {
+		participants, _ := json.Marshal(t.Participants)
+		_, err := tx.Exec(`
+			INSERT INTO threads (thread_path, board_path, slug, title, url, thread_num, first_post_at, last_post_at, participants, post_count)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, t.ThreadPath, t.BoardPath, t.Slug, t.Title, t.URL, t.ThreadNum, t.FirstPostAt, t.LastPostAt, string(participants), t.PostCount)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("insert thread %s: %w", t.ThreadPath, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d boards and %d threads.\n", len(boards), len(threads))
+	return nil
+}
+
+func parentBoardPath(boardPath string) string {
+	if idx := strings.LastIndex(boardPath, "/"); idx >= 0 {
+		return boardPath[:idx]
+	}
+	return ""
+}
+
+func aggregateThreads(db *sql.DB) ([]*Thread, error) {
+	rows, err := db.Query(`
+		SELECT thread_path, MIN(timestamp), MAX(timestamp), COUNT(*)
+		FROM forum_posts
+		GROUP BY thread_path
+	`)
+	if err != nil {
+		return nil, err
+	}
+	byPath := make(map[string]*Thread)
+	var threads []*Thread
+	for rows.Next() {
+		t := &Thread{}
+		if err := rows.Scan(&t.ThreadPath, &t.FirstPostAt, &t.LastPostAt, &t.PostCount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		t.BoardPath, t.Slug = SplitThreadPath(t.ThreadPath)
+		t.Title = titleFromSlug(t.Slug)
+		byPath[t.ThreadPath] = t
+		threads = append(threads, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Participants in order of their first post in the thread
+	rows, err = db.Query(`
+		SELECT thread_path, user, MIN(timestamp) AS first_seen
+		FROM forum_posts
+		GROUP BY thread_path, user
+		ORDER BY thread_path, first_seen
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var threadPath, user string
+		var firstSeen int64
+		if err := rows.Scan(&threadPath, &user, &firstSeen); err != nil {
+			return nil, err
+		}
+		if t, ok := byPath[threadPath]; ok && user != "" {
+			t.Participants = append(t.Participants, user)
+		}
+	}
+	sort.Slice(threads, func(i, j int) bool { return threads[i].ThreadPath < threads[j].ThreadPath })
+	return threads, rows.Err()
+}
+
+// ---- Queries ----
+func scanThread(scan func(dest ...interface{}) error) (*Thread, error) {
+	var t Thread
+	var participants string
+	err := scan(&t.ThreadPath, &t.BoardPath, &t.Slug, &t.Title, &t.URL, &t.ThreadNum,
+		&t.FirstPostAt, &t.LastPostAt, &participants, &t.PostCount)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(participants), &t.Participants)
+	return &t, nil
+}
+
+const threadColumns = `thread_path, board_path, slug, title, url, thread_num, first_post_at, last_post_at, participants, post_count`
+
+func GetThread(db *sql.DB, threadPath string) (*Thread, error) {
+	row := db.QueryRow(`SELECT `+threadColumns+` FROM threads WHERE thread_path = ?`, threadPath)
+	return scanThread(row.Scan)
+}
+
+// GetThreadsUnderBoard returns all threads on a board and its sub-boards.
+func GetThreadsUnderBoard(db *sql.DB, boardPath string) ([]*Thread, error) {
+	rows, err := db.Query(`SELECT `+threadColumns+` FROM threads WHERE board_path = ? OR board_path LIKE ? ORDER BY first_post_at ASC`,
+		boardPath, boardPath+"/%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var threads []*Thread
+	for rows.Next() {
+		t, err := scanThread(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, t)
+	}
+	return threads, rows.Err()
+}
+
+func GetChildBoards(db *sql.DB, parentPath string) ([]Board, error) {
+	rows, err := db.Query(`SELECT board_path, slug, title, parent_path, depth, url, board_num FROM boards WHERE parent_path = ? ORDER BY board_path`, parentPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var boards []Board
+	for rows.Next() {
+		var b Board
+		if err := rows.Scan(&b.BoardPath, &b.Slug, &b.Title, &b.ParentPath, &b.Depth, &b.URL, &b.BoardNum); err != nil {
+			return nil, err
+		}
+		boards = append(boards, b)
+	}
+	return boards, rows.Err()
+}
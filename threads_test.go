@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRebuildBoardsAndThreads(t *testing.T) {
+	db := openTestDB(t)
+	dataDir := t.TempDir()
+	index := `[
+		{"https://tfs.boards.net/board/63/isran-empire": [
+			{"https://tfs.boards.net/board/64/isra-free-city": [
+				["https://tfs.boards.net/thread/1409/midnight-sun"]
+			]},
+			["https://tfs.boards.net/thread/1500/court", "https://tfs.boards.net/thread/1600"]
+		]}
+	]`
+	if err := os.WriteFile(filepath.Join(dataDir, "overworld.json"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const (
+		midnightSun = "overworld/isran-empire/isra-free-city/threads/midnight-sun"
+		court       = "overworld/isran-empire/threads/court"
+		noSlug      = "overworld/isran-empire/threads"
+		unlisted    = "overworld/isran-empire/threads/unlisted"
+	)
+	for _, p := range []struct {
+		id, user, thread string
+		at               int64
+	}{
+		{"post-1", "Empress Naoki", midnightSun, 100},
+		{"post-2", "Puck", midnightSun, 200},
+		{"post-3", "Empress Naoki", midnightSun, 300},
+		{"post-4", "Puck", court, 50},
+		{"post-5", "Fly", noSlug, 400},
+		{"post-6", "Fly", unlisted, 500},
+	} {
+		if _, err := db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES (?, ?, 0, ?, 'x', ?)`,
+			p.id, p.user, p.at, p.thread); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A source that knows the real title
+	if _, err := db.Exec(`INSERT INTO ingest_manifest (file_path, thread_path, hash, mtime, post_count, scraped_at, title)
+		VALUES ('court.html', ?, '', 0, 1, 0, 'The Emperor''s Court')`, court); err != nil {
+		t.Fatal(err)
+	}
+
+	urls, err := LoadForumURLIndex(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls.Boards) != 2 || urls.Boards["overworld/isran-empire/isra-free-city"] != "https://tfs.boards.net/board/64/isra-free-city" {
+		t.Errorf("board URLs = %v", urls.Boards)
+	}
+	if len(urls.Threads) != 3 || urls.Threads[noSlug] != "https://tfs.boards.net/thread/1600" {
+		t.Errorf("thread URLs = %v", urls.Threads)
+	}
+
+	if err := RebuildBoardsAndThreads(db, dataDir); err != nil {
+		t.Fatal(err)
+	}
+	// The top-level category is added as the parent of the boards in it
+	top, err := GetChildBoards(db, "")
+	if err != nil || len(top) != 1 || top[0].BoardPath != "overworld" || top[0].URL != "" || top[0].Depth != 0 {
+		t.Fatalf("top-level boards = %+v, %v", top, err)
+	}
+	empire, _ := GetChildBoards(db, "overworld")
+	if len(empire) != 1 || empire[0].BoardNum != 63 || empire[0].Title != "Isran Empire" || empire[0].Depth != 1 {
+		t.Errorf("boards under overworld = %+v", empire)
+	}
+	city, _ := GetChildBoards(db, "overworld/isran-empire")
+	if len(city) != 1 || city[0].BoardNum != 64 || city[0].ParentPath != "overworld/isran-empire" || city[0].Depth != 2 {
+		t.Errorf("boards under isran-empire = %+v", city)
+	}
+
+	thread, err := GetThread(db, midnightSun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread.BoardPath != "overworld/isran-empire/isra-free-city" || thread.ThreadNum != 1409 || thread.Title != "Midnight Sun" ||
+		thread.URL != "https://tfs.boards.net/thread/1409/midnight-sun" || thread.PostCount != 3 ||
+		thread.FirstPostAt != 100 || thread.LastPostAt != 300 || strings.Join(thread.Participants, ",") != "Empress Naoki,Puck" {
+		t.Errorf("midnight sun = %+v", thread)
+	}
+	if thread, err := GetThread(db, court); err != nil || thread.Title != "The Emperor's Court" {
+		t.Errorf("court = %+v, %v", thread, err)
+	}
+	// A thread whose URL had no slug is titled by its number
+	if thread, err := GetThread(db, noSlug); err != nil || thread.Title != "Thread 1600" || thread.ThreadNum != 1600 {
+		t.Errorf("thread without a slug = %+v, %v", thread, err)
+	}
+	// One missing from the index keeps its slug title and has no link
+	if thread, err := GetThread(db, unlisted); err != nil || thread.Title != "Unlisted" || thread.URL != "" || thread.ThreadNum != 0 {
+		t.Errorf("unlisted thread = %+v, %v", thread, err)
+	}
+
+	threads, err := GetThreadsUnderBoard(db, "overworld/isran-empire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, th := range threads {
+		paths = append(paths, th.ThreadPath)
+	}
+	if strings.Join(paths, " ") != strings.Join([]string{court, midnightSun, noSlug, unlisted}, " ") {
+		t.Errorf("threads under the board = %v", paths)
+	}
+}
+
+func TestTitleFromSlug(t *testing.T) {
+	for slug, want := range map[string]string{
+		"land-tillers-tribe-overview": "Land Tillers Tribe Overview",
+		"école-d-été":                 "École D Été",
+		"":                            "",
+	} {
+		if got := titleFromSlug(slug); got != want {
+			t.Errorf("titleFromSlug(%q) = %q, want %q", slug, got, want)
+		}
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	_ "github.com/glebarez/go-sqlite"
 	"github.com/sashabaranov/go-openai"
@@ -31,38 +33,9 @@ type ConversationTimelineContext struct {
 	ChunkIDs   string // IDs of the chunk summaries (comma or JSON)
 }
 
-// --- Table migration ---
-func ensureTimelineTables(db *sql.DB) error {
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXISTS conversation_summaries (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT,
-			thread_path TEXT,
-			start INTEGER,
-			end INTEGER,
-			summary TEXT
-		)
-	`)
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS conversation_timeline_contexts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			prompt TEXT,
-			username TEXT,
-			thread_path TEXT,
-			start INTEGER,
-			end INTEGER,
-			chunk_ids TEXT
-		)
-	`)
-	return err
-}
-
 // --- Helpers ---
 func GetUserPosts(db *sql.DB, username string) ([]ForumPost, error) {
-	rows, err := db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path FROM forum_posts WHERE user = ? ORDER BY timestamp ASC`, username)
+	rows, err := db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message) FROM forum_posts WHERE user = ? ORDER BY timestamp ASC`, username)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +43,7 @@ func GetUserPosts(db *sql.DB, username string) ([]ForumPost, error) {
 	var posts []ForumPost
 	for rows.Next() {
 		var p ForumPost
-		if err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath); err != nil {
+		if err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage); err != nil {
 			return nil, err
 		}
 		posts = append(posts, p)
@@ -82,9 +55,9 @@ func GetThreadPostsBetween(db *sql.DB, threadPath string, start, end int64) ([]F
 	var rows *sql.Rows
 	var err error
 	if end > 0 && end < (1<<63-1) {
-		rows, err = db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path FROM forum_posts WHERE thread_path = ? AND timestamp >= ? AND timestamp < ? ORDER BY timestamp ASC`, threadPath, start, end)
+		rows, err = db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message) FROM forum_posts WHERE thread_path = ? AND timestamp >= ? AND timestamp < ? ORDER BY timestamp ASC`, threadPath, start, end)
 	} else {
-		rows, err = db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path FROM forum_posts WHERE thread_path = ? AND timestamp >= ? ORDER BY timestamp ASC`, threadPath, start)
+		rows, err = db.Query(`SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message) FROM forum_posts WHERE thread_path = ? AND timestamp >= ? ORDER BY timestamp ASC`, threadPath, start)
 	}
 	if err != nil {
 		return nil, err
@@ -93,7 +66,7 @@ func GetThreadPostsBetween(db *sql.DB, threadPath string, start, end int64) ([]F
 	var posts []ForumPost
 	for rows.Next() {
 		var p ForumPost
-		if err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath); err != nil {
+		if err := rows.Scan(&p.PostID, &p.User, &p.UserNum, &p.Timestamp, &p.Message, &p.ThreadPath, &p.CleanMessage); err != nil {
 			return nil, err
 		}
 		posts = append(posts, p)
@@ -104,90 +77,274 @@ func GetThreadPostsBetween(db *sql.DB, threadPath string, start, end int64) ([]F
 type Conversation struct {
 	ThreadPath string
 	Start      int64
-	End        int64
+	End        int64 // exclusive
 	Posts      []ForumPost
+	Open       bool // reaches the newest post of the thread, so it may still grow
+}
+
+// ---- Sessionization ----
+// A conversation is a session of a user in one thread. It starts at one of
+// their posts and takes in the posts around theirs until the thread goes
+// idle for MaxGap, the session would get longer than MaxLength, or, after
+// the user's last post of the session, someone outside the scene posts.
+// The scene is everyone who posted during the session, whoever the user
+// answered first and whoever answers their last post.
+type SessionOptions struct {
+	MaxGap    time.Duration
+	MaxLength time.Duration
+}
+
+// Forum roleplay replies can take days; a week of silence ends a scene
+var DefaultSessionOptions = SessionOptions{MaxGap: 7 * 24 * time.Hour, MaxLength: 60 * 24 * time.Hour}
+
+// Sessionize splits one thread's posts, oldest first, into the sessions of
+// username.
+func Sessionize(posts []ForumPost, username string, opts SessionOptions) []Conversation {
+	maxGap, maxLength := int64(opts.MaxGap/time.Second), int64(opts.MaxLength/time.Second)
+	fits := func(start, i int) bool {
+		return posts[i].Timestamp-posts[i-1].Timestamp <= maxGap && posts[i].Timestamp-posts[start].Timestamp <= maxLength
+	}
+
+	var sessions []Conversation
+	for i := 0; i < len(posts); i++ {
+		if posts[i].User != username {
+			continue
+		}
+		start := i
+		scene := map[string]bool{username: true}
+		if start > 0 {
+			scene[posts[start-1].User] = true
+		}
+		// Take in every post up to the user's last one that still fits
+		last := start
+		for j := start + 1; j < len(posts) && fits(start, j); j++ {
+			if posts[j].User == username {
+				last = j
+			}
+		}
+		for j := start; j <= last; j++ {
+			scene[posts[j].User] = true
+		}
+		// Then the replies from the scene, starting with the direct answer
+		end := last
+		for j := last + 1; j < len(posts) && fits(start, j); j++ {
+			if j > last+1 && !scene[posts[j].User] {
+				break
+			}
+			scene[posts[j].User] = true
+			end = j
+		}
+		sessions = append(sessions, Conversation{
+			ThreadPath: posts[start].ThreadPath,
+			Start:      posts[start].Timestamp,
+			End:        posts[end].Timestamp + 1,
+			Posts:      posts[start : end+1],
+			Open:       end == len(posts)-1,
+		})
+		i = end
+	}
+	return sessions
 }
 
-func FindUserConversations(db *sql.DB, username string) ([]Conversation, error) {
-	userPosts, err := GetUserPosts(db, username)
+// FindUserConversations sessionizes every thread username posted in and
+// returns the sessions oldest first.
+func FindUserConversations(db *sql.DB, username string, opts SessionOptions) ([]Conversation, error) {
+	rows, err := db.Query(`SELECT thread_path FROM forum_posts WHERE user = ? GROUP BY thread_path ORDER BY MIN(timestamp)`, username)
 	if err != nil {
 		return nil, err
 	}
-	if len(userPosts) == 0 {
-		return nil, nil
+	var threads []string
+	for rows.Next() {
+		var tp string
+		if err := rows.Scan(&tp); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		threads = append(threads, tp)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
 	var conversations []Conversation
-	for i, post := range userPosts {
-		thread := post.ThreadPath
-		startTime := post.Timestamp
+	for _, tp := range threads {
+		posts, err := GetPostsByThread(db, tp)
+		if err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, Sessionize(posts, username, opts)...)
+	}
+	sort.SliceStable(conversations, func(i, j int) bool { return conversations[i].Start < conversations[j].Start })
+	return conversations, nil
+}
+
+// ---- Resumable Timelines ----
+// A window is identified by user, thread, start and end. Summarized windows
+// are skipped on the next run, apart from open windows once posts were
+// added to them; failed windows are recorded and retried.
+const timelineContextPrompt = "You are a skilled fantasy forum summarizer. Your task is to combine multiple summaries into one concise but thorough summary for the entire conversation window."
+
+// saveConversationSummary stores or replaces the summary of a window and
+// returns its row ID. A session that grew replaces the one it started as.
+func saveConversationSummary(db *sql.DB, username string, convo Conversation, postCount int, summary string, citations []Citation) (int64, error) {
+	_, err := db.Exec(`DELETE FROM conversation_summaries WHERE username = ? AND thread_path = ? AND start = ? AND end != ?`,
+		username, convo.ThreadPath, convo.Start, convo.End)
+	if err != nil {
+		return 0, err
+	}
+	var id int64
+	err = db.QueryRow(`
+		INSERT INTO conversation_summaries (username, thread_path, start, end, summary, citations, post_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (username, thread_path, start, end) DO UPDATE SET summary = excluded.summary, citations = excluded.citations, post_count = excluded.post_count
+		RETURNING id
+	`, username, convo.ThreadPath, convo.Start, convo.End, summary, encodeCitations(citations), postCount).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.Exec(`DELETE FROM timeline_failures WHERE username = ? AND thread_path = ? AND start = ? AND end = ?`,
+		username, convo.ThreadPath, convo.Start, convo.End)
+	return id, err
+}
+
+// windowSummarized reports whether convo already has an up-to-date summary
+func windowSummarized(db *sql.DB, username string, convo Conversation) bool {
+	var postCount sql.NullInt64
+	err := db.QueryRow(`SELECT post_count FROM conversation_summaries WHERE username = ? AND thread_path = ? AND start = ? AND end = ?`,
+		username, convo.ThreadPath, convo.Start, convo.End).Scan(&postCount)
+	if err != nil {
+		return false
+	}
+	if !convo.Open {
+		return true
+	}
+	return postCount.Valid && int(postCount.Int64) == len(convo.Posts)
+}
+
+// windowContextPending reports whether a dry run already recorded convo and
+// its batch summaries have not been collected yet
+func windowContextPending(db *sql.DB, username string, convo Conversation) bool {
+	var n int
+	db.QueryRow(`SELECT COUNT(*) FROM conversation_timeline_contexts WHERE username = ? AND thread_path = ? AND start = ? AND end = ? AND summary_id IS NULL`,
+		username, convo.ThreadPath, convo.Start, convo.End).Scan(&n)
+	return n > 0
+}
+
+func recordTimelineFailure(db *sql.DB, username string, convo Conversation, failure error) {
+	_, err := db.Exec(`
+		INSERT INTO timeline_failures (username, thread_path, start, end, error, attempts, failed_at)
+		VALUES (?, ?, ?, ?, ?, 1, ?)
+		ON CONFLICT (username, thread_path, start, end) DO UPDATE SET error = excluded.error, attempts = attempts + 1, failed_at = excluded.failed_at
+	`, username, convo.ThreadPath, convo.Start, convo.End, failure.Error(), time.Now().Unix())
+	if err != nil {
+		log.Printf("Failed to record timeline failure: %v", err)
+	}
+}
+
+type TimelineFailure struct {
+	ThreadPath string
+	Start, End int64
+	Error      string
+	Attempts   int
+}
 
-		// Find end time: time of next user post, *if* in a different thread
-		endTime := int64(1<<63 - 1) // max int64
-		if i+1 < len(userPosts) && userPosts[i+1].ThreadPath != thread {
-			endTime = userPosts[i+1].Timestamp
-		} else if i+1 < len(userPosts) && userPosts[i+1].ThreadPath == thread {
-			continue // Next post is in the same thread, skip this conversation to avoid duplicate windows
+func GetTimelineFailures(db *sql.DB, username string) ([]TimelineFailure, error) {
+	rows, err := db.Query(`SELECT thread_path, start, end, error, attempts FROM timeline_failures WHERE username = ? ORDER BY start`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var failures []TimelineFailure
+	for rows.Next() {
+		var f TimelineFailure
+		if err := rows.Scan(&f.ThreadPath, &f.Start, &f.End, &f.Error, &f.Attempts); err != nil {
+			return nil, err
 		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// joinWindowSummaries puts the chunk summaries of a window together,
+// separated by --- lines, with their citations in order.
+func joinWindowSummaries(nodes []summaryNode) (string, []Citation) {
+	summaries := make([]string, len(nodes))
+	var citations []Citation
+	for i, n := range nodes {
+		summaries[i] = n.Summary
+		citations = append(citations, n.Citations...)
+	}
+	return strings.Join(summaries, "\n---\n"), citations
+}
 
-		threadPosts, err := GetThreadPostsBetween(db, thread, startTime, endTime)
+// summarizeWindow summarizes every chunk of convo. Chunks go through the
+// chunk cache, so retrying a window only pays for the chunks that failed.
+// In dry-run mode the result is the comma-separated context IDs.
+func summarizeWindow(db *sql.DB, client *openai.Client, convo Conversation, maxTokens int, dryRun bool) (string, []Citation, error) {
+	chunks := ChunkPosts(convo.Posts, ChunkOptions{Model: summaryModel, MaxTokens: maxTokens, Overlap: ChunkOverlap})
+	nodes := make([]summaryNode, 0, len(chunks))
+	for j, chunk := range chunks {
+		fmt.Printf("Summarizing chunk %d/%d...\n", j+1, len(chunks))
+		node, _, err := summarizeChunkNode(db, client, chunk, dryRun)
 		if err != nil {
-			return nil, err
+			return "", nil, fmt.Errorf("chunk %d/%d: %w", j+1, len(chunks), err)
 		}
-		if len(threadPosts) > 0 {
-			conversations = append(conversations, Conversation{
-				ThreadPath: thread,
-				Start:      startTime,
-				End:        endTime,
-				Posts:      threadPosts,
-			})
+		nodes = append(nodes, node)
+	}
+	if dryRun {
+		ids := make([]string, len(nodes))
+		for i, n := range nodes {
+			ids[i] = n.Summary
 		}
+		return strings.Join(ids, ","), nil, nil
 	}
-	return conversations, nil
+	summary, citations := joinWindowSummaries(nodes)
+	return summary, citations, nil
 }
 
 // --- Timeline Function ---
-func Timeline(dryRun bool, username string) {
+// Timeline summarizes each conversation window of username. Windows that
+// were summarized before are skipped unless force is set.
+func Timeline(dryRun, force bool, username string, opts SessionOptions) {
 	db, err := sql.Open("sqlite", "data/docs.db")
 	if err != nil {
 		log.Fatalf("failed to connect db: %v", err)
 	}
 	defer db.Close()
 
-	if err := ensureTimelineTables(db); err != nil {
-		log.Fatalf("failed to migrate: %v", err)
-	}
-
 	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-	maxChars := 100000 // safe for GPT-4o, adjust for your model
+	maxTokens := 25000 // per chunk; a whole session usually fits in one
 
-	convos, err := FindUserConversations(db, username)
+	convos, err := FindUserConversations(db, username, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(convos) == 0 {
+		log.Fatal(noPostsError(db, username))
+	}
 	fmt.Printf("Found %d conversations for user %s\n", len(convos), username)
 
+	skipped, saved, failed := 0, 0, 0
 	for i, convo := range convos {
-		fmt.Printf("\n--- Conversation %d (thread: %s, from %d to %d, %d posts) ---\n",
-			i+1, convo.ThreadPath, convo.Start, convo.End, len(convo.Posts))
-
-		chunks := ChunkPosts(convo.Posts, maxChars)
-		var summaries []string
-		for j, chunk := range chunks {
-			fmt.Printf("Summarizing chunk %d/%d...\n", j+1, len(chunks))
-			summary, err := SummarizeChunk(db, client, chunk, dryRun)
-			if err != nil {
-				log.Printf("Summarization failed: %v", err)
-				continue
-			}
-			summaries = append(summaries, summary)
+		if !force && (windowSummarized(db, username, convo) || dryRun && windowContextPending(db, username, convo)) {
+			skipped++
+			continue
+		}
+		fmt.Printf("\n--- Conversation %d (thread: %s, from %s to %s, %d posts) ---\n",
+			i+1, convo.ThreadPath, FormatWorldTime(convo.Start), FormatWorldTime(convo.Posts[len(convo.Posts)-1].Timestamp), len(convo.Posts))
+
+		summary, citations, err := summarizeWindow(db, client, convo, maxTokens, dryRun)
+		if err != nil {
+			fmt.Printf("Summarization failed: %v\n", err)
+			recordTimelineFailure(db, username, convo, err)
+			failed++
+			continue
 		}
-		summary := strings.Join(summaries, "\n---\n")
 		if dryRun {
 			res, err := db.Exec(
 				`INSERT INTO conversation_timeline_contexts (prompt, username, thread_path, start, end, chunk_ids) VALUES (?, ?, ?, ?, ?, ?)`,
-				"You are a skilled fantasy forum summarizer. Your task is to combine multiple summaries into one concise but thorough summary for the entire conversation window.",
-				username, convo.ThreadPath, convo.Start, convo.End, strings.Join(summaries, ","),
+				timelineContextPrompt, username, convo.ThreadPath, convo.Start, convo.End, summary,
 			)
 			if err != nil {
 				log.Printf("Failed to save dry run timeline context: %v", err)
@@ -195,19 +352,31 @@ func Timeline(dryRun bool, username string) {
 			}
 			id, _ := res.LastInsertId()
 			fmt.Printf("Dry run timeline context saved with ID %d\n", id)
-			fmt.Println("Chunk IDs:", strings.Join(summaries, ","))
+			fmt.Println("Chunk IDs:", summary)
+			saved++
 			continue
 		}
 		// Save actual summary to ConversationSummary table
-		_, err := db.Exec(
-			`INSERT INTO conversation_summaries (username, thread_path, start, end, summary) VALUES (?, ?, ?, ?, ?)`,
-			username, convo.ThreadPath, convo.Start, convo.End, summary,
-		)
-		if err != nil {
+		if _, err := saveConversationSummary(db, username, convo, len(convo.Posts), summary, citations); err != nil {
 			log.Printf("Failed to save summary: %v", err)
-		} else {
-			fmt.Printf("Saved summary for Conversation %d\n", i+1)
-			fmt.Println("Summary:", summary)
+			recordTimelineFailure(db, username, convo, err)
+			failed++
+			continue
+		}
+		saved++
+		fmt.Printf("Saved summary for Conversation %d\n", i+1)
+		fmt.Println("Summary:", summary)
+	}
+
+	fmt.Printf("\n%d windows summarized, %d already done, %d failed\n", saved, skipped, failed)
+	failures, err := GetTimelineFailures(db, username)
+	if err != nil {
+		log.Printf("Failed to list timeline failures: %v", err)
+	}
+	if len(failures) > 0 {
+		fmt.Println("Failed windows (run again to retry):")
+		for _, f := range failures {
+			fmt.Printf("  %s from %s (%d attempts): %s\n", f.ThreadPath, FormatWorldTime(f.Start), f.Attempts, f.Error)
 		}
 	}
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---- Timeline Export ----
+// Renders a user's conversation_summaries as a chronological "what has my
+// character done" recap, one entry per conversation window.
+type TimelineEntry struct {
+	ThreadPath   string          `json:"thread_path"`
+	ThreadTitle  string          `json:"thread_title"`
+	URL          string          `json:"url,omitempty"`
+	FirstPostAt  int64           `json:"first_post_at"`
+	LastPostAt   int64           `json:"last_post_at"`
+	From         string          `json:"from"` // dates with their in-world equivalent
+	To           string          `json:"to"`
+	Participants []string        `json:"participants"` // everyone else who posted in the window
+	Summary      string          `json:"summary"`
+	Citations    []EntryCitation `json:"citations,omitempty"` // the summary point by point, when cited
+}
+
+// A point of an entry's summary with links to the posts behind it
+type EntryCitation struct {
+	Text  string     `json:"text"`
+	Posts []PostLink `json:"posts"`
+}
+
+type PostLink struct {
+	PostID string `json:"post_id"`
+	Label  string `json:"label"`
+	URL    string `json:"url,omitempty"`
+}
+
+func entryCitations(threadURL string, citations []Citation) []EntryCitation {
+	var out []EntryCitation
+	for _, c := range citations {
+		ec := EntryCitation{Text: c.Text, Posts: []PostLink{}}
+		for _, id := range c.PostIDs {
+			ec.Posts = append(ec.Posts, PostLink{PostID: id, Label: PostLabel(id), URL: PostURL(threadURL, id)})
+		}
+		out = append(out, ec)
+	}
+	return out
+}
+
+type TimelineDocument struct {
+	Username    string          `json:"username"`
+	GeneratedAt string          `json:"generated_at"`
+	Entries     []TimelineEntry `json:"entries"`
+}
+
+// GetTimelineEntries returns the summarized windows of username, oldest
+// first, optionally limited to windows starting in [since, until).
+func GetTimelineEntries(db *sql.DB, username string, since, until time.Time) ([]TimelineEntry, error) {
+	query := `SELECT thread_path, start, end, summary, citations FROM conversation_summaries WHERE username = ?`
+	args := []interface{}{username}
+	if !since.IsZero() {
+		query += ` AND start >= ?`
+		args = append(args, postTimestamp(since))
+	}
+	if !until.IsZero() {
+		query += ` AND start < ?`
+		args = append(args, postTimestamp(until))
+	}
+	rows, err := db.Query(query+` ORDER BY start, end`, args...)
+	if err != nil {
+		return nil, err
+	}
+	type window struct {
+		TimelineEntry
+		Start, End int64
+		citations  sql.NullString
+	}
+	var windows []window
+	for rows.Next() {
+		var w window
+		if err := rows.Scan(&w.ThreadPath, &w.Start, &w.End, &w.Summary, &w.citations); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]TimelineEntry, 0, len(windows))
+	for _, w := range windows {
+		e := w.TimelineEntry
+		if t, err := GetThread(db, e.ThreadPath); err == nil {
+			e.ThreadTitle, e.URL = t.Title, t.URL
+		}
+		if e.ThreadTitle == "" {
+			_, slug := SplitThreadPath(e.ThreadPath)
+			e.ThreadTitle = titleFromSlug(slug)
+		}
+		e.Citations = entryCitations(e.URL, decodeCitations(w.citations))
+		posts, err := GetThreadPostsBetween(db, e.ThreadPath, w.Start, w.End)
+		if err != nil {
+			return nil, err
+		}
+		e.FirstPostAt, e.LastPostAt = w.Start, w.Start
+		seen := map[string]bool{username: true}
+		e.Participants = []string{}
+		for _, p := range posts {
+			if p.Timestamp > e.LastPostAt {
+				e.LastPostAt = p.Timestamp
+			}
+			if !seen[p.User] {
+				seen[p.User] = true
+				e.Participants = append(e.Participants, p.User)
+			}
+		}
+		e.From, e.To = FormatWorldTime(e.FirstPostAt), FormatWorldTime(e.LastPostAt)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// DateRange renders the real dates of the window and, with a calendar, the
+// in-world ones
+func (e TimelineEntry) DateRange() string {
+	from := postTime(e.FirstPostAt).Format("Jan 2, 2006")
+	to := postTime(e.LastPostAt).Format("Jan 2, 2006")
+	dates := from
+	if to != from {
+		dates += " – " + to
+	}
+	if c := WorldCalendar(); c != nil {
+		wf, wt := c.At(postTime(e.FirstPostAt)).String(), c.At(postTime(e.LastPostAt)).String()
+		if wf == wt {
+			dates += " (" + wf + ")"
+		} else {
+			dates += " (" + wf + " – " + wt + ")"
+		}
+	}
+	return dates
+}
+
+func WriteTimelineMarkdown(w io.Writer, doc TimelineDocument) error {
+	fmt.Fprintf(w, "# Timeline: %s\n\n_%d conversations, generated %s_\n", doc.Username, len(doc.Entries), doc.GeneratedAt)
+	for _, e := range doc.Entries {
+		title := e.ThreadTitle
+		if e.URL != "" {
+			title = fmt.Sprintf("[%s](%s)", e.ThreadTitle, e.URL)
+		}
+		fmt.Fprintf(w, "\n## %s\n\n**%s**", title, e.DateRange())
+		if len(e.Participants) > 0 {
+			fmt.Fprintf(w, " · with %s", strings.Join(e.Participants, ", "))
+		}
+		if len(e.Citations) == 0 {
+			fmt.Fprintf(w, "\n\n%s\n", strings.TrimSpace(e.Summary))
+			continue
+		}
+		fmt.Fprint(w, "\n\n")
+		for _, c := range e.Citations {
+			fmt.Fprintf(w, "- %s", c.Text)
+			var links []string
+			for _, p := range c.Posts {
+				if p.URL != "" {
+					links = append(links, fmt.Sprintf("[%s](%s)", p.Label, p.URL))
+				} else {
+					links = append(links, p.Label)
+				}
+			}
+			if len(links) > 0 {
+				fmt.Fprintf(w, " (%s)", strings.Join(links, ", "))
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
+
+var timelineHTML = template.Must(template.New("timeline").Funcs(template.FuncMap{
+	"paragraphs": func(s string) []string {
+		// Chunk summaries are joined by a --- line; give it a paragraph of its own
+		s = strings.ReplaceAll(s, "\n---\n", "\n\n---\n\n")
+		var out []string
+		for _, p := range strings.Split(strings.TrimSpace(s), "\n\n") {
+			if p = strings.TrimSpace(p); p != "" {
+				out = append(out, p)
+			}
+		}
+		return out
+	},
+	"join": strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Timeline: {{.Username}}</title>
+<style>
+body { font-family: Georgia, serif; max-width: 46em; margin: 2em auto; padding: 0 1em; line-height: 1.5; color: #222; background: #fbf8f1; }
+h1 { border-bottom: 2px solid #8a6d3b; }
+article { border-left: 3px solid #8a6d3b; padding-left: 1em; margin: 2em 0; }
+h2 { margin-bottom: 0.2em; }
+h2 a { color: inherit; }
+.meta { color: #666; font-size: 0.9em; }
+p { white-space: pre-line; }
+.posts { color: #8a6d3b; font-size: 0.85em; }
+</style>
+</head>
+<body>
+<h1>Timeline: {{.Username}}</h1>
+<p class="meta">{{len .Entries}} conversations, generated {{.GeneratedAt}}</p>
+{{range .Entries}}<article>
+<h2>{{if .URL}}<a href="{{.URL}}">{{.ThreadTitle}}</a>{{else}}{{.ThreadTitle}}{{end}}</h2>
+<div class="meta">{{.DateRange}}{{if .Participants}} · with {{join .Participants ", "}}{{end}}</div>
+{{if .Citations}}<ul>
+{{range .Citations}}<li>{{.Text}}{{if .Posts}} <span class="posts">({{range $i, $p := .Posts}}{{if $i}}, {{end}}{{if $p.URL}}<a href="{{$p.URL}}">{{$p.Label}}</a>{{else}}{{$p.Label}}{{end}}{{end}})</span>{{end}}</li>
+{{end}}</ul>
+{{else}}{{range paragraphs .Summary}}{{if eq . "---"}}<hr>
+{{else}}<p>{{.}}</p>
+{{end}}{{end}}{{end}}</article>
+{{end}}</body>
+</html>
+`))
+
+func WriteTimelineHTML(w io.Writer, doc TimelineDocument) error {
+	return timelineHTML.Execute(w, doc)
+}
+
+func WriteTimelineJSON(w io.Writer, doc TimelineDocument) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// ---- CLI ----
+func ExportTimeline(username, format, outPath string, since, until time.Time) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	name, err := ResolveUsername(db, username)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	entries, err := GetTimelineEntries(db, name, since, until)
+	if err != nil {
+		log.Fatalf("failed to load timeline: %v", err)
+	}
+	if len(entries) == 0 {
+		fmt.Printf("No conversation summaries for %s; run -mode timeline -username %q first\n", name, name)
+		return
+	}
+	doc := TimelineDocument{Username: name, GeneratedAt: time.Now().Format("2006-01-02"), Entries: entries}
+
+	w := os.Stdout
+	if outPath != "" {
+		file, err := os.Create(outPath)
+		if err != nil {
+			log.Fatalf("failed to create %s: %v", outPath, err)
+		}
+		defer file.Close()
+		w = file
+	}
+	switch format {
+	case "md", "markdown":
+		err = WriteTimelineMarkdown(w, doc)
+	case "html":
+		err = WriteTimelineHTML(w, doc)
+	case "json":
+		err = WriteTimelineJSON(w, doc)
+	default:
+		log.Fatalf("unknown timeline format %q (use md, html or json)", format)
+	}
+	if err != nil {
+		log.Fatalf("failed to write timeline: %v", err)
+	}
+}
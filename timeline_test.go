@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionize(t *testing.T) {
+	day := int64(24 * 60 * 60)
+	var posts []ForumPost
+	add := func(user string, at int64) {
+		posts = append(posts, ForumPost{PostID: fmt.Sprint(len(posts)), User: user, Timestamp: at * day, ThreadPath: "board/threads/a"})
+	}
+	add("Naoki", 0)  // answered by Puck
+	add("Puck", 1)   // 1
+	add("Naoki", 2)  // 2
+	add("Dusk", 3)   // 3: joins while Puck is in the scene
+	add("Puck", 4)   // 4
+	add("Naoki", 5)  // 5
+	add("Dusk", 6)   // 6: direct answer
+	add("Naoki", 7)  // 7: in the scene
+	add("Vale", 8)   // 8: a newcomer after Puck's last post ends it
+	add("Puck", 20)  // 9: after a long gap
+	add("Naoki", 21) // 10
+	opts := SessionOptions{MaxGap: 7 * 24 * time.Hour, MaxLength: 60 * 24 * time.Hour}
+
+	var got []string
+	for _, s := range Sessionize(posts, "Puck", opts) {
+		got = append(got, fmt.Sprintf("%s-%s open=%v", s.Posts[0].PostID, s.Posts[len(s.Posts)-1].PostID, s.Open))
+		if s.Start != s.Posts[0].Timestamp || s.End != s.Posts[len(s.Posts)-1].Timestamp+1 {
+			t.Errorf("session bounds %d-%d do not match its posts", s.Start, s.End)
+		}
+	}
+	if strings.Join(got, ", ") != "1-7 open=false, 9-10 open=true" {
+		t.Errorf("sessions = %v", got)
+	}
+
+	// A short maximum length splits the first session
+	opts.MaxLength = 2 * 24 * time.Hour
+	got = nil
+	for _, s := range Sessionize(posts, "Puck", opts) {
+		got = append(got, s.Posts[0].PostID+"-"+s.Posts[len(s.Posts)-1].PostID)
+	}
+	if strings.Join(got, ", ") != "1-2, 4-6, 9-10" {
+		t.Errorf("sessions with a 2 day limit = %v", got)
+	}
+}
+
+func TestTimelineWindowsResume(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	closed := Conversation{ThreadPath: "board/threads/a", Start: 100, End: 200, Posts: make([]ForumPost, 3)}
+	open := Conversation{ThreadPath: "board/threads/b", Start: 300, End: 400, Posts: make([]ForumPost, 2), Open: true}
+
+	recordTimelineFailure(db, "Puck", closed, errors.New("rate limited"))
+	recordTimelineFailure(db, "Puck", closed, errors.New("rate limited again"))
+	failures, _ := GetTimelineFailures(db, "Puck")
+	if len(failures) != 1 || failures[0].Attempts != 2 || failures[0].Error != "rate limited again" {
+		t.Errorf("failures = %+v", failures)
+	}
+	if windowSummarized(db, "Puck", closed) {
+		t.Error("failed window counted as summarized")
+	}
+
+	first, err := saveConversationSummary(db, "Puck", closed, 3, "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := saveConversationSummary(db, "Puck", closed, 3, "forced", nil)
+	if err != nil || again != first {
+		t.Errorf("re-saving gave row %d, want %d (%v)", again, first, err)
+	}
+	if !windowSummarized(db, "Puck", closed) || windowSummarized(db, "Empress Naoki", closed) {
+		t.Error("window lookup is not per user and window")
+	}
+	if failures, _ := GetTimelineFailures(db, "Puck"); len(failures) != 0 {
+		t.Errorf("failure kept after success: %+v", failures)
+	}
+
+	// An open window is redone once posts are added to it
+	saveConversationSummary(db, "Puck", open, 2, "so far", nil)
+	if !windowSummarized(db, "Puck", open) {
+		t.Error("open window with the same posts not skipped")
+	}
+	open.Posts = append(open.Posts, ForumPost{})
+	if windowSummarized(db, "Puck", open) {
+		t.Error("open window with a new post skipped")
+	}
+
+	var rows int
+	db.QueryRow(`SELECT COUNT(*) FROM conversation_summaries`).Scan(&rows)
+	if rows != 2 {
+		t.Errorf("%d summary rows, want 2", rows)
+	}
+}
+
+func TestTimelineExport(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range []struct {
+		user string
+		ts   int64
+	}{{"Puck", 1459729209}, {"Empress Naoki", 1459729300}, {"<Dusk>", 1459815700}, {"Puck", 1459900000}} {
+		db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES (?, ?, 0, ?, 'x', 'board/threads/midnight-sun')`,
+			i, p.user, p.ts)
+	}
+	db.Exec(`INSERT INTO threads (thread_path, board_path, slug, title, url, thread_num, first_post_at, last_post_at, participants, post_count)
+		VALUES ('board/threads/midnight-sun', 'board', 'midnight-sun', 'Midnight Sun', 'https://example.com/thread/1', 1, 0, 0, '[]', 0)`)
+	convo := Conversation{ThreadPath: "board/threads/midnight-sun", Start: 1459729209, End: 1459900000}
+	saveConversationSummary(db, "Puck", convo, 3, "Puck met the Empress.\nThey argued <loudly>.",
+		[]Citation{{Text: "Puck met the Empress.", PostIDs: []string{"post-0", "post-1"}}, {Text: "They argued <loudly>.", PostIDs: []string{}}})
+	saveConversationSummary(db, "Puck", Conversation{ThreadPath: "board/threads/gone", Start: 1459900000, End: 1459900001}, 1, "Later.\n---\nMuch later.", nil)
+
+	entries, err := GetTimelineEntries(db, "Puck", time.Time{}, time.Time{})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("entries = %+v, %v", entries, err)
+	}
+	e := entries[0]
+	if e.ThreadTitle != "Midnight Sun" || strings.Join(e.Participants, ",") != "Empress Naoki,<Dusk>" || e.LastPostAt != 1459815700 {
+		t.Errorf("entry = %+v", e)
+	}
+	if entries[1].ThreadTitle != "Gone" || entries[1].URL != "" {
+		t.Errorf("entry without a thread row = %+v", entries[1])
+	}
+	if later, _ := GetTimelineEntries(db, "Puck", time.Unix(1459800000, 0), time.Time{}); len(later) != 1 {
+		t.Errorf("since filter kept %d entries", len(later))
+	}
+
+	doc := TimelineDocument{Username: "Puck", GeneratedAt: "2016-04-06", Entries: entries}
+	var md, page, js bytes.Buffer
+	WriteTimelineMarkdown(&md, doc)
+	if !strings.Contains(md.String(), "## [Midnight Sun](https://example.com/thread/1)") || !strings.Contains(md.String(), "with Empress Naoki, <Dusk>") ||
+		!strings.Contains(md.String(), "- Puck met the Empress. ([#0](https://example.com/post/0/thread), [#1](https://example.com/post/1/thread))\n- They argued <loudly>.\n") {
+		t.Errorf("markdown:\n%s", md.String())
+	}
+	if err := WriteTimelineHTML(&page, doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), "&lt;Dusk&gt;") || !strings.Contains(page.String(), "<hr>") || strings.Contains(page.String(), "<loudly>") ||
+		!strings.Contains(page.String(), `<a href="https://example.com/post/1/thread">#1</a>`) {
+		t.Errorf("html:\n%s", page.String())
+	}
+	WriteTimelineJSON(&js, doc)
+	var decoded TimelineDocument
+	if err := json.Unmarshal(js.Bytes(), &decoded); err != nil || len(decoded.Entries) != 2 || decoded.Entries[0].Citations[0].Posts[1].URL == "" {
+		t.Errorf("json = %s, %v", js.String(), err)
+	}
+}
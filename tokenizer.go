@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ---- Tokenizer ----
+// A pure Go byte pair encoder for OpenAI's cl100k_base and o200k_base
+// encodings, used to budget prompts in tokens rather than characters. The
+// merge ranks are read from the published .tiktoken files in
+// data/tokenizers (e.g. cl100k_base.tiktoken from
+// openaipublic.blob.core.windows.net/encodings). Without the file, counts
+// are estimated so that they err high: three ASCII letters or digits to a
+// token, and a token for every other byte.
+const tokenizerDir = "data/tokenizers"
+
+type Tokenizer struct {
+	Encoding string
+	ranks    map[string]int // nil when estimating
+}
+
+var (
+	tokenizersMu sync.Mutex
+	tokenizers   = make(map[string]*Tokenizer)
+)
+
+// LoadTokenizer returns the tokenizer for encoding, reading its rank file
+// once. A missing rank file is a warning, not an error.
+func LoadTokenizer(encoding string) (*Tokenizer, error) {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+	if t, ok := tokenizers[encoding]; ok {
+		return t, nil
+	}
+	t := &Tokenizer{Encoding: encoding}
+	path := filepath.Join(tokenizerDir, encoding+".tiktoken")
+	ranks, err := readTiktokenRanks(path)
+	switch {
+	case err == nil:
+		t.ranks = ranks
+	case os.IsNotExist(err):
+		log.Printf("Warning: no %s, estimating token counts (download https://openaipublic.blob.core.windows.net/encodings/%s.tiktoken there for exact ones)", path, encoding)
+	default:
+		return nil, err
+	}
+	tokenizers[encoding] = t
+	return t, nil
+}
+
+// readTiktokenRanks reads "<base64 token> <rank>" lines
+func readTiktokenRanks(path string) (map[string]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed line", path, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	return ranks, scanner.Err()
+}
+
+// Count returns the number of tokens in s
+func (t *Tokenizer) Count(s string) int {
+	n := 0
+	for _, piece := range splitPieces(s, t.Encoding) {
+		n += len(t.tokens(piece))
+	}
+	return n
+}
+
+// Split cuts s into consecutive parts of at most max tokens each, between
+// words where possible.
+func (t *Tokenizer) Split(s string, max int) []string {
+	if max < 1 {
+		max = 1
+	}
+	var parts []string
+	var current strings.Builder
+	count := 0
+	flush := func() {
+		if current.Len() > 0 {
+			parts = append(parts, current.String())
+			current.Reset()
+			count = 0
+		}
+	}
+	for _, piece := range splitPieces(s, t.Encoding) {
+		tokens := t.tokens(piece)
+		if count+len(tokens) > max {
+			flush()
+		}
+		if len(tokens) <= max {
+			current.WriteString(piece)
+			count += len(tokens)
+			continue
+		}
+		// A single piece over the budget, like a long URL, is cut by token,
+		// but never inside a character whose bytes span several tokens
+		start, off, n := 0, 0, 0
+		for _, tok := range tokens {
+			off += len(tok)
+			n++
+			if off < len(piece) && !utf8.RuneStart(piece[off]) {
+				continue
+			}
+			if count > 0 && count+n > max {
+				flush()
+			}
+			current.WriteString(piece[start:off])
+			count += n
+			start, n = off, 0
+		}
+	}
+	flush()
+	return parts
+}
+
+// Truncate returns the first max tokens of s
+func (t *Tokenizer) Truncate(s string, max int) string {
+	if t.Count(s) <= max {
+		return s
+	}
+	return t.Split(s, max)[0]
+}
+
+// tokens returns the text of each token in piece
+func (t *Tokenizer) tokens(piece string) []string {
+	if t.ranks == nil {
+		return estimateTokens(piece)
+	}
+	if _, ok := t.ranks[piece]; ok {
+		return []string{piece}
+	}
+	return t.bytePairs(piece)
+}
+
+// estimateTokens cuts piece into runs of up to three ASCII letters or
+// digits and single other bytes
+func estimateTokens(piece string) []string {
+	isAlnum := func(b byte) bool {
+		return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+	}
+	var out []string
+	for i := 0; i < len(piece); {
+		n := 1
+		for n < 3 && i+n < len(piece) && isAlnum(piece[i]) && isAlnum(piece[i+n]) {
+			n++
+		}
+		out = append(out, piece[i:i+n])
+		i += n
+	}
+	return out
+}
+
+// bytePairs starts from single bytes and keeps merging the adjacent pair
+// with the lowest rank, as tiktoken does.
+func (t *Tokenizer) bytePairs(piece string) []string {
+	parts := make([]string, len(piece))
+	for i := range piece {
+		parts[i] = piece[i : i+1]
+	}
+	for len(parts) > 1 {
+		best, bestRank := -1, 0
+		for i := 0; i+1 < len(parts); i++ {
+			if rank, ok := t.ranks[parts[i]+parts[i+1]]; ok && (best < 0 || rank < bestRank) {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts[best] += parts[best+1]
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+	return parts
+}
+
+// splitPieces pre-tokenizes s like the encoding's pattern, which Go's
+// regexp cannot express because of the lookahead. cl100k_base:
+//
+//	'(?i:[sdmt]|ll|ve|re)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// o200k_base, which splits words at case changes and keeps contractions
+// with their word:
+//
+//	[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?
+//	|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?
+//	|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+(?!\S)|\s+
+func splitPieces(s, encoding string) []string {
+	match := matchPiece
+	if encoding == "o200k_base" {
+		match = matchPieceO200k
+	}
+	rs := []rune(s)
+	var pieces []string
+	for i := 0; i < len(rs); {
+		n := match(rs, i)
+		pieces = append(pieces, string(rs[i:i+n]))
+		i += n
+	}
+	return pieces
+}
+
+func isNewline(r rune) bool { return r == '\r' || r == '\n' }
+
+func isOther(r rune) bool { return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r) }
+
+func runOf(rs []rune, from int, ok func(rune) bool) int {
+	j := from
+	for j < len(rs) && ok(rs[j]) {
+		j++
+	}
+	return j
+}
+
+func matchPiece(rs []rune, i int) int {
+	// Contractions
+	if n := matchContraction(rs, i); n > 0 {
+		return n
+	}
+	// A word, with at most one leading space or symbol
+	j := i
+	if !isNewline(rs[j]) && !unicode.IsLetter(rs[j]) && !unicode.IsNumber(rs[j]) {
+		j++
+	}
+	if j < len(rs) && unicode.IsLetter(rs[j]) {
+		return runOf(rs, j, unicode.IsLetter) - i
+	}
+	if n := matchDigits(rs, i); n > 0 {
+		return n
+	}
+	// Symbols, with at most one leading space and any trailing newlines
+	if n := matchSymbols(rs, i, isNewline); n > 0 {
+		return n
+	}
+	return matchSpace(rs, i)
+}
+
+func matchPieceO200k(rs []rune, i int) int {
+	isUpper := func(r rune) bool {
+		return unicode.In(r, unicode.Lu, unicode.Lt, unicode.Lm, unicode.Lo, unicode.M)
+	}
+	isLower := func(r rune) bool {
+		return unicode.In(r, unicode.Ll, unicode.Lm, unicode.Lo, unicode.M)
+	}
+	// A word of capitals then lower case (or capitals alone), with at most
+	// one leading space or symbol and a trailing contraction. The prefix is
+	// optional, so each word pattern is tried with and without it, and the
+	// capitals give characters back to the lower case as a regexp would.
+	word := func(start int, lowerRequired bool) int {
+		upper := runOf(rs, start, isUpper)
+		for u := upper; u >= start; u-- {
+			if !lowerRequired && u == start {
+				break
+			}
+			end := runOf(rs, u, isLower)
+			if lowerRequired && end == u {
+				continue
+			}
+			return end + matchContraction(rs, end)
+		}
+		return -1
+	}
+	starts := []int{i}
+	if !isNewline(rs[i]) && !unicode.IsLetter(rs[i]) && !unicode.IsNumber(rs[i]) && i+1 < len(rs) {
+		starts = []int{i + 1, i}
+	}
+	for _, lowerRequired := range []bool{true, false} {
+		for _, start := range starts {
+			if end := word(start, lowerRequired); end > start {
+				return end - i
+			}
+		}
+	}
+	if n := matchDigits(rs, i); n > 0 {
+		return n
+	}
+	// Symbols, with at most one leading space and any trailing newlines or
+	// slashes
+	if n := matchSymbols(rs, i, func(r rune) bool { return isNewline(r) || r == '/' }); n > 0 {
+		return n
+	}
+	return matchSpace(rs, i)
+}
+
+// matchContraction matches 's, 't, 're, 've, 'm, 'll or 'd in any case
+func matchContraction(rs []rune, i int) int {
+	if i >= len(rs) || rs[i] != '\'' {
+		return 0
+	}
+	for _, c := range []string{"s", "t", "re", "ve", "m", "ll", "d"} {
+		end := i + 1 + len(c)
+		if end <= len(rs) && strings.EqualFold(string(rs[i+1:end]), c) {
+			return end - i
+		}
+	}
+	return 0
+}
+
+// matchDigits matches up to three digits
+func matchDigits(rs []rune, i int) int {
+	end := i
+	for end < len(rs) && end-i < 3 && unicode.IsNumber(rs[end]) {
+		end++
+	}
+	return end - i
+}
+
+func matchSymbols(rs []rune, i int, trailing func(rune) bool) int {
+	j := i
+	if rs[j] == ' ' {
+		j++
+	}
+	if j < len(rs) && isOther(rs[j]) {
+		return runOf(rs, runOf(rs, j, isOther), trailing) - i
+	}
+	return 0
+}
+
+func matchSpace(rs []rune, i int) int {
+	// Whitespace up to the last newline in it
+	end := runOf(rs, i, unicode.IsSpace)
+	for k := end - 1; k >= i; k-- {
+		if isNewline(rs[k]) {
+			return k + 1 - i
+		}
+	}
+	// Other whitespace leaves its last character to the word that follows
+	if end < len(rs) && end-i > 1 {
+		return end - 1 - i
+	}
+	return end - i
+}
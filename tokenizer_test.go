@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplitPieces(t *testing.T) {
+	got := splitPieces("Hello world's 12345 !!!\n\n  end", "cl100k_base")
+	want := []string{"Hello", " world", "'s", " ", "123", "45", " !!!\n\n", " ", " end"}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("splitPieces = %q, want %q", got, want)
+	}
+	got = splitPieces("HelloWorld world's ÉCOLE a/b//\n x", "o200k_base")
+	want = []string{"Hello", "World", " world's", " ÉCOLE", " a", "/b", "//\n", " x"}
+	if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+		t.Errorf("splitPieces o200k = %q, want %q", got, want)
+	}
+}
+
+// Token IDs from tiktoken for each encoding. Needs the rank files.
+func TestTokenizerMatchesTiktoken(t *testing.T) {
+	cases := []struct {
+		encoding, text string
+		want           []int
+	}{
+		{"cl100k_base", "hello world", []int{15339, 1917}},
+		{"cl100k_base", "tiktoken is great!", []int{83, 1609, 5963, 374, 2294, 0}},
+		{"o200k_base", "hello world", []int{24912, 2375}},
+	}
+	for _, c := range cases {
+		ranks, err := readTiktokenRanks(filepath.Join(tokenizerDir, c.encoding+".tiktoken"))
+		if err != nil {
+			t.Skipf("no %s ranks: %v", c.encoding, err)
+		}
+		tok := &Tokenizer{Encoding: c.encoding, ranks: ranks}
+		var got []int
+		for _, piece := range splitPieces(c.text, c.encoding) {
+			for _, s := range tok.tokens(piece) {
+				got = append(got, ranks[s])
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(c.want) || tok.Count(c.text) != len(c.want) {
+			t.Errorf("%s %q = %v, want %v", c.encoding, c.text, got, c.want)
+		}
+	}
+}
+
+func TestEstimateErrsHigh(t *testing.T) {
+	tok := &Tokenizer{Encoding: "cl100k_base"}
+	for text, atLeast := range map[string]int{"hello world": 2, "tiktoken is great!": 6} {
+		if n := tok.Count(text); n < atLeast {
+			t.Errorf("estimate for %q = %d, want at least tiktoken's %d", text, n, atLeast)
+		}
+	}
+	// Byte level BPE never needs more than a token per byte
+	if n := tok.Count("日本"); n != len("日本") {
+		t.Errorf("estimate for non-Latin text = %d, want a token per byte", n)
+	}
+}
+
+func TestBytePairs(t *testing.T) {
+	tok := &Tokenizer{ranks: map[string]int{"l": 0, "o": 1, "h": 2, "e": 3, "ll": 4, "he": 5, "llo": 6, "hello": 7}}
+	if parts := tok.bytePairs("helloo"); strings.Join(parts, "|") != "hello|o" {
+		t.Errorf("bytePairs = %q", parts)
+	}
+	if n := tok.Count("hello hello"); n != 3 { // "hello", then " " and "hello"
+		t.Errorf("Count = %d", n)
+	}
+	if parts := tok.Split("hello hello", 2); strings.Join(parts, "|") != "hello| hello" {
+		t.Errorf("Split = %q", parts)
+	}
+}
+
+// An oversized piece is cut between characters, not inside one
+func TestSplitKeepsCharacters(t *testing.T) {
+	tok := &Tokenizer{Encoding: "cl100k_base"} // estimates a token per byte of é
+	s := strings.Repeat("é", 5)
+	parts := tok.Split(s, 3)
+	for _, p := range parts {
+		if !utf8.ValidString(p) {
+			t.Errorf("part %q cuts a character", p)
+		}
+	}
+	if len(parts) != 5 || strings.Join(parts, "") != s {
+		t.Errorf("Split = %q", parts)
+	}
+}
+
+func TestChunkPostsByTokens(t *testing.T) {
+	tok := TokenizerFor(summaryModel)
+	post := func(id, text string) ForumPost {
+		return ForumPost{PostID: id, User: "Puck", Timestamp: 1459729209, Message: text, CleanMessage: text, ThreadPath: "board/threads/a"}
+	}
+	short := strings.Repeat("The sun did not set. ", 5)
+	posts := []ForumPost{post("1", short), post("2", short), post("3", short), post("4", strings.Repeat("Dragons everywhere. ", 60)), post("5", short)}
+	budget := tok.Count(renderChunk(posts[:2])) + 1
+
+	chunks := ChunkPosts(posts, ChunkOptions{Model: summaryModel, MaxTokens: budget, Overlap: 1})
+	var ids []string
+	for _, c := range chunks {
+		if n := tok.Count(renderChunk(c)); n > budget {
+			t.Errorf("chunk of %d tokens over the budget of %d", n, budget)
+		}
+		var chunkIDs []string
+		for _, p := range c {
+			chunkIDs = append(chunkIDs, p.PostID)
+		}
+		ids = append(ids, strings.Join(chunkIDs, ","))
+	}
+	// 2 is carried over, and 4 is split into parts that fill chunks of their own
+	got := strings.Join(ids, " ")
+	if !strings.HasPrefix(got, "1,2 2,3 4 4 ") || !strings.HasSuffix(got, "5") {
+		t.Errorf("chunks = %s", got)
+	}
+
+	// A negative overlap carries nothing over
+	if chunks := ChunkPosts(posts[:3], ChunkOptions{Model: summaryModel, MaxTokens: budget, Overlap: -1}); len(chunks) != 2 || len(chunks[1]) != 1 {
+		t.Errorf("chunks with negative overlap = %d", len(chunks))
+	}
+}
+
+func TestEmbeddingInputsSplitLongPosts(t *testing.T) {
+	tok, max := TokenizerFor(embedModel), TokenBudget(embedModel, 0)
+	long := strings.Repeat("Dragons everywhere. ", max/2)
+	posts := []ForumPost{
+		{PostID: "post-1", User: "Puck", Message: "Short.", CleanMessage: "Short."},
+		{PostID: "post-2", User: "Puck", Message: long, CleanMessage: long},
+	}
+	inputs := embeddingInputs(posts)
+	if len(inputs) < 3 || inputs[0].PostID != "post-1" || inputs[0].Part != 0 {
+		t.Fatalf("inputs = %+v", inputs)
+	}
+	var text strings.Builder
+	for i, in := range inputs[1:] {
+		if in.PostID != "post-2" || in.Part != i {
+			t.Errorf("input %d = %s part %d", i+1, in.PostID, in.Part)
+		}
+		if n := tok.Count(in.Message); n > max {
+			t.Errorf("part %d is %d tokens, over %d", in.Part, n, max)
+		}
+		text.WriteString(in.Message)
+	}
+	if text.String() != long {
+		t.Error("parts do not add up to the post")
+	}
+	if id, part := parseEmbeddingCustomID(embeddingCustomID("post-2", 3)); id != "post-2" || part != 3 {
+		t.Errorf("custom ID round trip = %s, %d", id, part)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ---- Forum Users Registry ----
+// One row per forum account. Display names change over time, so the same
+// user_num can post under several aliases; the most used one is canonical.
+type ForumUser struct {
+	ID            int64
+	UserNum       int
+	Name          string
+	Aliases       []string
+	FirstPostAt   int64
+	LastPostAt    int64
+	PostCount     int
+	Boards        []string
+	CharacterPath string // generated character sheet, if any
+}
+
+// Path Charactar writes the master sheet to for a username
+func characterSheetFile(username string) string {
+	return fmt.Sprintf("data/tfs/characters/%s.json", strings.ToLower(strings.ReplaceAll(username, " ", "-")))
+}
+
+func RebuildForumUsers(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT user_num, user, thread_path, COUNT(*), MIN(timestamp), MAX(timestamp)
+		FROM forum_posts
+		GROUP BY user_num, user, thread_path
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type aliasStat struct {
+		count int
+		last  int64
+	}
+	type userAgg struct {
+		user    *ForumUser
+		aliases map[string]*aliasStat
+		boards  map[string]bool
+	}
+	byKey := make(map[string]*userAgg)
+	var order []string
+
+	for rows.Next() {
+		var userNum, count int
+		var name, threadPath string
+		var first, last int64
+		if err := rows.Scan(&userNum, &name, &threadPath, &count, &first, &last); err != nil {
+			return err
+		}
+		// Posts without a user_num (guests, imports) are grouped by name
+		key := fmt.Sprintf("num:%d", userNum)
+		if userNum == 0 {
+			key = "name:" + name
+		}
+		agg, ok := byKey[key]
+		if !ok {
+			agg = &userAgg{
+				user:    &ForumUser{UserNum: userNum, FirstPostAt: first, LastPostAt: last},
+				aliases: make(map[string]*aliasStat),
+				boards:  make(map[string]bool),
+			}
+			byKey[key] = agg
+			order = append(order, key)
+		}
+		u := agg.user
+		u.PostCount += count
+		if first < u.FirstPostAt {
+			u.FirstPostAt = first
+		}
+		if last > u.LastPostAt {
+			u.LastPostAt = last
+		}
+		a, ok := agg.aliases[name]
+		if !ok {
+			a = &aliasStat{}
+			agg.aliases[name] = a
+		}
+		a.count += count
+		if last > a.last {
+			a.last = last
+		}
+		board, _ := SplitThreadPath(threadPath)
+		agg.boards[board] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var users []*ForumUser
+	for _, key := range order {
+		agg := byKey[key]
+		u := agg.user
+		for name := range agg.aliases {
+			u.Aliases = append(u.Aliases, name)
+		}
+		sort.Slice(u.Aliases, func(i, j int) bool {
+			ai, aj := agg.aliases[u.Aliases[i]], agg.aliases[u.Aliases[j]]
+			if ai.count != aj.count {
+				return ai.count > aj.count
+			}
+			return ai.last > aj.last
+		})
+		u.Name = u.Aliases[0]
+		for b := range agg.boards {
+			u.Boards = append(u.Boards, b)
+		}
+		sort.Strings(u.Boards)
+		for _, name := range u.Aliases {
+			if p := characterSheetFile(name); fileExistsAndNotEmpty(p) {
+				u.CharacterPath = p
+				break
+			}
+		}
+		users = append(users, u)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM forum_users`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, u := range users {
+		aliases, _ := json.Marshal(u.Aliases)
+		boards, _ := json.Marshal(u.Boards)
+		_, err := tx.Exec(`
+			INSERT INTO forum_users (user_num, name, aliases, first_post_at, last_post_at, post_count, boards, character_path)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, u.UserNum, u.Name, string(aliases), u.FirstPostAt, u.LastPostAt, u.PostCount, string(boards), u.CharacterPath)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("insert user %s: %w", u.Name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d forum users.\n", len(users))
+	return nil
+}
+
+const userColumns = `id, user_num, name, aliases, first_post_at, last_post_at, post_count, boards, character_path`
+
+func scanForumUser(scan func(dest ...interface{}) error) (*ForumUser, error) {
+	var u ForumUser
+	var aliases, boards string
+	var characterPath sql.NullString
+	if err := scan(&u.ID, &u.UserNum, &u.Name, &aliases, &u.FirstPostAt, &u.LastPostAt, &u.PostCount, &boards, &characterPath); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(aliases), &u.Aliases)
+	json.Unmarshal([]byte(boards), &u.Boards)
+	u.CharacterPath = characterPath.String
+	return &u, nil
+}
+
+func GetForumUsers(db *sql.DB) ([]*ForumUser, error) {
+	rows, err := db.Query(`SELECT ` + userColumns + ` FROM forum_users ORDER BY post_count DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var users []*ForumUser
+	for rows.Next() {
+		u, err := scanForumUser(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// FindForumUser looks a name up against canonical names and aliases,
+// ignoring case. It returns nil if nobody matches.
+func FindForumUser(db *sql.DB, name string) (*ForumUser, error) {
+	users, err := GetForumUsers(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		for _, alias := range u.Aliases {
+			if strings.EqualFold(alias, name) {
+				return u, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// SuggestUsernames returns up to n known names closest to the given one.
+func SuggestUsernames(db *sql.DB, name string, n int) ([]string, error) {
+	users, err := GetForumUsers(db)
+	if err != nil {
+		return nil, err
+	}
+	type candidate struct {
+		name string
+		dist int
+	}
+	lower := strings.ToLower(name)
+	var candidates []candidate
+	for _, u := range users {
+		for _, alias := range u.Aliases {
+			if alias == "" {
+				continue
+			}
+			la := strings.ToLower(alias)
+			d := levenshtein(lower, la)
+			if strings.Contains(la, lower) || strings.Contains(lower, la) {
+				d = d / 2
+			}
+			candidates = append(candidates, candidate{alias, d})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+	var out []string
+	for _, c := range candidates {
+		if len(out) >= n || c.dist > len(name)/2+2 {
+			break
+		}
+		out = append(out, c.name)
+	}
+	return out, nil
+}
+
+// ResolveUsername maps a possibly mistyped name onto the exact name stored in
+// forum_posts, so lookups by `user = ?` don't silently come back empty.
+func ResolveUsername(db *sql.DB, name string) (string, error) {
+	u, err := FindForumUser(db, name)
+	if err != nil {
+		return name, err
+	}
+	if u != nil {
+		for _, alias := range u.Aliases {
+			if alias == name {
+				return name, nil
+			}
+		}
+		for _, alias := range u.Aliases {
+			if strings.EqualFold(alias, name) {
+				return alias, nil
+			}
+		}
+	}
+	suggestions, err := SuggestUsernames(db, name, 5)
+	if err != nil {
+		return name, err
+	}
+	if len(suggestions) == 0 {
+		return name, fmt.Errorf("unknown user %q", name)
+	}
+	return name, fmt.Errorf("unknown user %q, did you mean: %s", name, strings.Join(suggestions, ", "))
+}
+
+// Error for a username with no posts, listing close matches if there are any
+func noPostsError(db *sql.DB, username string) error {
+	suggestions, err := SuggestUsernames(db, username, 5)
+	if err != nil || len(suggestions) == 0 {
+		return fmt.Errorf("no posts found for user %s", username)
+	}
+	return fmt.Errorf("no posts found for user %s, did you mean: %s", username, strings.Join(suggestions, ", "))
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(min(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// ---- CLI ----
+func ListUsers(limit int) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	users, err := GetForumUsers(db)
+	if err != nil {
+		log.Fatalf("failed to list users (did you run -mode scrape?): %v", err)
+	}
+	fmt.Printf("%-8s %-40s %6s  %-10s  %-10s  %s\n", "user_num", "name", "posts", "first", "last", "sheet")
+	for i, u := range users {
+		if limit > 0 && i >= limit {
+			break
+		}
+		sheet := ""
+		if u.CharacterPath != "" {
+			sheet = "yes"
+		}
+		fmt.Printf("%-8d %-40s %6d  %-10s  %-10s  %s\n", u.UserNum, truncate(u.Name, 40), u.PostCount,
+			formatPostDate(u.FirstPostAt), formatPostDate(u.LastPostAt), sheet)
+	}
+	fmt.Printf("\n%d users total\n", len(users))
+}
+
+func InspectUser(name string) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	u, err := FindForumUser(db, name)
+	if err != nil {
+		log.Fatalf("failed to look up user: %v", err)
+	}
+	if u == nil {
+		if _, err := ResolveUsername(db, name); err != nil {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("Name:       %s\n", u.Name)
+	fmt.Printf("User num:   %d\n", u.UserNum)
+	fmt.Printf("Aliases:    %s\n", strings.Join(u.Aliases, ", "))
+	fmt.Printf("Posts:      %d\n", u.PostCount)
+	fmt.Printf("First post: %s\n", formatPostDate(u.FirstPostAt))
+	fmt.Printf("Last post:  %s\n", formatPostDate(u.LastPostAt))
+	fmt.Printf("Character:  %s\n", u.CharacterPath)
+	fmt.Printf("Boards (%d):\n", len(u.Boards))
+	for _, b := range u.Boards {
+		fmt.Printf("  %s\n", b)
+	}
+}
+
+func formatPostDate(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return postTime(ts).Format("2006-01-02")
+}
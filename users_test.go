@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestForumUsers(t *testing.T) {
+	db := openTestDB(t)
+	for _, p := range []struct {
+		id, user string
+		num      int
+		thread   string
+		at       int64
+	}{
+		// One account that renamed itself, posting on two boards
+		{"post-1", "Naoki", 607, "overworld/isran-empire/threads/a", 100},
+		{"post-2", "Empress Naoki", 607, "overworld/isran-empire/threads/a", 200},
+		{"post-3", "Empress Naoki", 607, "overworld/vessia/threads/b", 300},
+		{"post-4", "Empress Naoki", 607, "overworld/vessia/threads/c", 400},
+		{"post-5", "Puck", 42, "overworld/vessia/threads/b", 250},
+		// Guests have no account and are told apart by name
+		{"post-6", "Wandering Bard", 0, "overworld/vessia/threads/b", 260},
+		{"post-7", "Stranger", 0, "overworld/vessia/threads/b", 270},
+	} {
+		if _, err := db.Exec(`INSERT INTO forum_posts (post_id, user, user_num, timestamp, message, thread_path) VALUES (?, ?, ?, ?, 'x', ?)`,
+			p.id, p.user, p.num, p.at, p.thread); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RebuildForumUsers(db); err != nil {
+		t.Fatal(err)
+	}
+	users, err := GetForumUsers(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 4 {
+		t.Fatalf("%d users, want 4", len(users))
+	}
+	naoki := users[0]
+	if naoki.UserNum != 607 || naoki.Name != "Empress Naoki" || strings.Join(naoki.Aliases, ",") != "Empress Naoki,Naoki" ||
+		naoki.PostCount != 4 || naoki.FirstPostAt != 100 || naoki.LastPostAt != 400 ||
+		strings.Join(naoki.Boards, ",") != "overworld/isran-empire,overworld/vessia" {
+		t.Errorf("renamed user = %+v", naoki)
+	}
+	if naoki.CharacterPath != "data/tfs/characters/empress-naoki.json" {
+		t.Errorf("character sheet = %q", naoki.CharacterPath)
+	}
+
+	// An old alias finds the account, in any case
+	if u, err := FindForumUser(db, "naoki"); err != nil || u == nil || u.Name != "Empress Naoki" {
+		t.Errorf("FindForumUser(naoki) = %+v, %v", u, err)
+	}
+	if u, _ := FindForumUser(db, "Nobody"); u != nil {
+		t.Errorf("FindForumUser(Nobody) = %+v", u)
+	}
+	if name, err := ResolveUsername(db, "empress naoki"); err != nil || name != "Empress Naoki" {
+		t.Errorf("ResolveUsername = %q, %v", name, err)
+	}
+
+	// A typo gets the closest names
+	suggestions, err := SuggestUsernames(db, "Empres Naoky", 3)
+	if err != nil || len(suggestions) == 0 || suggestions[0] != "Empress Naoki" {
+		t.Errorf("suggestions = %v, %v", suggestions, err)
+	}
+	if _, err := ResolveUsername(db, "Pukc"); err == nil || !strings.Contains(err.Error(), "did you mean: Puck") {
+		t.Errorf("ResolveUsername(Pukc) error = %v", err)
+	}
+	if suggestions, _ := SuggestUsernames(db, "Zzyzx Qwertyuiop", 3); len(suggestions) != 0 {
+		t.Errorf("suggestions for an unrelated name = %v", suggestions)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ---- Ingestion Validation ----
+// Posts that fail validation are kept out of forum_posts and recorded in the
+// quarantine table with the reason, so bad source data is visible instead of
+// being printed once and forgotten. Quarantine rows always describe the last
+// ingest of their file.
+const (
+	ReasonMalformedJSON      = "malformed_json"
+	ReasonEmptyMessage       = "empty_message"
+	ReasonBadTimestamp       = "bad_timestamp"
+	ReasonDuplicatePostID    = "duplicate_post_id"
+	ReasonUserNumWithoutUser = "user_num_without_user"
+)
+
+type ValidationIssue struct {
+	FilePath   string
+	ThreadPath string
+	PostID     string // "" for file-level issues
+	Reason     string
+	Detail     string
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// ValidatePosts checks the source fields of parsed posts and returns the
+// posts that passed plus an issue for each that did not.
+func ValidatePosts(posts []ForumPost) ([]ForumPost, []ValidationIssue) {
+	var ok []ForumPost
+	var issues []ValidationIssue
+	for _, p := range posts {
+		issue := ValidationIssue{ThreadPath: p.ThreadPath, PostID: p.PostID}
+		switch {
+		case strings.TrimSpace(p.Message) == "":
+			issue.Reason = ReasonEmptyMessage
+		case p.Timestamp <= 0:
+			issue.Reason = ReasonBadTimestamp
+			issue.Detail = fmt.Sprintf("timestamp %d", p.Timestamp)
+		case p.UserNum != 0 && strings.TrimSpace(p.User) == "":
+			issue.Reason = ReasonUserNumWithoutUser
+			issue.Detail = fmt.Sprintf("user_num %d", p.UserNum)
+		default:
+			ok = append(ok, p)
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	return ok, issues
+}
+
+// quarantineCrossThreadDuplicates leaves out posts whose ID is already
+// stored for a different thread. post_id is the primary key, so inserting
+// them would silently move the other thread's post.
+func quarantineCrossThreadDuplicates(tx *sql.Tx, threadPath string, posts []ForumPost) ([]ForumPost, []ValidationIssue, error) {
+	stmt, err := tx.Prepare(`SELECT thread_path FROM forum_posts WHERE post_id = ? AND thread_path != ?`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stmt.Close()
+	var ok []ForumPost
+	var issues []ValidationIssue
+	for _, p := range posts {
+		var other string
+		err := stmt.QueryRow(p.PostID, threadPath).Scan(&other)
+		if err == sql.ErrNoRows {
+			ok = append(ok, p)
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		issues = append(issues, ValidationIssue{
+			ThreadPath: threadPath,
+			PostID:     p.PostID,
+			Reason:     ReasonDuplicatePostID,
+			Detail:     "already stored for " + other,
+		})
+	}
+	return ok, issues, nil
+}
+
+// saveQuarantine replaces the quarantine rows of a source file.
+func saveQuarantine(db execer, runID int64, filePath string, issues []ValidationIssue) error {
+	if _, err := db.Exec(`DELETE FROM quarantine WHERE file_path = ?`, filePath); err != nil {
+		return err
+	}
+	for _, i := range issues {
+		_, err := db.Exec(`
+			INSERT INTO quarantine (run_id, file_path, thread_path, post_id, reason, detail, quarantined_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, runID, filePath, i.ThreadPath, i.PostID, i.Reason, i.Detail, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func withoutQuotesFrom(quotes []PostQuote, issues []ValidationIssue) []PostQuote {
+	if len(issues) == 0 {
+		return quotes
+	}
+	bad := make(map[string]bool)
+	for _, i := range issues {
+		bad[i.PostID] = true
+	}
+	var out []PostQuote
+	for _, q := range quotes {
+		if !bad[q.PostID] {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+func GetQuarantine(db *sql.DB) ([]ValidationIssue, error) {
+	rows, err := db.Query(`SELECT file_path, thread_path, post_id, reason, detail FROM quarantine ORDER BY reason, file_path, post_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var issues []ValidationIssue
+	for rows.Next() {
+		var i ValidationIssue
+		if err := rows.Scan(&i.FilePath, &i.ThreadPath, &i.PostID, &i.Reason, &i.Detail); err != nil {
+			return nil, err
+		}
+		issues = append(issues, i)
+	}
+	return issues, rows.Err()
+}
+
+// PrintValidationSummary prints issue counts by reason and a few examples of each.
+func PrintValidationSummary(issues []ValidationIssue, examples int) {
+	if len(issues) == 0 {
+		fmt.Println("Validation: no new issues")
+		return
+	}
+	byReason := make(map[string][]ValidationIssue)
+	var reasons []string
+	for _, i := range issues {
+		if _, ok := byReason[i.Reason]; !ok {
+			reasons = append(reasons, i.Reason)
+		}
+		byReason[i.Reason] = append(byReason[i.Reason], i)
+	}
+	sort.Strings(reasons)
+	fmt.Printf("Validation: %d items quarantined\n", len(issues))
+	for _, r := range reasons {
+		fmt.Printf("  %-24s %d\n", r, len(byReason[r]))
+		for n, i := range byReason[r] {
+			if n >= examples {
+				break
+			}
+			where := i.ThreadPath
+			if i.PostID != "" {
+				where += " " + i.PostID
+			}
+			if where == "" {
+				where = i.FilePath
+			}
+			if i.Detail != "" {
+				where += " (" + truncate(i.Detail, 80) + ")"
+			}
+			fmt.Printf("    %s\n", where)
+		}
+	}
+}
+
+// ---- CLI ----
+func ListQuarantine(examples int) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		log.Fatalf("failed to open db: %v", err)
+	}
+	defer db.Close()
+
+	issues, err := GetQuarantine(db)
+	if err != nil {
+		log.Fatalf("failed to read quarantine: %v", err)
+	}
+	if len(issues) == 0 {
+		fmt.Println("Quarantine is empty")
+		return
+	}
+	PrintValidationSummary(issues, examples)
+}
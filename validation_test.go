@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writePostsFile(t *testing.T, dir, threadPath, content string) {
+	t.Helper()
+	path := filepath.Join(dir, threadPath, "posts")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrapeQuarantine(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(tmp, "docs.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, docsMigrations); err != nil {
+		t.Fatal(err)
+	}
+
+	forum := filepath.Join(tmp, "forum") + "/"
+	writePostsFile(t, forum, "board/threads/a", `{
+		"post-1": {"user": "Puck", "user_num": 42, "timestamp": "1459729209000", "message": "Hello."},
+		"post-2": {"user": "Puck", "user_num": 42, "timestamp": "1459729309000", "message": "   "},
+		"post-3": {"user": "Puck", "user_num": 42, "timestamp": "yesterday", "message": "Late."},
+		"post-4": {"user": "Puck", "user_num": 42, "timestamp": true, "message": "Odd."},
+		"post-5": {"user": "", "user_num": 7, "timestamp": "1459729409000", "message": "Who?"}
+	}`)
+	writePostsFile(t, forum, "board/threads/b", `{
+		"post-1": {"user": "Tanis", "user_num": 9, "timestamp": "1459729509000", "message": "Mine."},
+		"post-6": {"user": "Tanis", "user_num": 9, "timestamp": "1459729609000", "message": "Fine."}
+	}`)
+	writePostsFile(t, forum, "board/threads/c", `{"post-7": {`)
+
+	report, err := ScrapeAndInsertPosts(context.Background(), db, forum, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]int)
+	for _, i := range report.Issues {
+		reasons[i.Reason]++
+	}
+	want := map[string]int{
+		ReasonEmptyMessage:       1,
+		ReasonBadTimestamp:       2,
+		ReasonUserNumWithoutUser: 1,
+		ReasonDuplicatePostID:    1,
+		ReasonMalformedJSON:      1,
+	}
+	for reason, n := range want {
+		if reasons[reason] != n {
+			t.Errorf("%s: got %d issues, want %d (all: %v)", reason, reasons[reason], n, reasons)
+		}
+	}
+
+	var stored, quarantined int
+	db.QueryRow(`SELECT COUNT(*) FROM forum_posts`).Scan(&stored)
+	db.QueryRow(`SELECT COUNT(*) FROM quarantine`).Scan(&quarantined)
+	if stored != 2 || quarantined != 6 {
+		t.Errorf("stored %d posts and quarantined %d, want 2 and 6", stored, quarantined)
+	}
+}
+
+// Renaming a thread's file moves its posts instead of quarantining them as
+// duplicates of the old thread
+func TestScrapeRenamedThread(t *testing.T) {
+	db := openTestDB(t)
+	forum := filepath.Join(t.TempDir(), "forum") + "/"
+	writePostsFile(t, forum, "board/threads/a", `{
+		"post-1": {"user": "Puck", "user_num": 42, "timestamp": "1459729209000", "message": "One."},
+		"post-2": {"user": "Fly", "user_num": 43, "timestamp": "1459729309000", "message": "Two."}
+	}`)
+	scrape := func() *ScrapeReport {
+		t.Helper()
+		report, err := ScrapeAndInsertPosts(context.Background(), db, forum, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+	threadOf := func(id string) string {
+		t.Helper()
+		var threadPath string
+		if err := db.QueryRow(`SELECT thread_path FROM forum_posts WHERE post_id = ?`, id).Scan(&threadPath); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+		return threadPath
+	}
+	scrape()
+
+	if err := os.Rename(filepath.Join(forum, "board/threads/a"), filepath.Join(forum, "board/threads/a-moved")); err != nil {
+		t.Fatal(err)
+	}
+	if report := scrape(); len(report.Issues) != 0 {
+		t.Errorf("rename quarantined %v", report.Issues)
+	}
+	for _, id := range []string{"post-1", "post-2"} {
+		if tp := threadOf(id); tp != "board/threads/a-moved" {
+			t.Errorf("%s is in %q after the rename", id, tp)
+		}
+	}
+
+	// A real duplicate is quarantined, and taken once the other thread's
+	// file is gone
+	writePostsFile(t, forum, "board/threads/b", `{
+		"post-2": {"user": "Fly", "user_num": 43, "timestamp": "1459729309000", "message": "Two."}
+	}`)
+	if report := scrape(); len(report.Issues) != 1 || report.Issues[0].Reason != ReasonDuplicatePostID {
+		t.Fatalf("duplicate issues = %v", report.Issues)
+	}
+	if err := os.RemoveAll(filepath.Join(forum, "board/threads/a-moved")); err != nil {
+		t.Fatal(err)
+	}
+	scrape()
+	if tp := threadOf("post-2"); tp != "board/threads/b" {
+		t.Errorf("post-2 is in %q, want the thread that still has it", tp)
+	}
+	var quarantined int
+	db.QueryRow(`SELECT COUNT(*) FROM quarantine`).Scan(&quarantined)
+	if quarantined != 0 {
+		t.Errorf("%d posts still quarantined", quarantined)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	// This is the SQLite driver
 	_ "github.com/glebarez/go-sqlite"
@@ -21,6 +22,7 @@ type PostToEmbed struct {
 	Message   string `json:"message"`
 	ThreadID  string `json:"thread_id,omitempty"`
 	Timestamp int64  `json:"timestamp,omitempty"`
+	Part      int    `json:"part,omitempty"` // of a post too long to embed whole
 }
 
 const (
@@ -64,10 +66,6 @@ func CreateVectorDBForTFS(dryMode bool) {
 	}
 	defer db.Close()
 
-	if err := EnsureBatchTable(db); err != nil {
-		log.Fatalf("Fatal: Failed to ensure batch_jobs table exists: %v", err)
-	}
-
 	posts, err := GetAllForumPosts(db)
 	if err != nil {
 		log.Fatalf("Fatal: Failed to get posts : %v", err)
@@ -79,17 +77,9 @@ func CreateVectorDBForTFS(dryMode bool) {
 	}
 	openaiClient := openai.NewClient(apiKey)
 
-	// Prepare all messages for embedding
-	postsToEmbed := make([]PostToEmbed, len(posts))
-	for i, post := range posts {
-		postsToEmbed[i] = PostToEmbed{
-			PostID:    post.PostID,
-			User:      post.User,
-			Message:   post.Message,
-			ThreadID:  post.ThreadPath,
-			Timestamp: post.Timestamp,
-		}
-	}
+	// Prepare all messages for embedding, splitting those too long for the
+	// model into parts
+	postsToEmbed := embeddingInputs(posts)
 
 	// Batch processing
 	numBatches := (len(postsToEmbed) + maxBatchSize - 1) / maxBatchSize
@@ -105,7 +95,7 @@ func CreateVectorDBForTFS(dryMode bool) {
 		lines := make([]openai.BatchLineItem, len(batch))
 		for i, post := range batch {
 			lines[i] = openai.BatchEmbeddingRequest{
-				CustomID: post.PostID,
+				CustomID: embeddingCustomID(post.PostID, post.Part),
 				Body: openai.EmbeddingRequest{
 					Input: post.Message,
 					Model: openai.LargeEmbedding3,
@@ -149,8 +139,63 @@ func CreateVectorDBForTFS(dryMode bool) {
 	}
 }
 
+const embedModel = string(openai.LargeEmbedding3)
+
+// embeddingInputs returns what to embed for each post: the post's text, or
+// for a post over the model's limit, each part of it in turn
+func embeddingInputs(posts []ForumPost) []PostToEmbed {
+	tok, maxTokens := TokenizerFor(embedModel), TokenBudget(embedModel, 0)
+	var inputs []PostToEmbed
+	for _, post := range posts {
+		parts := []ForumPost{post}
+		if tok.Count(post.Text()) > maxTokens {
+			parts = splitPost(tok, post, maxTokens)
+		}
+		for i, part := range parts {
+			inputs = append(inputs, PostToEmbed{
+				PostID:    post.PostID,
+				User:      post.User,
+				Message:   part.Text(),
+				ThreadID:  post.ThreadPath,
+				Timestamp: post.Timestamp,
+				Part:      i,
+			})
+		}
+	}
+	return inputs
+}
+
+// Parts after the first are embedded as "<post id>#<part>"
+func embeddingCustomID(postID string, part int) string {
+	if part == 0 {
+		return postID
+	}
+	return fmt.Sprintf("%s#%d", postID, part)
+}
+
+func parseEmbeddingCustomID(customID string) (postID string, part int) {
+	i := strings.LastIndex(customID, "#")
+	if i < 0 {
+		return customID, 0
+	}
+	part, err := strconv.Atoi(customID[i+1:])
+	if err != nil {
+		return customID, 0
+	}
+	return customID[:i], part
+}
+
+// embeddingPointID is the Qdrant ID for a post or part of one
+func embeddingPointID(post PostToEmbed) uint64 {
+	id := embeddingCustomID(post.PostID, post.Part)
+	if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return n
+	}
+	return uint64(hashString(id))
+}
+
 func GetAllForumPosts(db *sql.DB) ([]ForumPost, error) {
-	rows, err := db.Query("SELECT post_id, user, user_num, timestamp, message, thread_path FROM forum_posts")
+	rows, err := db.Query("SELECT post_id, user, user_num, timestamp, message, thread_path, COALESCE(clean_message, message) FROM forum_posts")
 	if err != nil {
 		return nil, fmt.Errorf("query failed: %w", err)
 	}
@@ -159,7 +204,7 @@ func GetAllForumPosts(db *sql.DB) ([]ForumPost, error) {
 	var posts []ForumPost
 	for rows.Next() {
 		var post ForumPost
-		if err := rows.Scan(&post.PostID, &post.User, &post.UserNum, &post.Timestamp, &post.Message, &post.ThreadPath); err != nil {
+		if err := rows.Scan(&post.PostID, &post.User, &post.UserNum, &post.Timestamp, &post.Message, &post.ThreadPath, &post.CleanMessage); err != nil {
 			return nil, fmt.Errorf("scan failed: %w", err)
 		}
 		posts = append(posts, post)
@@ -177,12 +222,8 @@ func InsertBatchEmbeddings(qdrantClient *qdrant.Client, embeddings [][]float32,
 	}
 	points := make([]*qdrant.PointStruct, len(posts))
 	for i, post := range posts {
-		postID, err := strconv.ParseUint(post.PostID, 10, 64)
-		if err != nil {
-			postID = uint64(hashString(post.PostID))
-		}
 		points[i] = &qdrant.PointStruct{
-			Id:      qdrant.NewIDNum(postID),
+			Id:      qdrant.NewIDNum(embeddingPointID(post)),
 			Vectors: qdrant.NewVectors(embeddings[i]...),
 			Payload: qdrant.NewValueMap(map[string]any{
 				"user":      post.User,
@@ -190,6 +231,7 @@ func InsertBatchEmbeddings(qdrantClient *qdrant.Client, embeddings [][]float32,
 				"timestamp": post.Timestamp,
 				"message":   post.Message,
 				"post_id":   post.PostID,
+				"part":      post.Part,
 			}),
 		}
 	}
@@ -213,18 +255,6 @@ func hashString(s string) int {
 	return hash
 }
 
-func EnsureBatchTable(db *sql.DB) error {
-	_, err := db.Exec(`
-	CREATE TABLE IF NOT EXISTS batch_jobs (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		batch_id TEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		completed BOOLEAN DEFAULT 0
-	);
-	`)
-	return err
-}
-
 func SaveBatchID(db *sql.DB, batchID string) error {
 	_, err := db.Exec(`INSERT INTO batch_jobs (batch_id, completed) VALUES (?, 0)`, batchID)
 	return err
@@ -243,7 +273,7 @@ func CompleteBatches() {
 }
 
 func MarkAllBatchesCompleted(db *sql.DB) error {
-	_, err := db.Exec(`UPDATE batch_jobs SET completed = 1 WHERE completed = 0`)
+	_, err := db.Exec(`UPDATE batch_jobs SET completed = 1 WHERE completed = 0 AND kind = 'embeddings'`)
 	return err
 }
 
@@ -267,7 +297,7 @@ func ListBatches() {
 }
 
 func GetUncompletedBatchIDs(db *sql.DB) ([]string, error) {
-	rows, err := db.Query(`SELECT batch_id FROM batch_jobs WHERE completed = 0`)
+	rows, err := db.Query(`SELECT batch_id FROM batch_jobs WHERE completed = 0 AND kind = 'embeddings'`)
 	if err != nil {
 		return nil, err
 	}